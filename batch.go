@@ -0,0 +1,424 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultBatchSize    = 100
+	defaultBatchMaxWait = time.Second
+)
+
+var ErrNack = errors.New("message nacked by server")
+
+// Message 批量发送的消息
+type Message struct {
+	Exchange   string
+	RoutingKey string
+	Body       []byte
+}
+
+// SendBatch 在同一个 Confirm Mode 的 Channel 上发送一批消息，发送完成后统一等待服务器确认。
+//
+// 参数 opts 对这一批消息都生效。如果 opts 为 nil，则表示使用默认配置。
+// 未被确认（nack、网络错误等）的消息会按照 SendOpts.retryable 的配置重发，已确认的消息不会被重发；
+// retryable 为 nil 表示只发送一次。ctx 结束后不再重发，也不再等待尚未返回的确认。
+//
+// 返回值 results 与 msgs 一一对应，nil 表示该消息已被服务器确认；只要有消息发送失败，err 就不为 nil。
+func (p *Producer) SendBatch(ctx context.Context, msgs []Message, opts *SendOpts) (results []error, err error) {
+	// 批量发送不创建 Span，但会将 ctx 中的链路上下文写入每条消息的消息头
+	opts = p.c.traceOpts(ctx, opts)
+	results = make([]error, len(msgs))
+	publishings := make([]amqp.Publishing, len(msgs))
+	pending := make([]int, 0, len(msgs))
+	for i, m := range msgs {
+		o := *opts
+		if publishings[i], results[i] = o.publishing(m.Body); results[i] == nil {
+			pending = append(pending, i)
+		}
+	}
+
+	b := &batchSender{p: p, msgs: msgs, publishings: publishings, results: results, opts: opts}
+	defer b.close()
+	getNonNilRetryable(opts.retryable).retry(func() (brk bool) {
+		if len(pending) > 0 {
+			pending = b.send(ctx, pending)
+		}
+		return len(pending) == 0 || ctx.Err() != nil || !p.c.CanRetry()
+	})
+
+	var failed int
+	for _, e := range results {
+		if e != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d messages failed to send", failed, len(msgs))
+	}
+	return results, err
+}
+
+// batchSender 批量发送的状态。Channel 在多轮重发之间复用，出现网络错误后才会重建。
+type batchSender struct {
+	p           *Producer
+	msgs        []Message
+	publishings []amqp.Publishing
+	results     []error
+	opts        *SendOpts
+
+	ch       *Channel
+	confirms chan amqp.Confirmation
+	seq      uint64 // 最后一条消息的 delivery tag
+}
+
+func (b *batchSender) open() error {
+	if b.ch != nil {
+		return nil
+	}
+	ch, err := b.p.c.Channel()
+	if err != nil {
+		return err
+	}
+	// 缓冲区足够容纳所有的确认消息，避免阻塞连接的读协程
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, len(b.msgs)))
+	if err = ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return err
+	}
+	b.ch, b.confirms, b.seq = ch, confirms, 0
+	return nil
+}
+
+func (b *batchSender) close() {
+	if b.ch != nil {
+		_ = b.ch.Close()
+		b.ch = nil
+		b.confirms = nil
+	}
+}
+
+// send 发送一轮消息并等待确认，返回失败的消息下标
+func (b *batchSender) send(ctx context.Context, pending []int) (failed []int) {
+	fail := func(err error, idx ...int) {
+		for _, i := range idx {
+			b.results[i] = err
+		}
+		failed = append(failed, idx...)
+	}
+	if err := ctx.Err(); err != nil {
+		fail(err, pending...)
+		return
+	}
+	if err := b.open(); err != nil {
+		fail(err, pending...)
+		return
+	}
+
+	var broken bool
+	tags := make(map[uint64]int, len(pending))
+	for k, i := range pending {
+		m := b.msgs[i]
+		err := b.ch.Publish(m.Exchange, m.RoutingKey, b.opts.mandatory, b.opts.immediate, b.publishings[i])
+		b.p.c.metrics().Published(m.Exchange, err)
+		if err != nil {
+			fail(err, pending[k:]...)
+			broken = broken || isConnectedErr(err)
+			break
+		}
+		b.seq++
+		tags[b.seq] = i
+	}
+
+	// 确认消息的 delivery tag 与发送顺序对应
+	rest := func(err error) {
+		for _, i := range tags {
+			fail(err, i)
+		}
+	}
+	for len(tags) > 0 {
+		select {
+		case confirm, ok := <-b.confirms:
+			if !ok {
+				rest(amqp.ErrClosed)
+				broken = true
+				tags = nil
+				break
+			}
+			i, ok := tags[confirm.DeliveryTag]
+			if !ok {
+				continue
+			}
+			delete(tags, confirm.DeliveryTag)
+			b.p.c.metrics().Confirmed(b.msgs[i].Exchange, confirm.Ack)
+			if confirm.Ack {
+				b.results[i] = nil
+			} else {
+				fail(ErrNack, i)
+			}
+		case <-ctx.Done():
+			rest(ctx.Err())
+			broken = true // 仍有未返回的确认，不再复用该 Channel
+			tags = nil
+		}
+	}
+	if broken {
+		b.close()
+	}
+	// 保持原有的发送顺序
+	sort.Ints(failed)
+	return failed
+}
+
+// BatchConsumerFunc 批量处理消息。
+//
+// 返回 nil 表示整批消息处理成功；返回 *BatchError 表示部分消息处理失败；返回其他错误表示整批消息处理失败。
+type BatchConsumerFunc func(deliveries []*amqp.Delivery) error
+
+// BatchError 表示一批消息中部分消息处理失败。Failed 为处理失败的消息在这一批消息中的下标。
+type BatchError struct {
+	Failed []int
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d messages in batch failed: %v", len(e.Failed), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// BatchOpts 批量接收选项。
+//
+// size 表示每批最多包含的消息数；maxWait 表示从收到一批中的第一条消息起，最多等待多久就处理这一批消息。
+// 两个条件满足其一，就会调用 BatchConsumerFunc。
+//
+// prefetch 表示 Channel 的预取数量（basic.qos），小于 size 时会使用 size，否则未确认的消息数达到预取数量后，
+// 服务器不会再投递消息，这一批消息永远也无法凑满。
+//
+// errDisposition 表示处理失败的消息的处置方式，默认为 DispositionRequeue。
+//
+// 处理成功的整批消息会使用 multiple=true 一次性确认；部分失败时，成功的消息会被逐个确认，失败的消息会被逐个处置。
+// 如果接收选项的 autoAck 为 true，则不会确认或处置任何消息。
+type BatchOpts struct {
+	size           int
+	maxWait        time.Duration
+	prefetch       int
+	errDisposition Disposition
+}
+
+func DefaultBatchOpts() *BatchOpts {
+	return &BatchOpts{size: defaultBatchSize, maxWait: defaultBatchMaxWait, errDisposition: DispositionRequeue}
+}
+
+type BatchOptsBuilder struct {
+	opts *BatchOpts
+}
+
+func NewBatchOptsBuilder() *BatchOptsBuilder {
+	return &BatchOptsBuilder{DefaultBatchOpts()}
+}
+
+func (bld *BatchOptsBuilder) SetSize(size int) *BatchOptsBuilder {
+	bld.opts.size = size
+	return bld
+}
+
+func (bld *BatchOptsBuilder) SetMaxWait(maxWait time.Duration) *BatchOptsBuilder {
+	bld.opts.maxWait = maxWait
+	return bld
+}
+
+func (bld *BatchOptsBuilder) SetPrefetch(prefetch int) *BatchOptsBuilder {
+	bld.opts.prefetch = prefetch
+	return bld
+}
+
+func (bld *BatchOptsBuilder) SetErrDisposition(d Disposition) *BatchOptsBuilder {
+	bld.opts.errDisposition = d
+	return bld
+}
+
+func (bld *BatchOptsBuilder) Build() *BatchOpts {
+	return bld.opts
+}
+
+// ReceiveBatch 持续接收消息，并按批交给 consumer 处理，除非 `<-chan amqp.Delivery` 关闭或消息被 DispositionStop 处置。
+//
+// 参数 opts 和 batch 如果为 nil，将分别使用 DefaultReceiveOpts() 和 DefaultBatchOpts() 作为默认配置。
+// 注意 DefaultReceiveOpts() 的 autoAck 为 true，批量处理通常需要将其设为 false。
+//
+// 与 ReceiveCtx 一样，如果 `<-chan amqp.Delivery` 因为连接断开或消费者被服务器取消而关闭，会返回对应的错误
+// （后者包装了 ErrConsumerCanceled）；主动停止接收时返回 nil。
+// 连接断开时，尚未处理的消息会被丢弃，服务器会将其重新投递。
+func (c *Channel) ReceiveBatch(queue string, consumer BatchConsumerFunc, opts *ReceiveOpts, batch *BatchOpts) error {
+	_, err := c.receiveBatch(queue, consumer, opts, checkBatch(consumer, batch))
+	return err
+}
+
+// checkBatch 校验批量接收的参数，batch 为 nil 时返回 DefaultBatchOpts()
+func checkBatch(consumer BatchConsumerFunc, batch *BatchOpts) *BatchOpts {
+	if consumer == nil {
+		panic("BatchConsumerFunc can't be nil")
+	}
+	if batch == nil {
+		batch = DefaultBatchOpts()
+	}
+	if batch.size <= 0 {
+		panic("batch size must be greater than 0")
+	}
+	return batch
+}
+
+// receiveBatch 同 ReceiveBatch，返回值 brk 表示是否因为消息被 DispositionStop 处置而主动停止接收
+func (c *Channel) receiveBatch(queue string, consumer BatchConsumerFunc, opts *ReceiveOpts, batch *BatchOpts) (brk bool, err error) {
+	if opts == nil {
+		opts = DefaultReceiveOpts()
+	}
+	prefetch := batch.prefetch
+	if prefetch < batch.size {
+		prefetch = batch.size
+	}
+	if err = c.Qos(prefetch, 0, false); err != nil {
+		return false, err
+	}
+	cancels, closes := c.consumerNotify()
+	deliveries, err := c.Consume(
+		queue,
+		opts.consumerTag,
+		opts.autoAck,
+		opts.exclusive,
+		opts.noLocal,
+		opts.noWait,
+		*getNonNilArgs(opts.args),
+	)
+	if err != nil {
+		return false, err
+	}
+	if opts.consuming != nil {
+		opts.consuming(c)
+	}
+	if c.consumeBatch(queue, deliveries, consumer, opts, batch) {
+		return true, nil
+	}
+	return false, closedReason(cancels, closes)
+}
+
+// consumeBatch 累积消息并按批处理，直到 deliveries 关闭或需要终止消费。返回值 brk 表示是否主动终止消费。
+func (c *Channel) consumeBatch(queue string, deliveries <-chan amqp.Delivery, consumer BatchConsumerFunc, opts *ReceiveOpts, batch *BatchOpts) (brk bool) {
+	buf := make([]*amqp.Delivery, 0, batch.size)
+	timer := time.NewTimer(batch.maxWait)
+	timer.Stop()
+	defer timer.Stop()
+
+	flush := func() (brk bool) {
+		// 清空可能已经触发的定时器，防止下一批消息被提前处理
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		start := time.Now()
+		err := consumer(buf)
+		elapsed := time.Since(start)
+		for range buf {
+			c.conn.metrics().Consumed(queue, elapsed)
+		}
+		brk = c.settleBatch(queue, buf, err, batch.errDisposition, opts.autoAck)
+		buf = make([]*amqp.Delivery, 0, batch.size)
+		return brk
+	}
+	for {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return false
+			}
+			if e := opts.restore(&delivery); e != nil {
+				c.conn.warn("restore message failed:", e, c.logField(), queueField(queue),
+					consumerField(delivery.ConsumerTag), deliveryTagField(delivery.DeliveryTag))
+				if opts.errDisposition.apply(c.conn, &delivery, opts.autoAck, c.logField(), queueField(queue)) {
+					return true
+				}
+				continue
+			}
+			buf = append(buf, &delivery)
+			if len(buf) == 1 {
+				timer.Reset(batch.maxWait)
+			}
+			if len(buf) >= batch.size && flush() {
+				return true
+			}
+		case <-timer.C:
+			if len(buf) > 0 && flush() {
+				return true
+			}
+		}
+	}
+}
+
+// settleBatch 根据处理结果确认或处置一批消息。返回值 brk 表示是否需要终止消费。
+func (c *Channel) settleBatch(queue string, buf []*amqp.Delivery, err error, d Disposition, autoAck bool) (brk bool) {
+	if err == nil {
+		if !autoAck {
+			// 同一 Channel 上的 delivery tag 是递增的，确认最后一条即可确认整批消息
+			if e := buf[len(buf)-1].Ack(true); e != nil {
+				c.conn.warn("ack batch failed:", e, c.logField(), queueField(queue), consumerField(buf[0].ConsumerTag))
+			}
+		}
+		return false
+	}
+
+	failed := make(map[int]bool, len(buf))
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		for _, i := range batchErr.Failed {
+			failed[i] = true
+		}
+	} else {
+		for i := range buf {
+			failed[i] = true
+		}
+	}
+	c.conn.warn(fmt.Sprintf("consume batch failed, %d of %d messages failed:", len(failed), len(buf)), err,
+		c.logField(), queueField(queue), consumerField(buf[0].ConsumerTag))
+	for i, delivery := range buf {
+		if !failed[i] {
+			if !autoAck {
+				if e := delivery.Ack(false); e != nil {
+					c.conn.warn("ack message failed:", e, c.logField(), queueField(queue),
+						consumerField(delivery.ConsumerTag), deliveryTagField(delivery.DeliveryTag))
+				}
+			}
+			continue
+		}
+		if d.apply(c.conn, delivery, autoAck, c.logField(), queueField(queue)) {
+			brk = true
+		}
+	}
+	return brk
+}
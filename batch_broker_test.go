@@ -0,0 +1,103 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+	"ezmq/ezmqtest"
+)
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("wait for condition timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReceiveBatch_reconnect(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err = ch.QueueDeclare("batch", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	batches := make(chan int, 10)
+	finished := make(chan error, 10)
+	opts := ezmq.NewReceiveOptsBuilder().SetAutoAck(false).Build()
+	batch := ezmq.NewBatchOptsBuilder().SetSize(2).SetMaxWait(20 * time.Millisecond).Build()
+	sub := conn.Consumer().ReceiveBatch("batch", opts, batch, func(ds []*amqp.Delivery) error {
+		batches <- len(ds)
+		return nil
+	}, func(err error) { finished <- err })
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := conn.Producer().Send("", "batch", []byte("msg"), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case got := <-batches:
+			if got != n {
+				t.Errorf("batch size = %d, want %d", got, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("receive batch timeout")
+		}
+	}
+	waitFor(t, time.Second, func() bool { return b.Consumers("batch") == 1 })
+	send(2)
+
+	b.CloseConnections()
+	select {
+	case err := <-finished:
+		if err == nil {
+			t.Error("finish error = nil, want the connection error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("finish timeout")
+	}
+	waitFor(t, time.Second, func() bool { return b.Consumers("batch") == 1 })
+	send(2)
+	waitFor(t, time.Second, func() bool { return b.Unacked("batch") == 0 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sub.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if n := b.Consumers("batch"); n != 0 {
+		t.Errorf("Consumers() after Stop = %d, want 0", n)
+	}
+}
@@ -0,0 +1,164 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestProducer_SendBatch_closed(t *testing.T) {
+	// 未连接的 Connection，Channel 返回 amqp.ErrClosed
+	conn := NewConnection(defaultURL, nil)
+	msgs := []Message{
+		{Exchange: "amq.direct", RoutingKey: "key.direct", Body: []byte("a")},
+		{Exchange: "amq.direct", RoutingKey: "key.direct", Body: []byte("b")},
+	}
+	opts := NewSendOptsBuilder().SetRetryable(nil).Build()
+	results, err := conn.Producer().SendBatch(context.Background(), msgs, opts)
+	if err == nil {
+		t.Fatal("SendBatch() error = nil, want error")
+	}
+	for i, e := range results {
+		if !errors.Is(e, amqp.ErrClosed) {
+			t.Errorf("results[%d] = %v, want %v", i, e, amqp.ErrClosed)
+		}
+	}
+}
+
+func TestProducer_SendBatch_ctx(t *testing.T) {
+	conn := NewConnection(defaultURL, DefaultTimesRetry())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	opts := NewSendOptsBuilder().SetRetryable(NewTimesRetry(true, 10*time.Millisecond, 0)).Build()
+	results, err := conn.Producer().SendBatch(ctx, []Message{{Exchange: "amq.direct", Body: []byte("a")}}, opts)
+	if err == nil {
+		t.Fatal("SendBatch() error = nil, want error")
+	}
+	if !errors.Is(results[0], context.DeadlineExceeded) {
+		t.Errorf("results[0] = %v, want %v", results[0], context.DeadlineExceeded)
+	}
+}
+
+// tagAcknowledger 按 delivery tag 记录消息的确认情况
+type tagAcknowledger struct {
+	mut      sync.Mutex
+	acked    []uint64 // 单独确认的消息
+	multiple []uint64 // 使用 multiple=true 确认的消息
+	nacked   []uint64
+}
+
+func (a *tagAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if multiple {
+		a.multiple = append(a.multiple, tag)
+	} else {
+		a.acked = append(a.acked, tag)
+	}
+	return nil
+}
+
+func (a *tagAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.nacked = append(a.nacked, tag)
+	return nil
+}
+
+func (a *tagAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestConsumeBatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		count        int
+		size         int
+		err          error
+		wantBatches  []int
+		wantMultiple []uint64
+		wantAcked    []uint64
+		wantNacked   []uint64
+	}{
+		{name: "by size", count: 4, size: 2, wantBatches: []int{2, 2}, wantMultiple: []uint64{2, 4}},
+		{name: "by max wait", count: 3, size: 2, wantBatches: []int{2, 1}, wantMultiple: []uint64{2, 3}},
+		{name: "all failed", count: 2, size: 2, err: errors.New("failed"),
+			wantBatches: []int{2}, wantNacked: []uint64{1, 2}},
+		{name: "partial failed", count: 3, size: 3, err: &BatchError{Failed: []int{1}},
+			wantBatches: []int{3}, wantAcked: []uint64{1, 3}, wantNacked: []uint64{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &tagAcknowledger{}
+			deliveries := make(chan amqp.Delivery, tt.count)
+			for i := 1; i <= tt.count; i++ {
+				deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: uint64(i)}
+			}
+			var batches []int
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				opts := NewReceiveOptsBuilder().SetAutoAck(false).Build()
+				batch := NewBatchOptsBuilder().SetSize(tt.size).SetMaxWait(20 * time.Millisecond).Build()
+				(&Channel{}).consumeBatch("queue", deliveries, func(ds []*amqp.Delivery) error {
+					batches = append(batches, len(ds))
+					return tt.err
+				}, opts, batch)
+			}()
+			time.Sleep(100 * time.Millisecond)
+			close(deliveries)
+			<-done
+
+			if !reflect.DeepEqual(batches, tt.wantBatches) {
+				t.Errorf("batches = %v, want %v", batches, tt.wantBatches)
+			}
+			if !reflect.DeepEqual(ack.multiple, tt.wantMultiple) {
+				t.Errorf("multiple acked = %v, want %v", ack.multiple, tt.wantMultiple)
+			}
+			if !reflect.DeepEqual(ack.acked, tt.wantAcked) {
+				t.Errorf("acked = %v, want %v", ack.acked, tt.wantAcked)
+			}
+			if !reflect.DeepEqual(ack.nacked, tt.wantNacked) {
+				t.Errorf("nacked = %v, want %v", ack.nacked, tt.wantNacked)
+			}
+		})
+	}
+}
+
+func TestSettleBatch_logger(t *testing.T) {
+	conn, buf := newLogConnection(t)
+	ch := &Channel{conn: conn, id: 7}
+	ch.settleBatch("orders", []*amqp.Delivery{{Acknowledger: closedAcknowledger{}, DeliveryTag: 1}},
+		errors.New("boom"), DispositionReject, false)
+	for _, want := range []string{
+		"consume batch failed, 1 of 1 messages failed: boom channel=7 queue=orders",
+		"settle message failed:",
+		"delivery_tag=1 channel=7 queue=orders",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("connection log %q does not contain %q", buf.String(), want)
+		}
+	}
+}
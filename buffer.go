@@ -0,0 +1,199 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrBufferFull = errors.New("send buffer is full")
+
+// OverflowPolicy 发送缓冲区已满时的处理策略
+type OverflowPolicy int
+
+const (
+	// OverflowBlock 阻塞发送者，直到缓冲区有空闲位置
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest 丢弃缓冲区中最早的消息
+	OverflowDropOldest
+	// OverflowError 返回 ErrBufferFull
+	OverflowError
+)
+
+type bufferedMessage struct {
+	exchange   string
+	routingKey string
+	body       []byte
+	opts       *SendOpts
+}
+
+// sendBuffer 有界的消息缓冲队列，先进先出
+type sendBuffer struct {
+	c        *Connection // 用于记录日志
+	size     int
+	policy   OverflowPolicy
+	queue    []*bufferedMessage
+	flushing bool
+	mut      sync.Mutex
+	notFull  *sync.Cond
+}
+
+func newSendBuffer(c *Connection, size int, policy OverflowPolicy) *sendBuffer {
+	b := &sendBuffer{c: c, size: size, policy: policy}
+	b.notFull = sync.NewCond(&b.mut)
+	return b
+}
+
+func (b *sendBuffer) push(msg *bufferedMessage) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	for len(b.queue) >= b.size {
+		switch b.policy {
+		case OverflowDropOldest:
+			b.c.warn("send buffer is full, drop the oldest message", Field{Key: "exchange", Value: b.queue[0].exchange})
+			b.queue[0] = nil
+			b.queue = b.queue[1:]
+		case OverflowError:
+			return ErrBufferFull
+		default:
+			b.notFull.Wait()
+		}
+	}
+	b.queue = append(b.queue, msg)
+	return nil
+}
+
+// next 返回队首的消息。如果缓冲区为空，则结束清空缓冲区并返回 nil。
+// 判断与结束在同一把锁中完成，防止并发 push 的消息无人发送。
+func (b *sendBuffer) next() *bufferedMessage {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if len(b.queue) == 0 {
+		b.flushing = false
+		return nil
+	}
+	return b.queue[0]
+}
+
+// remove 移除队首的 msg。如果 msg 已经因为 OverflowDropOldest 被丢弃，则不做任何操作。
+func (b *sendBuffer) remove(msg *bufferedMessage) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if len(b.queue) > 0 && b.queue[0] == msg {
+		b.queue[0] = nil
+		b.queue = b.queue[1:]
+		b.notFull.Signal()
+	}
+}
+
+func (b *sendBuffer) len() int {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	return len(b.queue)
+}
+
+// startFlush 标记开始清空缓冲区。如果已经有其他协程正在清空缓冲区，返回 false。
+func (b *sendBuffer) startFlush() bool {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if b.flushing {
+		return false
+	}
+	b.flushing = true
+	return true
+}
+
+func (b *sendBuffer) endFlush() {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.flushing = false
+}
+
+// EnableBuffer 启用发送缓冲区。启用后，如果连接断开（或正在重连），Send 不会阻塞或返回错误，
+// 而是将消息放入缓冲区，待重连成功后按顺序发送。缓冲区中仍有消息时，新的消息也会进入缓冲区，以保证发送顺序。
+//
+// 参数 size 表示缓冲区最多能容纳的消息数，必须大于 0；policy 表示缓冲区已满时的处理策略。
+//
+// 注意：缓冲区只存在于内存中，进程退出时缓冲区中的消息会丢失。如果需要持久化，请使用 Outbox。
+func (p *Producer) EnableBuffer(size int, policy OverflowPolicy) *Producer {
+	if size <= 0 {
+		panic("buffer size must be greater than 0")
+	}
+	p.buf = newSendBuffer(p.c, size, policy)
+	// 每次重连成功后，重连监听器会重新执行 Operation，从而发送缓冲区中的消息
+	p.c.RegisterAndExec(func(key string, ch *Channel) {
+		p.flush(ch)
+	})
+	return p
+}
+
+// BufferDepth 返回缓冲区中等待发送的消息数。如果未启用缓冲区，返回 0。
+func (p *Producer) BufferDepth() int {
+	if p.buf == nil {
+		return 0
+	}
+	return p.buf.len()
+}
+
+func (p *Producer) bufferSend(exchange string, routingKey string, body []byte, opts *SendOpts) error {
+	msg := &bufferedMessage{
+		exchange:   exchange,
+		routingKey: routingKey,
+		body:       append([]byte(nil), body...),
+	}
+	if opts != nil {
+		o := *opts
+		msg.opts = &o
+	}
+	if err := p.buf.push(msg); err != nil {
+		return err
+	}
+	if p.c.IsOpen() {
+		go p.flush(nil)
+	}
+	return nil
+}
+
+// flush 按顺序发送缓冲区中的消息，直到缓冲区为空或者连接断开。
+// 参数 ch 如果为 nil，则会创建新的 Channel。
+func (p *Producer) flush(ch *Channel) {
+	if !p.buf.startFlush() {
+		return
+	}
+	if ch == nil {
+		var err error
+		if ch, err = p.c.Channel(); err != nil {
+			p.buf.endFlush()
+			return
+		}
+		defer ch.Close()
+	}
+	for msg := p.buf.next(); msg != nil; msg = p.buf.next() {
+		err := ch.SendOpts(msg.exchange, msg.routingKey, msg.body, msg.opts)
+		if err != nil && isConnectedErr(err) {
+			// 保留消息，等待重连成功后再次发送
+			p.c.debug("flush send buffer interrupted:", err, ch.logField(), urlField(p.c.url))
+			p.buf.endFlush()
+			return
+		}
+		if err != nil {
+			p.c.warn("drop buffered message:", err, ch.logField())
+		}
+		p.buf.remove(msg)
+	}
+}
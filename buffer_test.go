@@ -0,0 +1,97 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendBuffer_overflow(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    OverflowPolicy
+		wantErr   error
+		wantFirst string
+		wantLog   string
+	}{
+		{name: "drop oldest", policy: OverflowDropOldest, wantFirst: "1",
+			wantLog: "send buffer is full, drop the oldest message exchange=0"},
+		{name: "error", policy: OverflowError, wantErr: ErrBufferFull, wantFirst: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, buf := newLogConnection(t)
+			b := newSendBuffer(conn, 2, tt.policy)
+			_ = b.push(&bufferedMessage{exchange: "0"})
+			_ = b.push(&bufferedMessage{exchange: "1"})
+			if err := b.push(&bufferedMessage{exchange: "2"}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("push() error = %v, want %v", err, tt.wantErr)
+			}
+			if b.len() != 2 {
+				t.Errorf("len() = %d, want 2", b.len())
+			}
+			if first := b.next(); first.exchange != tt.wantFirst {
+				t.Errorf("next() = %s, want %s", first.exchange, tt.wantFirst)
+			}
+			if !strings.Contains(buf.String(), tt.wantLog) {
+				t.Errorf("connection log %q does not contain %q", buf.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestSendBuffer_block(t *testing.T) {
+	b := newSendBuffer(nil, 1, OverflowBlock)
+	first := &bufferedMessage{exchange: "0"}
+	_ = b.push(first)
+	pushed := make(chan struct{})
+	go func() {
+		_ = b.push(&bufferedMessage{exchange: "1"})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push() should block while buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.remove(first)
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push() should be unblocked after remove()")
+	}
+}
+
+func TestProducer_Send_buffered(t *testing.T) {
+	// 未连接的 Connection，IsOpen 返回 false
+	conn := NewConnection(defaultURL, nil)
+	producer := conn.Producer().EnableBuffer(2, OverflowError)
+	for i := 0; i < 2; i++ {
+		if err := producer.Send("amq.direct", "key.direct", []byte("buffered"), nil); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+	if err := producer.Send("amq.direct", "key.direct", []byte("buffered"), nil); !errors.Is(err, ErrBufferFull) {
+		t.Errorf("Send() error = %v, want %v", err, ErrBufferFull)
+	}
+	if depth := producer.BufferDepth(); depth != 2 {
+		t.Errorf("BufferDepth() = %d, want 2", depth)
+	}
+}
@@ -17,8 +17,11 @@
 package ezmq
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
+
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -34,16 +37,31 @@ import (
 //
 // consumerTag 用于唯一识别一个消费者，如果不填可自动生成。
 //
+// envelope 如果设置了该选项，消息在交给消费者之前会校验签名并解密，详见 Envelope。
+//
+// errDisposition 表示消息体无法还原（如解压失败、解密失败、签名不匹配）时的处置方式，默认为 DispositionReject。
+//
+// resubscribe 表示消费者被服务器取消（如队列被删除、仲裁队列的 leader 发生迁移）后，Consumer.Receive 是否自动重新订阅，
+// 默认为 true。重新订阅前会先调用 redeclare（如果不为 nil）重新声明队列，并使用 Connection 的 Retryable 重试，直到队列可用。
+//
+// prefetch 表示 Channel 的预取数量（basic.qos），即最多可以有多少条未确认的消息，默认为 0，表示不限制。autoAck 为 true 时无效。
+//
 // 其他参数如果没有特别需求，默认不填即可。
 type ReceiveOpts struct {
 	autoAck, exclusive, noLocal, noWait bool
 	args                                *amqp.Table
 	consumerTag                         string
+	envelope                            *Envelope
+	errDisposition                      Disposition
+	resubscribe                         bool
+	redeclare                           func() error
+	prefetch                            int
+	consuming                           func(ch *Channel) // 订阅成功后调用，用于 Subscription 记录正在消费的 Channel
 }
 
-// DefaultReceiveOpts 将 ReceiveOpts.autoAck 默认设置为 true
+// DefaultReceiveOpts 将 ReceiveOpts.autoAck 和 ReceiveOpts.resubscribe 默认设置为 true
 func DefaultReceiveOpts() *ReceiveOpts {
-	return &ReceiveOpts{autoAck: true}
+	return &ReceiveOpts{autoAck: true, resubscribe: true}
 }
 
 type ReceiveOptsBuilder struct {
@@ -85,6 +103,36 @@ func (bld *ReceiveOptsBuilder) SetConsumerTag(tag string) *ReceiveOptsBuilder {
 	return bld
 }
 
+// 设置消息的签名校验和解密配置，详见 Envelope
+func (bld *ReceiveOptsBuilder) SetEnvelope(envelope *Envelope) *ReceiveOptsBuilder {
+	bld.opts.envelope = envelope
+	return bld
+}
+
+// 设置消息体无法还原（如解压失败、解密失败、签名不匹配）时的处置方式
+func (bld *ReceiveOptsBuilder) SetErrDisposition(d Disposition) *ReceiveOptsBuilder {
+	bld.opts.errDisposition = d
+	return bld
+}
+
+// 设置消费者被服务器取消后是否自动重新订阅
+func (bld *ReceiveOptsBuilder) SetResubscribe(b bool) *ReceiveOptsBuilder {
+	bld.opts.resubscribe = b
+	return bld
+}
+
+// 设置重新订阅前重新声明队列的方法，如 func() error { return queue.DeclareAndBind(name, key, exchange) }
+func (bld *ReceiveOptsBuilder) SetRedeclare(fn func() error) *ReceiveOptsBuilder {
+	bld.opts.redeclare = fn
+	return bld
+}
+
+// 设置预取数量
+func (bld *ReceiveOptsBuilder) SetPrefetch(prefetch int) *ReceiveOptsBuilder {
+	bld.opts.prefetch = prefetch
+	return bld
+}
+
 func (bld *ReceiveOptsBuilder) Build() *ReceiveOpts {
 	return bld.opts
 }
@@ -105,11 +153,20 @@ func (bld *ReceiveOptsBuilder) Build() *ReceiveOpts {
 // messageFactory 如果未设置该选项，则默认使用 MessagePlainTransient 生产消息。
 //
 // retryable 如果不设置该选项，表示不启用消息重发功能。
+//
+// compressor 如果设置了该选项，消息体长度不小于 compressThreshold 时会被压缩，并设置 ContentEncoding。
+// 如果消息工厂方法已经设置了 ContentEncoding，则不会再压缩。
+//
+// envelope 如果设置了该选项，消息体会在压缩后被加密和签名，详见 Envelope。
 type SendOpts struct {
-	mandatory      bool
-	immediate      bool
-	messageFactory MessageFactory
-	retryable      Retryable
+	mandatory         bool
+	immediate         bool
+	messageFactory    MessageFactory
+	retryable         Retryable
+	compressor        Compressor
+	compressThreshold int
+	envelope          *Envelope
+	traceHeaders      amqp.Table // 链路上下文，发送时写入消息头，见 Channel.SendCtx
 }
 
 // DefaultSendOpts 默认消息发送选项：消息无格式，非持久化，启用默认重试配置(DefaultTimesRetry)
@@ -153,6 +210,19 @@ func (bld *SendOptsBuilder) SetRetryable(retryable Retryable) *SendOptsBuilder {
 	return bld
 }
 
+// 设置压缩配置。消息体长度不小于 threshold 时才会被压缩。compressor 为 nil 表示不压缩。
+func (bld *SendOptsBuilder) SetCompressor(compressor Compressor, threshold int) *SendOptsBuilder {
+	bld.opts.compressor = compressor
+	bld.opts.compressThreshold = threshold
+	return bld
+}
+
+// 设置消息的加密和签名配置，详见 Envelope
+func (bld *SendOptsBuilder) SetEnvelope(envelope *Envelope) *SendOptsBuilder {
+	bld.opts.envelope = envelope
+	return bld
+}
+
 func (bld *SendOptsBuilder) Build() *SendOpts {
 	return bld.opts
 }
@@ -163,20 +233,45 @@ func (bld *SendOptsBuilder) Build() *SendOpts {
 // 返回值 brk 表示是否 break，即在循环消费过程中是否需要终止消费。
 type ConsumerFunc func(*amqp.Delivery) (brk bool)
 
+// ContextConsumerFunc 与 ConsumerFunc 相同。ctx 包含从消息头中提取的链路上下文，以及处理消息的 Span（如果设置了 Tracer）。
+type ContextConsumerFunc func(ctx context.Context, delivery *amqp.Delivery) (brk bool)
+
 type Channel struct {
-	*amqp.Channel
-	conn       *Connection            // 用于断线重连
-	confirming bool                   // producer
-	confirms   chan amqp.Confirmation // producer
+	AMQPChannel
+	id          uint64                 // 用于在日志中区分 Channel
+	conn        *Connection            // 用于断线重连
+	confirming  bool                   // producer
+	confirms    chan amqp.Confirmation // producer
+	abandoned   int                    // 因 ctx 结束而不再等待的确认消息数，这些确认消息之后仍会到达 confirms
+	transacting bool                   // 是否处于事务模式，与 Confirm Mode 互斥
+	cancels     chan string            // consumer
+	closes      chan *amqp.Error       // consumer
 }
 
-func newChannel(ch *amqp.Channel, conn *Connection) *Channel {
+var channelID = AdderGenerator(1)
+
+func newChannel(ch AMQPChannel, conn *Connection) *Channel {
 	return &Channel{
-		Channel: ch,
-		conn:    conn,
+		AMQPChannel: ch,
+		id:          channelID(),
+		conn:        conn,
 	}
 }
 
+// logField 返回用于在日志中标识 Channel 的字段
+func (c *Channel) logField() Field {
+	return channelField(c.id)
+}
+
+// AMQP 返回底层的 *amqp.Channel，用于调用 AMQPChannel 中没有的方法，如 PublishWithContext、NotifyFlow 和 GetNextPublishSeqNo。
+// 使用其他 Dialer（如 ezmqtest.Broker）时返回 nil。
+//
+// 注意：断线重连时底层的 Channel 会被替换，不要长期持有返回值。
+func (c *Channel) AMQP() *amqp.Channel {
+	ch, _ := c.AMQPChannel.(*amqp.Channel)
+	return ch
+}
+
 func (c *Channel) RemoveOperation(key string) {
 	c.conn.RemoveOperation(key)
 }
@@ -190,17 +285,36 @@ func (c *Channel) RemoveOperation(key string) {
 // 是因为消费者有可能会需要拒绝确认，或在消费出现错误时不进行确认。
 //
 // 参数 consumer 用于处理接收操作。参数 consumer 一定不能为 nil，否则将 panic。
+// 消息在交给 consumer 之前，会按需校验签名、解密，并根据 ContentEncoding 自动解压，
+// 失败的消息按照 ReceiveOpts.errDisposition 处置。
 //
-// 返回值：当 `<-chan amqp.Delivery` 关闭或 ConsumerFunc 主动放弃接收，返回 nil；其他情况则返回 error
+// 返回值：当 ConsumerFunc 主动放弃接收或 Channel 被正常关闭，返回 nil；消费者被服务器取消时，返回包装了
+// ErrConsumerCanceled 的 error；Channel 或 Connection 异常关闭时，返回关闭的原因；其他情况则返回 error
 func (c *Channel) ReceiveOpts(queue string, consumer ConsumerFunc, opts *ReceiveOpts) error {
-	var err error
 	if consumer == nil {
 		panic("ConsumerFunc can't be nil")
 	}
+	return c.ReceiveCtx(queue, func(_ context.Context, delivery *amqp.Delivery) bool {
+		return consumer(delivery)
+	}, opts)
+}
+
+// ReceiveCtx 与 ReceiveOpts 相同，但会从消息头中提取链路上下文并创建处理消息的 Span，详见 ContextConsumerFunc 和 SetTracing
+func (c *Channel) ReceiveCtx(queue string, consumer ContextConsumerFunc, opts *ReceiveOpts) error {
+	var err error
+	if consumer == nil {
+		panic("ContextConsumerFunc can't be nil")
+	}
 	if opts == nil {
 		opts = DefaultReceiveOpts()
 	}
 
+	if opts.prefetch > 0 && !opts.autoAck {
+		if err = c.Qos(opts.prefetch, 0, false); err != nil {
+			return err
+		}
+	}
+	cancels, closes := c.consumerNotify()
 	deliveries, err := c.Consume(
 		queue,
 		opts.consumerTag,
@@ -213,11 +327,112 @@ func (c *Channel) ReceiveOpts(queue string, consumer ConsumerFunc, opts *Receive
 	if err != nil {
 		return err
 	}
+	if opts.consuming != nil {
+		opts.consuming(c)
+	}
 	for delivery := range deliveries {
-		if consumer(&delivery) {
-			break
+		if e := opts.restore(&delivery); e != nil {
+			c.conn.warn("restore message failed:", e, c.logField(), queueField(queue),
+				consumerField(delivery.ConsumerTag), deliveryTagField(delivery.DeliveryTag))
+			if opts.errDisposition.apply(c.conn, &delivery, opts.autoAck, c.logField(), queueField(queue)) {
+				return nil
+			}
+			continue
+		}
+		ctx, span := c.conn.startConsumerSpan(queue, &delivery)
+		start := time.Now()
+		brk := consumer(ctx, &delivery)
+		c.conn.metrics().Consumed(queue, time.Since(start))
+		span.End(nil)
+		if brk {
+			return nil
+		}
+	}
+	return closedReason(cancels, closes)
+}
+
+// consumerNotify 返回用于区分 deliveries 关闭原因的通知通道。每个 Channel 上只有一个消费者，缓冲区为 1 即可。
+// 通道只注册一次，防止重新订阅后旧的通道无人读取，从而阻塞 amqp091 的读协程。
+func (c *Channel) consumerNotify() (chan string, chan *amqp.Error) {
+	if c.cancels == nil {
+		c.cancels = c.NotifyCancel(make(chan string, 1))
+		c.closes = c.NotifyClose(make(chan *amqp.Error, 1))
+	}
+	return c.cancels, c.closes
+}
+
+// closedReason 返回 deliveries 关闭的原因。amqp091 会在关闭 deliveries 之前发送取消或关闭通知。
+func closedReason(cancels <-chan string, closes <-chan *amqp.Error) error {
+	select {
+	case tag, ok := <-cancels:
+		if ok {
+			return fmt.Errorf("%w, consumer tag: %s", ErrConsumerCanceled, tag)
 		}
+	default:
 	}
+	select {
+	case e, ok := <-closes:
+		if ok && e != nil {
+			return e
+		}
+	default:
+	}
+	return nil
+}
+
+// awaitQueue 在消费者被服务器取消后，按照 Connection 的 Retryable 重新声明队列（redeclare 不为 nil 时），
+// 直到队列可用或 stopped 返回 true。队列不存在会导致 Channel 被服务器关闭，此时会重建 Channel。
+func (c *Channel) awaitQueue(queue string, redeclare func() error, stopped func() bool) (err error) {
+	getNonNilRetryable(c.conn.retryable).retry(func() (brk bool) {
+		if stopped() {
+			err = nil
+			return true
+		}
+		if !c.conn.IsOpen() {
+			// 断线后，重连监听器会重新执行 Operation
+			err = amqp.ErrClosed
+			return true
+		}
+		if c.IsClosed() {
+			var ch AMQPChannel
+			if ch, err = c.conn.channel(); err != nil {
+				return !c.conn.CanRetry()
+			}
+			c.resetChannel(ch)
+		}
+		if redeclare != nil {
+			if err = redeclare(); err != nil {
+				c.conn.debug("redeclare queue failed:", err, c.logField(), queueField(queue))
+				return !c.conn.CanRetry()
+			}
+		}
+		_, err = c.QueueDeclarePassive(queue, false, false, false, false, nil)
+		return err == nil || !c.conn.CanRetry()
+	})
+	return err
+}
+
+// restore 将消息体还原为发送前的内容：校验签名并解密，然后根据 ContentEncoding 解压消息体。
+// 未注册的 ContentEncoding 会被原样保留。
+func (opts *ReceiveOpts) restore(delivery *amqp.Delivery) error {
+	if opts.envelope != nil {
+		if err := opts.envelope.open(delivery); err != nil {
+			return err
+		}
+	}
+	if delivery.ContentEncoding == "" {
+		return nil
+	}
+	compressor, ok := CompressorFor(delivery.ContentEncoding)
+	if !ok {
+		return nil
+	}
+	body, err := compressor.Decompress(delivery.Body)
+	if err != nil {
+		return err
+	}
+	delivery.Body = body
+	delivery.ContentEncoding = ""
 	return nil
 }
 
@@ -237,41 +452,93 @@ func (c *Channel) Send(exchange string, routingKey string, body []byte) error {
 // 参数 opts 即发送消息需要配置的选项。如果 opts 为 nil，则表示使用默认配置。可以通过配置 SendOpts.retryable
 // 启用消息重发的能力。请注意，由于消息重发使用的是同步的方式处理 ack，因此启用消息重发会极大降低 QPS。
 func (c *Channel) SendOpts(exchange string, routingKey string, body []byte, opts *SendOpts) error {
-	if opts == nil {
-		opts = DefaultSendOpts()
-	}
+	return c.SendCtx(context.Background(), exchange, routingKey, body, opts)
+}
+
+// SendCtx 与 SendOpts 相同。此外会创建发送消息的 Span，并将 ctx 中的链路上下文写入消息头，详见 SetTracing。
+func (c *Channel) SendCtx(ctx context.Context, exchange string, routingKey string, body []byte, opts *SendOpts) (err error) {
+	ctx, span := c.conn.startProducerSpan(ctx, exchange, routingKey)
+	defer func() { span.End(err) }()
+	opts = c.conn.traceOpts(ctx, opts)
 	if opts.retryable == nil {
 		return c.sendOpts(exchange, routingKey, body, opts)
 	}
-	return c.reSendSyncOpts(exchange, routingKey, body, opts)
+	return c.reSendSyncOpts(ctx, exchange, routingKey, body, opts)
 }
 
 // sendOpts 发送消息，但不确保送达。参数 opts 一定不能为 nil。
 func (c *Channel) sendOpts(exchange string, routingKey string, body []byte, opts *SendOpts) error {
+	msg, err := opts.publishing(body)
+	if err != nil {
+		return err
+	}
+	err = c.Publish(exchange, routingKey, opts.mandatory, opts.immediate, msg)
+	c.conn.metrics().Published(exchange, err)
+	return err
+}
+
+// publishing 使用消息工厂方法生产消息，并按需压缩、加密和签名
+func (opts *SendOpts) publishing(body []byte) (amqp.Publishing, error) {
 	opts.messageFactory = getNonNilMessageFactory(opts.messageFactory)
-	return c.Publish(exchange, routingKey, opts.mandatory, opts.immediate, opts.messageFactory(body))
+	msg := opts.messageFactory(body)
+	if len(opts.traceHeaders) > 0 {
+		// 复制消息头，防止修改消息工厂方法共享的 Table
+		headers := make(amqp.Table, len(msg.Headers)+len(opts.traceHeaders))
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		for k, v := range opts.traceHeaders {
+			headers[k] = v
+		}
+		msg.Headers = headers
+	}
+	if opts.compressor != nil && msg.ContentEncoding == "" && len(msg.Body) >= opts.compressThreshold {
+		compressed, err := opts.compressor.Compress(msg.Body)
+		if err != nil {
+			return msg, err
+		}
+		msg.Body = compressed
+		msg.ContentEncoding = opts.compressor.Encoding()
+	}
+	if opts.envelope != nil {
+		if err := opts.envelope.seal(&msg); err != nil {
+			return msg, err
+		}
+	}
+	return msg, nil
 }
 
 // reSendSyncOpts 按照 Retryable 的配置内容确保发送消息是否到达。
 // 该方法会在发送后等待确认消息，由于消息的发送和确认是同步的，所以在消息确认之前，不会继续发送下一个消息。
 // 如果不想后续的消息被阻塞，请使用不同的 Channel 或 Connection 发送。
-func (c *Channel) reSendSyncOpts(exchange string, routingKey string, body []byte, opts *SendOpts) (err error) {
+// ctx 结束后不再重发，也不再等待确认，返回 ctx.Err()。
+func (c *Channel) reSendSyncOpts(ctx context.Context, exchange string, routingKey string, body []byte, opts *SendOpts) (err error) {
 	err = c.enableConfirm()
 	if err != nil && !isConnectedErr(err) {
 		return err
 	}
 
 	var retryable = opts.retryable
-	var confirm *amqp.Confirmation
+	var confirm = &amqp.Confirmation{}
+	attempt := 0
 	retryable.retry(func() (brk bool) {
-		confirm, err = c.sendAndWaitConfirmation(exchange, routingKey, body, opts)
-		if confirm.Ack || !c.conn.CanRetry() {
+		if ctx.Err() != nil {
+			return true
+		}
+		if attempt++; attempt > 1 {
+			c.conn.metrics().Retried(exchange)
+		}
+		confirm, err = c.sendAndWaitConfirmation(ctx, exchange, routingKey, body, opts)
+		if confirm.Ack || ctx.Err() != nil || !c.conn.CanRetry() {
 			return true
 		}
 		c.resetChannelIfNeeded(err)
 		return false
 	})
 	if !confirm.Ack {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
 		if err != nil {
 			err = fmt.Errorf("send failed, cause nack: %w", err)
 		} else {
@@ -282,20 +549,39 @@ func (c *Channel) reSendSyncOpts(exchange string, routingKey string, body []byte
 }
 
 // sendAndWaitConfirmation 发送消息并等待确认信息。需要配合 enableConfirm 一起使用。
-func (c *Channel) sendAndWaitConfirmation(exchange string, routingKey string, body []byte, opts *SendOpts) (*amqp.Confirmation, error) {
+//
+// ctx 结束时不再等待，返回 ctx.Err()。同一 Channel 上的确认消息按照发送顺序返回，
+// 被放弃的确认消息会在下一次等待时被跳过。
+func (c *Channel) sendAndWaitConfirmation(ctx context.Context, exchange string, routingKey string, body []byte, opts *SendOpts) (*amqp.Confirmation, error) {
 	err := c.sendOpts(exchange, routingKey, body, opts)
-	confirm := <-c.confirms
-	return &confirm, err
+	if err != nil {
+		// 消息没有发送，不会有对应的确认消息
+		return &amqp.Confirmation{}, err
+	}
+	for {
+		select {
+		case confirm := <-c.confirms:
+			if c.abandoned > 0 && confirm.DeliveryTag != 0 {
+				c.abandoned--
+				continue
+			}
+			c.conn.metrics().Confirmed(exchange, confirm.Ack)
+			return &confirm, nil
+		case <-ctx.Done():
+			c.abandoned++
+			return &amqp.Confirmation{}, ctx.Err()
+		}
+	}
 }
 
-// resetChannelIfNeeded 如果必要（发生网络错误），则重置 Channel.Channel
+// resetChannelIfNeeded 如果必要（发生网络错误），则重置 Channel.AMQPChannel
 func (c *Channel) resetChannelIfNeeded(err error) bool {
 	if err == nil || !isConnectedErr(err) {
 		// 如果 err==nil 也会从此退出
 		return false
 	}
 	var e error
-	var ch *amqp.Channel
+	var ch AMQPChannel
 	var conn = c.conn
 
 	if !conn.IsOpen() {
@@ -303,13 +589,13 @@ func (c *Channel) resetChannelIfNeeded(err error) bool {
 	}
 
 	if ch, e = conn.channel(); e != nil {
-		debug(e)
+		c.conn.debug("reopen channel failed:", e, c.logField())
 		return false
 	}
 
 	c.resetChannel(ch)
 	if e = c.enableConfirm(); e != nil {
-		debug(e)
+		c.conn.debug("enable confirm mode failed:", e, c.logField())
 		return false
 	}
 	return true
@@ -322,22 +608,36 @@ func (c *Channel) enableConfirm() error {
 	if c.confirming {
 		return nil
 	}
+	if c.transacting {
+		return ErrTxMode
+	}
 	defer func() { c.confirming = true }()
-	c.confirms = c.Channel.NotifyPublish(make(chan amqp.Confirmation, 1))
-	if err := c.Channel.Confirm(false); err != nil {
+	c.confirms = c.AMQPChannel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	// 记录被退回的消息。Channel 关闭时 returns 会被关闭，协程随之退出。
+	returns := c.AMQPChannel.NotifyReturn(make(chan amqp.Return, 1))
+	go func(metrics MetricsRecorder) {
+		for r := range returns {
+			metrics.Returned(r.Exchange, r.RoutingKey)
+		}
+	}(c.conn.metrics())
+	if err := c.AMQPChannel.Confirm(false); err != nil {
 		return err
 	}
 	return nil
 }
 
-// resetChannel 重置 Channel。关闭旧的 amqp.Channel，赋予新的 amqp.Channel，重置 Confirm Mode。
-func (c *Channel) resetChannel(ch *amqp.Channel) {
-	err := c.Channel.Close()
+// resetChannel 重置 Channel。关闭旧的 AMQPChannel，赋予新的 AMQPChannel，重置 Confirm Mode。
+func (c *Channel) resetChannel(ch AMQPChannel) {
+	err := c.AMQPChannel.Close()
 	if err != nil {
-		debug(err)
+		c.conn.debug("close channel failed:", err, c.logField())
 	}
-	c.Channel = ch
-	// 重置 Confirm Mode
+	c.AMQPChannel = ch
+	// 重置 Confirm Mode 和事务模式
 	c.confirming = false
 	c.confirms = nil
+	c.abandoned = 0
+	c.transacting = false
+	c.cancels = nil
+	c.closes = nil
 }
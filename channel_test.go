@@ -17,6 +17,7 @@
 package ezmq
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -185,3 +186,41 @@ func TestChannel_Receive_limit_time(t *testing.T) {
 	}()
 	time.Sleep(time.Minute * 3)
 }
+
+func TestClosedReason(t *testing.T) {
+	closeErr := &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND"}
+	tests := []struct {
+		name     string
+		cancel   bool
+		closeErr *amqp.Error
+		want     error
+	}{
+		{name: "canceled by server", cancel: true, want: ErrConsumerCanceled},
+		{name: "closed abnormally", closeErr: closeErr, want: closeErr},
+		{name: "closed normally"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cancels := make(chan string, 1)
+			closes := make(chan *amqp.Error, 1)
+			if tt.cancel {
+				cancels <- "ctag"
+			}
+			if tt.closeErr != nil {
+				closes <- tt.closeErr
+			}
+			close(closes)
+			err := closedReason(cancels, closes)
+			if tt.want == nil && err != nil || !errors.Is(err, tt.want) {
+				t.Errorf("closedReason() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChannel_AMQP(t *testing.T) {
+	raw := &amqp.Channel{}
+	if got := newChannel(raw, nil).AMQP(); got != raw {
+		t.Errorf("AMQP() = %p, want %p", got, raw)
+	}
+}
@@ -0,0 +1,110 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Dialer 用于连接服务器。默认使用 amqp091-go 连接 RabbitMQ（见 DefaultDialer），
+// 可以替换为测试用的实现，如 ezmqtest.Broker。
+type Dialer interface {
+	Dial(url string) (AMQPConnection, error)
+}
+
+// DialerFunc 将函数适配为 Dialer
+type DialerFunc func(url string) (AMQPConnection, error)
+
+func (f DialerFunc) Dial(url string) (AMQPConnection, error) {
+	return f(url)
+}
+
+// DefaultDialer 使用 amqp.Dial 连接服务器
+var DefaultDialer Dialer = DialerFunc(func(url string) (AMQPConnection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+})
+
+// AMQPConnection 是 Connection 依赖的底层连接，语义与 *amqp.Connection 的同名方法一致。
+//
+// 连接异常断开时，实现必须向 NotifyClose 注册的通道发送 *amqp.Error，然后关闭通道；正常关闭时只关闭通道。
+// 只有 Code 为 amqp.ConnectionForced、Reason 为 EOF 或者包装了 amqp.ErrClosed 的错误才会触发断线重连。
+type AMQPConnection interface {
+	Channel() (AMQPChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking
+	IsClosed() bool
+	Close() error
+}
+
+// AMQPChannel 是 Channel 依赖的底层 Channel，语义与 *amqp.Channel 的同名方法一致。
+// Channel 内嵌了 AMQPChannel，因此可以直接调用这些方法。
+type AMQPChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Cancel(consumer string, noWait bool) error
+
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDelete(name string, ifUnused, noWait bool) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	ExchangeUnbind(destination, key, source string, noWait bool, args amqp.Table) error
+
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error)
+	Ack(tag uint64, multiple bool) error
+	Nack(tag uint64, multiple bool, requeue bool) error
+	Reject(tag uint64, requeue bool) error
+
+	Confirm(noWait bool) error
+	Tx() error
+	TxCommit() error
+	TxRollback() error
+
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyCancel(c chan string) chan string
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+
+	IsClosed() bool
+	Close() error
+}
+
+var _ AMQPChannel = (*amqp.Channel)(nil)
+
+// amqpConnection 将 *amqp.Connection 适配为 AMQPConnection
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (AMQPChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
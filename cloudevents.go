@@ -0,0 +1,400 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	ContentTypeCloudEvents     = "application/cloudevents+json"
+	CloudEventsSpecVersion     = "1.0"
+	cloudEventsHeaderPrefix    = "cloudEvents:"
+	cloudEventsHeaderPrefixAlt = "cloudEvents_" // 部分不支持冒号的客户端使用下划线作为前缀
+)
+
+var ErrInvalidEvent = errors.New("invalid cloud event")
+
+// EventMode CloudEvents 的消息编码模式
+type EventMode int
+
+const (
+	// EventModeBinary 事件属性以 `cloudEvents:` 为前缀写入消息头，datacontenttype 写入 ContentType，事件数据即消息体。
+	EventModeBinary EventMode = iota
+	// EventModeStructured 整个事件编码为 JSON 作为消息体，ContentType 为 application/cloudevents+json。
+	EventModeStructured
+)
+
+// Event CloudEvents 1.0 事件。
+//
+// ID、Source、SpecVersion 和 Type 为必填属性，SpecVersion 为空时发送会使用 CloudEventsSpecVersion。
+// Extensions 为扩展属性，名称只能由小写字母和数字组成。
+type Event struct {
+	ID              string
+	Source          string
+	SpecVersion     string
+	Type            string
+	DataContentType string
+	DataSchema      string
+	Subject         string
+	Time            time.Time
+	Extensions      map[string]interface{}
+	Data            []byte
+}
+
+// Validate 校验事件是否符合 CloudEvents 1.0 规范
+func (e *Event) Validate() error {
+	switch {
+	case e.ID == "":
+		return fmt.Errorf("%w: id is required", ErrInvalidEvent)
+	case e.Source == "":
+		return fmt.Errorf("%w: source is required", ErrInvalidEvent)
+	case e.Type == "":
+		return fmt.Errorf("%w: type is required", ErrInvalidEvent)
+	case e.SpecVersion != CloudEventsSpecVersion:
+		return fmt.Errorf("%w: unsupported specversion %q", ErrInvalidEvent, e.SpecVersion)
+	}
+	for name := range e.Extensions {
+		if !isValidAttributeName(name) {
+			return fmt.Errorf("%w: invalid extension name %q", ErrInvalidEvent, name)
+		}
+		if isContextAttribute(name) {
+			return fmt.Errorf("%w: extension %q conflicts with context attribute", ErrInvalidEvent, name)
+		}
+	}
+	return nil
+}
+
+// DataAs 根据 DataContentType 选择已注册的 Codec 解码事件数据，DataContentType 为空时使用 JSONCodec
+func (e *Event) DataAs(v interface{}) error {
+	codec := JSONCodec
+	if e.DataContentType != "" {
+		c, ok := CodecFor(e.DataContentType)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownContentType, e.DataContentType)
+		}
+		codec = c
+	}
+	return codec.Unmarshal(e.Data, v)
+}
+
+// eventMessageFactory 使用 factory 生产消息，并按照 mode 将事件写入消息
+func eventMessageFactory(event *Event, mode EventMode, factory MessageFactory) MessageFactory {
+	factory = getNonNilMessageFactory(factory)
+	return func(body []byte) amqp.Publishing {
+		msg := factory(body)
+		if mode == EventModeStructured {
+			msg.ContentType = ContentTypeCloudEvents
+			return msg
+		}
+		headers := make(amqp.Table, len(msg.Headers)+len(event.Extensions)+6)
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		for k, v := range event.binaryHeaders() {
+			headers[k] = v
+		}
+		msg.Headers = headers
+		msg.ContentType = event.DataContentType
+		return msg
+	}
+}
+
+func (e *Event) binaryHeaders() amqp.Table {
+	headers := amqp.Table{
+		cloudEventsHeaderPrefix + "id":          e.ID,
+		cloudEventsHeaderPrefix + "source":      e.Source,
+		cloudEventsHeaderPrefix + "specversion": e.SpecVersion,
+		cloudEventsHeaderPrefix + "type":        e.Type,
+	}
+	if e.DataSchema != "" {
+		headers[cloudEventsHeaderPrefix+"dataschema"] = e.DataSchema
+	}
+	if e.Subject != "" {
+		headers[cloudEventsHeaderPrefix+"subject"] = e.Subject
+	}
+	if !e.Time.IsZero() {
+		headers[cloudEventsHeaderPrefix+"time"] = e.Time.Format(time.RFC3339Nano)
+	}
+	for k, v := range e.Extensions {
+		headers[cloudEventsHeaderPrefix+k] = v
+	}
+	return headers
+}
+
+// marshalStructured 将事件编码为 CloudEvents JSON 格式
+func (e *Event) marshalStructured() ([]byte, error) {
+	m := make(map[string]interface{}, len(e.Extensions)+9)
+	for k, v := range e.Extensions {
+		m[k] = v
+	}
+	m["id"] = e.ID
+	m["source"] = e.Source
+	m["specversion"] = e.SpecVersion
+	m["type"] = e.Type
+	if e.DataContentType != "" {
+		m["datacontenttype"] = e.DataContentType
+	}
+	if e.DataSchema != "" {
+		m["dataschema"] = e.DataSchema
+	}
+	if e.Subject != "" {
+		m["subject"] = e.Subject
+	}
+	if !e.Time.IsZero() {
+		m["time"] = e.Time.Format(time.RFC3339Nano)
+	}
+	if e.Data != nil {
+		if isJSONContentType(e.DataContentType) && json.Valid(e.Data) {
+			m["data"] = json.RawMessage(e.Data)
+		} else {
+			m["data_base64"] = base64.StdEncoding.EncodeToString(e.Data)
+		}
+	}
+	return json.Marshal(m)
+}
+
+// ParseEvent 从消息中解析并校验事件。ContentType 为 application/cloudevents+json 的消息按结构化模式解析，
+// 其他消息按二进制模式解析。
+func ParseEvent(delivery *amqp.Delivery) (*Event, error) {
+	var event *Event
+	var err error
+	if normalizeContentType(delivery.ContentType) == ContentTypeCloudEvents {
+		event, err = parseStructuredEvent(delivery.Body)
+	} else {
+		event, err = parseBinaryEvent(delivery)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = event.Validate(); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+func parseBinaryEvent(delivery *amqp.Delivery) (*Event, error) {
+	event := &Event{DataContentType: delivery.ContentType, Data: delivery.Body}
+	for k, v := range delivery.Headers {
+		var name string
+		switch {
+		case strings.HasPrefix(k, cloudEventsHeaderPrefix):
+			name = k[len(cloudEventsHeaderPrefix):]
+		case strings.HasPrefix(k, cloudEventsHeaderPrefixAlt):
+			name = k[len(cloudEventsHeaderPrefixAlt):]
+		default:
+			continue
+		}
+		if err := event.setAttribute(name, v); err != nil {
+			return nil, err
+		}
+	}
+	return event, nil
+}
+
+func parseStructuredEvent(body []byte) (*Event, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+	event := &Event{}
+	for k, raw := range m {
+		switch k {
+		case "data":
+			event.Data = []byte(raw)
+		case "data_base64":
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return nil, fmt.Errorf("%w: data_base64: %v", ErrInvalidEvent, err)
+			}
+			data, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: data_base64: %v", ErrInvalidEvent, err)
+			}
+			event.Data = data
+		default:
+			var v interface{}
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidEvent, k, err)
+			}
+			if err := event.setAttribute(k, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, ok := m["data"]; ok && event.DataContentType == "" {
+		event.DataContentType = ContentTypeJSON
+	}
+	return event, nil
+}
+
+func (e *Event) setAttribute(name string, v interface{}) error {
+	if !isContextAttribute(name) {
+		if !isValidAttributeName(name) {
+			return fmt.Errorf("%w: invalid extension name %q", ErrInvalidEvent, name)
+		}
+		if e.Extensions == nil {
+			e.Extensions = make(map[string]interface{})
+		}
+		e.Extensions[name] = v
+		return nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("%w: attribute %s must be a string, got %T", ErrInvalidEvent, name, v)
+	}
+	switch name {
+	case "id":
+		e.ID = s
+	case "source":
+		e.Source = s
+	case "specversion":
+		e.SpecVersion = s
+	case "type":
+		e.Type = s
+	case "datacontenttype":
+		e.DataContentType = s
+	case "dataschema":
+		e.DataSchema = s
+	case "subject":
+		e.Subject = s
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("%w: time: %v", ErrInvalidEvent, err)
+		}
+		e.Time = t
+	}
+	return nil
+}
+
+func isContextAttribute(name string) bool {
+	switch name {
+	case "id", "source", "specversion", "type", "datacontenttype", "dataschema", "subject", "time", "data", "data_base64":
+		return true
+	}
+	return false
+}
+
+func isValidAttributeName(name string) bool {
+	if name == "" || len(name) > 20 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType := normalizeContentType(contentType)
+	return mediaType == "" || mediaType == ContentTypeJSON || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// SendEvent 按照 mode 编码并发送 CloudEvents 事件。事件在发送前会被校验。
+//
+// 参数 opts 详见 Producer.Send。消息的投递模式等属性仍由 SendOpts 的消息工厂方法决定。
+func (p *Producer) SendEvent(exchange string, routingKey string, event *Event, mode EventMode, opts *SendOpts) error {
+	e := *event
+	if e.SpecVersion == "" {
+		e.SpecVersion = CloudEventsSpecVersion
+	}
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	body := e.Data
+	if mode == EventModeStructured {
+		var err error
+		if body, err = e.marshalStructured(); err != nil {
+			return err
+		}
+	}
+	if opts == nil {
+		opts = DefaultSendOpts()
+	}
+	o := *opts
+	o.messageFactory = eventMessageFactory(&e, mode, o.messageFactory)
+	return p.Send(exchange, routingKey, body, &o)
+}
+
+// EventHandler 处理解析后的事件。返回值 brk 详见 ConsumerFunc。
+type EventHandler func(event *Event, delivery *amqp.Delivery) (brk bool)
+
+// EventConsumer 将消息解析为 CloudEvents 事件并校验后，再交给 EventHandler 处理。
+// 无法解析或校验失败的消息按照 Disposition 处置（默认为 DispositionReject），不会交给 EventHandler。
+type EventConsumer struct {
+	c           *Consumer
+	disposition Disposition
+	onInvalid   func(delivery *amqp.Delivery, err error)
+}
+
+func NewEventConsumer(c *Consumer) *EventConsumer {
+	return &EventConsumer{c: c, disposition: DispositionReject}
+}
+
+// SetInvalidDisposition 设置非法事件的处置方式
+func (ec *EventConsumer) SetInvalidDisposition(d Disposition) *EventConsumer {
+	ec.disposition = d
+	return ec
+}
+
+// SetInvalidHandler 设置收到非法事件时的回调，一般用于记录日志。回调在消息被处置之前调用。
+func (ec *EventConsumer) SetInvalidHandler(fn func(delivery *amqp.Delivery, err error)) *EventConsumer {
+	ec.onInvalid = fn
+	return ec
+}
+
+// ConsumerFunc 将 EventHandler 包装为 ConsumerFunc。autoAck 应与接收选项的 autoAck 一致。
+func (ec *EventConsumer) ConsumerFunc(handler EventHandler, autoAck bool) ConsumerFunc {
+	if handler == nil {
+		panic("EventHandler can't be nil")
+	}
+	return func(delivery *amqp.Delivery) (brk bool) {
+		event, err := ParseEvent(delivery)
+		if err != nil {
+			if ec.onInvalid != nil {
+				ec.onInvalid(delivery, err)
+			} else {
+				ec.c.conn().warn("parse cloud event failed:", err, consumerField(delivery.ConsumerTag), deliveryTagField(delivery.DeliveryTag))
+			}
+			return ec.disposition.apply(ec.c.conn(), delivery, autoAck)
+		}
+		return handler(event, delivery)
+	}
+}
+
+// Receive 持续接收事件并交给 handler 处理。参数 finish 可以为 nil。
+//
+// 详见 Consumer.Receive
+func (ec *EventConsumer) Receive(queue string, opts *ReceiveOpts, handler EventHandler, finish func(err error)) *Subscription {
+	if opts == nil {
+		opts = DefaultReceiveOpts()
+	}
+	return ec.c.Receive(queue, opts, &AbsReceiveListener{
+		ConsumerMethod: ec.ConsumerFunc(handler, opts.autoAck),
+		FinishMethod:   finish,
+	})
+}
@@ -0,0 +1,138 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestEvent(contentType string, data []byte) *Event {
+	return &Event{
+		ID:              "1",
+		Source:          "/ezmq/test",
+		SpecVersion:     CloudEventsSpecVersion,
+		Type:            "com.example.created",
+		DataContentType: contentType,
+		Subject:         "order",
+		Time:            time.Date(2022, 1, 2, 3, 4, 5, 6, time.UTC),
+		Extensions:      map[string]interface{}{"tenant": "ezmq"},
+		Data:            data,
+	}
+}
+
+func TestEvent_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		event *Event
+		mode  EventMode
+	}{
+		{name: "binary", event: newTestEvent(ContentTypeJSON, []byte(`{"id":1}`)), mode: EventModeBinary},
+		{name: "structured json", event: newTestEvent(ContentTypeJSON, []byte(`{"id":1}`)), mode: EventModeStructured},
+		{name: "structured base64", event: newTestEvent("application/octet-stream", []byte{0, 1, 2}), mode: EventModeStructured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.event.Data
+			if tt.mode == EventModeStructured {
+				var err error
+				if body, err = tt.event.marshalStructured(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			msg := eventMessageFactory(tt.event, tt.mode, MessagePlainPersistent)(body)
+			if msg.DeliveryMode != amqp.Persistent {
+				t.Errorf("delivery mode = %v, want persistent", msg.DeliveryMode)
+			}
+			got, err := ParseEvent(&amqp.Delivery{Headers: msg.Headers, ContentType: msg.ContentType, Body: msg.Body})
+			if err != nil {
+				t.Fatalf("ParseEvent() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.event) {
+				t.Errorf("ParseEvent() got = %+v, want %+v", got, tt.event)
+			}
+		})
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery amqp.Delivery
+		wantErr  bool
+	}{
+		{name: "alternative prefix", delivery: amqp.Delivery{Headers: amqp.Table{
+			"cloudEvents_id": "1", "cloudEvents_source": "s", "cloudEvents_specversion": "1.0", "cloudEvents_type": "t",
+		}}},
+		{name: "missing id", delivery: amqp.Delivery{Headers: amqp.Table{
+			"cloudEvents:source": "s", "cloudEvents:specversion": "1.0", "cloudEvents:type": "t",
+		}}, wantErr: true},
+		{name: "bad specversion", delivery: amqp.Delivery{ContentType: ContentTypeCloudEvents,
+			Body: []byte(`{"id":"1","source":"s","specversion":"0.3","type":"t"}`)}, wantErr: true},
+		{name: "bad extension", delivery: amqp.Delivery{ContentType: ContentTypeCloudEvents,
+			Body: []byte(`{"id":"1","source":"s","specversion":"1.0","type":"t","Bad-Name":1}`)}, wantErr: true},
+		{name: "malformed json", delivery: amqp.Delivery{ContentType: ContentTypeCloudEvents, Body: []byte(`{`)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseEvent(&tt.delivery)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseEvent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidEvent) {
+				t.Errorf("ParseEvent() error = %v, want %v", err, ErrInvalidEvent)
+			}
+		})
+	}
+}
+
+func TestEvent_DataAs(t *testing.T) {
+	var data struct{ ID int }
+	if err := newTestEvent("", []byte(`{"ID":1}`)).DataAs(&data); err != nil || data.ID != 1 {
+		t.Errorf("DataAs() got = %v, err = %v", data, err)
+	}
+}
+
+func TestEventConsumer_ConsumerFunc(t *testing.T) {
+	ack := &recordAcknowledger{}
+	var handled bool
+	fn := NewEventConsumer(nil).
+		SetInvalidDisposition(DispositionRequeue).
+		ConsumerFunc(func(event *Event, delivery *amqp.Delivery) (brk bool) {
+			handled = true
+			return
+		}, false)
+	fn(&amqp.Delivery{Acknowledger: ack, ContentType: ContentTypeCloudEvents, Body: []byte(`{}`)})
+	if handled || !ack.nacked || !ack.requeued {
+		t.Errorf("invalid event: handled = %v, ack = %+v", handled, *ack)
+	}
+}
+
+func TestEventConsumer_logger(t *testing.T) {
+	conn, buf := newLogConnection(t)
+	fn := NewEventConsumer(conn.Consumer()).
+		ConsumerFunc(func(event *Event, delivery *amqp.Delivery) (brk bool) { return }, false)
+	fn(&amqp.Delivery{Acknowledger: &recordAcknowledger{}, DeliveryTag: 1, ContentType: ContentTypeCloudEvents, Body: []byte(`{}`)})
+	if want := "parse cloud event failed:"; !strings.Contains(buf.String(), want) {
+		t.Errorf("connection log %q does not contain %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,235 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+)
+
+// 消息的确认方式
+const (
+	ackAuto    = "auto"    // 服务器投递后即视为已确认
+	ackAck     = "ack"     // 输出后确认
+	ackRequeue = "requeue" // 输出后拒绝并重新入队
+	ackReject  = "reject"  // 输出后拒绝，不重新入队（如果配置了死信交换器，消息会成为死信）
+)
+
+func notifyInterrupt() <-chan os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	return sig
+}
+
+// output 输出接收到的消息。如果设置了 dir，每条消息的消息体写入 dir 下的一个文件，否则写入 w。
+type output struct {
+	w       io.Writer
+	dir     string
+	verbose bool
+	ack     string
+	n       int
+}
+
+func (c *cli) outputFlags(fs *flag.FlagSet) *output {
+	o := &output{w: c.stdout}
+	fs.StringVar(&o.ack, "ack", ackAck, "acknowledgement mode: auto, ack, requeue or reject")
+	fs.StringVar(&o.dir, "out", "", "write each message body to a file in `dir` instead of stdout")
+	fs.BoolVar(&o.verbose, "verbose", false, "print message properties and headers before each body")
+	return o
+}
+
+func (o *output) check() error {
+	switch o.ack {
+	case ackAuto, ackAck, ackRequeue, ackReject:
+	default:
+		return fmt.Errorf("invalid ack mode %q", o.ack)
+	}
+	if o.dir != "" {
+		return os.MkdirAll(o.dir, 0o755)
+	}
+	return nil
+}
+
+// handle 输出消息，并按照确认方式确认消息
+func (o *output) handle(d *amqp.Delivery) error {
+	o.n++
+	if err := o.write(d); err != nil {
+		// 输出失败时将消息放回队列，防止丢失
+		if o.ack != ackAuto {
+			_ = d.Nack(false, true)
+		}
+		return err
+	}
+	switch o.ack {
+	case ackAck:
+		return d.Ack(false)
+	case ackRequeue:
+		return d.Nack(false, true)
+	case ackReject:
+		return d.Reject(false)
+	}
+	return nil
+}
+
+func (o *output) write(d *amqp.Delivery) error {
+	if o.dir != "" {
+		name := filepath.Join(o.dir, fmt.Sprintf("%06d.msg", o.n))
+		if err := os.WriteFile(name, d.Body, 0o644); err != nil {
+			return err
+		}
+		if o.verbose {
+			fmt.Fprintf(o.w, "%s %s\n", name, describe(d))
+		}
+		return nil
+	}
+	if o.verbose {
+		fmt.Fprintln(o.w, describe(d))
+	}
+	_, err := fmt.Fprintf(o.w, "%s\n", d.Body)
+	return err
+}
+
+// describe 返回消息的属性和消息头，格式为 key=value，按 key 排序
+func describe(d *amqp.Delivery) string {
+	fields := []string{
+		"exchange=" + quote(d.Exchange),
+		"routing-key=" + quote(d.RoutingKey),
+		fmt.Sprintf("redelivered=%t", d.Redelivered),
+	}
+	props := [][2]string{
+		{"content-type", d.ContentType},
+		{"content-encoding", d.ContentEncoding},
+		{"message-id", d.MessageId},
+		{"correlation-id", d.CorrelationId},
+		{"reply-to", d.ReplyTo},
+		{"expiration", d.Expiration},
+		{"type", d.Type},
+	}
+	for _, p := range props {
+		if p[1] != "" {
+			fields = append(fields, p[0]+"="+quote(p[1]))
+		}
+	}
+	if d.DeliveryMode == amqp.Persistent {
+		fields = append(fields, "persistent=true")
+	}
+	keys := make([]string, 0, len(d.Headers))
+	for k := range d.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, "header."+k+"="+quote(fmt.Sprint(d.Headers[k])))
+	}
+	return strings.Join(fields, " ")
+}
+
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// consume 订阅队列并输出消息，直到收到中断信号或者接收了 -count 条消息。断线后会按照全局选项自动重连并重新订阅；
+// 订阅无法恢复（如队列不存在、没有权限）时返回订阅结束的原因，中断前发生的断线也会作为错误返回。
+func (c *cli) consume(args []string) error {
+	fs := c.flagSet("consume", "<queue>", "Consume messages from a queue until interrupted or -count messages are received.")
+	out := c.outputFlags(fs)
+	count := fs.Int("count", 0, "stop after `n` messages, 0 for no limit")
+	tag := fs.String("tag", "", "consumer tag, generated if empty")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	if err := out.check(); err != nil {
+		return err
+	}
+	queue := fs.Arg(0)
+
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	opts := ezmq.NewReceiveOptsBuilder().SetAutoAck(out.ack == ackAuto).SetConsumerTag(*tag).Build()
+	var handleErr error
+	sub := conn.Consumer().Receive(queue, opts, &ezmq.AbsReceiveListener{
+		ConsumerMethod: func(d *amqp.Delivery) (brk bool) {
+			if handleErr = out.handle(d); handleErr != nil {
+				return true
+			}
+			return *count > 0 && out.n >= *count
+		},
+	})
+	select {
+	case <-sub.Done():
+	case <-c.interrupt:
+		_ = sub.Stop(context.Background())
+	}
+	if handleErr != nil {
+		return handleErr
+	}
+	return sub.Err()
+}
+
+// get 使用 basic.get 逐条获取消息，直到队列为空或者获取了 -count 条消息
+func (c *cli) get(args []string) error {
+	fs := c.flagSet("get", "<queue>", "Fetch messages one by one until the queue is empty or -count messages are fetched.")
+	out := c.outputFlags(fs)
+	count := fs.Int("count", 1, "fetch at most `n` messages, 0 for no limit")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	if err := out.check(); err != nil {
+		return err
+	}
+	if out.ack == ackRequeue && *count <= 0 {
+		// 重新入队的消息会被再次获取，不限制数量将无法结束
+		return errors.New("-ack requeue requires -count")
+	}
+	ch, closeFn, err := c.channel()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	for *count <= 0 || out.n < *count {
+		d, ok, err := ch.Get(fs.Arg(0), out.ack == ackAuto)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if err = out.handle(&d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+)
+
+// declare 声明队列或交换器
+func (c *cli) declare(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "queue":
+			return c.declareQueue(args[1:])
+		case "exchange":
+			return c.declareExchange(args[1:])
+		}
+	}
+	fmt.Fprintln(c.stderr, "Usage: ezmq declare queue|exchange [options] <name>")
+	return errUsage
+}
+
+// declareQueue 声明队列。如果指定了 -exchange，会同时将队列绑定到该交换器，声明和绑定失败时按照全局选项重试。
+func (c *cli) declareQueue(args []string) error {
+	fs := c.flagSet("declare queue", "[name]", "Declare a queue, optionally binding it to an exchange. An empty name lets the broker generate one.")
+	durable := fs.Bool("durable", true, "survive broker restarts")
+	autoDelete := fs.Bool("auto-delete", false, "delete the queue when its last consumer is cancelled")
+	exchange := fs.String("exchange", "", "bind the queue to this exchange")
+	key := fs.String("key", "", "binding key used with -exchange, defaults to the queue name")
+	arguments := tableFlag{}
+	fs.Var(arguments, "arg", "queue argument `key=value`, may be repeated, e.g. x-queue-type=quorum")
+	if err := parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	argTable := amqp.Table(arguments)
+
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if *exchange != "" {
+		if name == "" {
+			return errors.New("a queue name is required with -exchange")
+		}
+		if *key == "" {
+			*key = name
+		}
+		q := conn.QueueBuilder().
+			SetQueueDeclareOpts(func(bld *ezmq.QueueDeclareOptsBuilder) *ezmq.QueueDeclareOpts {
+				return bld.SetDurable(*durable).SetAutoDelete(*autoDelete).SetArgs(&argTable).Build()
+			}).
+			SetRetryable(c.retryable()).
+			Build()
+		if err = q.RetryDeclareAndBind(name, *key, *exchange); err != nil {
+			return err
+		}
+		return c.printQueue(q.Queue)
+	}
+
+	ch, err := conn.RetryChannel(c.retryable())
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	q, err := ch.QueueDeclare(name, *durable, *autoDelete, false, false, argTable)
+	if err != nil {
+		return err
+	}
+	return c.printQueue(&q)
+}
+
+func (c *cli) printQueue(q *amqp.Queue) error {
+	_, err := fmt.Fprintf(c.stdout, "%s messages=%d consumers=%d\n", q.Name, q.Messages, q.Consumers)
+	return err
+}
+
+// declareExchange 声明交换器
+func (c *cli) declareExchange(args []string) error {
+	fs := c.flagSet("declare exchange", "<name>", "Declare an exchange.")
+	kind := fs.String("type", amqp.ExchangeDirect, "exchange type: direct, fanout, topic, headers or a plugin type")
+	durable := fs.Bool("durable", true, "survive broker restarts")
+	autoDelete := fs.Bool("auto-delete", false, "delete the exchange when its last binding is removed")
+	internal := fs.Bool("internal", false, "only allow publishing from other exchanges")
+	arguments := tableFlag{}
+	fs.Var(arguments, "arg", "exchange argument `key=value`, may be repeated, e.g. alternate-exchange=unrouted")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	return c.withChannel(func(ch *ezmq.Channel) error {
+		return ch.ExchangeDeclare(fs.Arg(0), *kind, *durable, *autoDelete, *internal, false, amqp.Table(arguments))
+	})
+}
+
+// bind 将队列绑定到交换器
+func (c *cli) bind(args []string) error {
+	fs := c.flagSet("bind", "<queue> <exchange>", "Bind a queue to an exchange.")
+	key := fs.String("key", "", "binding key")
+	arguments := tableFlag{}
+	fs.Var(arguments, "arg", "binding argument `key=value`, may be repeated, e.g. x-match=all for headers exchanges")
+	if err := parse(fs, args, 2, 2); err != nil {
+		return err
+	}
+	return c.withChannel(func(ch *ezmq.Channel) error {
+		return ch.QueueBind(fs.Arg(0), *key, fs.Arg(1), false, amqp.Table(arguments))
+	})
+}
+
+// purge 清空队列，并输出被清除的消息数
+func (c *cli) purge(args []string) error {
+	fs := c.flagSet("purge", "<queue>", "Remove all ready messages from a queue.")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	return c.withChannel(func(ch *ezmq.Channel) error {
+		n, err := ch.QueuePurge(fs.Arg(0), false)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.stdout, "purged %d messages\n", n)
+		return err
+	})
+}
+
+// delete 删除队列或交换器
+func (c *cli) delete(args []string) error {
+	if len(args) == 0 || (args[0] != "queue" && args[0] != "exchange") {
+		fmt.Fprintln(c.stderr, "Usage: ezmq delete queue|exchange [options] <name>")
+		return errUsage
+	}
+	kind := args[0]
+	fs := c.flagSet("delete "+kind, "<name>", "Delete a "+kind+".")
+	ifUnused := fs.Bool("if-unused", false, "only delete if the "+kind+" is unused")
+	var ifEmpty *bool
+	if kind == "queue" {
+		ifEmpty = fs.Bool("if-empty", false, "only delete if the queue is empty")
+	}
+	if err := parse(fs, args[1:], 1, 1); err != nil {
+		return err
+	}
+	return c.withChannel(func(ch *ezmq.Channel) error {
+		if kind == "exchange" {
+			return ch.ExchangeDelete(fs.Arg(0), *ifUnused, false)
+		}
+		n, err := ch.QueueDelete(fs.Arg(0), *ifUnused, *ifEmpty, false)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.stdout, "deleted queue with %d messages\n", n)
+		return err
+	})
+}
+
+// withChannel 连接服务器，并使用新的 Channel 执行 fn
+func (c *cli) withChannel(fn func(ch *ezmq.Channel) error) error {
+	ch, closeFn, err := c.channel()
+	if err != nil {
+		return err
+	}
+	defer closeFn()
+	return fn(ch)
+}
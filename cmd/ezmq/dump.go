@@ -0,0 +1,135 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"ezmq"
+)
+
+// dump 将队列中的消息导出为 NDJSON 文件，详见 ezmq.Connection.DumpQueue
+func (c *cli) dump(args []string) error {
+	fs := c.flagSet("dump", "<queue>", "Export the messages of a queue as newline-delimited JSON. Messages are requeued unless -drain is given.")
+	drain := fs.Bool("drain", false, "remove the exported messages from the queue")
+	count := fs.Int("count", 0, "export at most `n` messages, 0 for all")
+	file := fs.String("o", "-", "write to `path`, - for stdout")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	var w io.Writer = c.stdout
+	if *file != "-" {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := c.interruptContext()
+	defer cancel()
+	opts := ezmq.NewDumpOptsBuilder().SetDrain(*drain).SetLimit(*count).Build()
+	n, err := conn.DumpQueue(ctx, fs.Arg(0), w, opts)
+	fmt.Fprintf(c.stderr, "dumped %d messages\n", n)
+	return err
+}
+
+// replay 重新发送 dump 导出的消息，详见 ezmq.Connection.Replay
+func (c *cli) replay(args []string) error {
+	fs := c.flagSet("replay", "[file]", "Republish messages exported by dump with publisher confirms. Reads stdin if no file is given.")
+	exchange := fs.String("exchange", "", "publish to this exchange instead of the recorded one")
+	key := fs.String("key", "", "publish with this routing key instead of the recorded one")
+	rate := fs.Float64("rate", 0, "publish at most `n` messages per second, 0 for no limit")
+	dryRun := fs.Bool("dry-run", false, "only read and validate the file")
+	if err := parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+	var r io.Reader = c.stdin
+	if name := fs.Arg(0); name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	bld := ezmq.NewReplayOptsBuilder().SetRate(*rate).SetRetryable(c.retryable())
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "exchange":
+			bld.SetExchange(*exchange)
+		case "key":
+			bld.SetRoutingKey(*key)
+		}
+	})
+
+	if *dryRun {
+		// 只校验文件，不需要连接服务器
+		n, err := countRecords(r)
+		fmt.Fprintf(c.stderr, "would publish %d messages\n", n)
+		return err
+	}
+
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := c.interruptContext()
+	defer cancel()
+	start := time.Now()
+	n, err := conn.Replay(ctx, r, bld.Build())
+	fmt.Fprintf(c.stderr, "published %d messages in %v\n", n, time.Since(start).Round(time.Millisecond))
+	return err
+}
+
+func countRecords(r io.Reader) (n int, err error) {
+	dr := ezmq.NewDumpReader(r)
+	for {
+		if _, err = dr.Read(); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			return n, err
+		}
+		n++
+	}
+}
+
+// interruptContext 返回收到中断信号时结束的 Context
+func (c *cli) interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
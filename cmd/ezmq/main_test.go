@@ -0,0 +1,267 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ezmq/ezmqtest"
+)
+
+type testCLI struct {
+	*cli
+	broker         *ezmqtest.Broker
+	stdout, stderr *bytes.Buffer
+}
+
+func newTestCLI() *testCLI {
+	b := ezmqtest.NewBroker()
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	return &testCLI{
+		cli:    &cli{stdin: strings.NewReader(""), stdout: stdout, stderr: stderr, dialer: b},
+		broker: b,
+		stdout: stdout,
+		stderr: stderr,
+	}
+}
+
+// exec 执行命令并返回标准输出，退出码不是 want 时测试失败
+func (c *testCLI) exec(t *testing.T, want int, args ...string) string {
+	t.Helper()
+	c.stdout.Reset()
+	c.stderr.Reset()
+	if code := c.run(append([]string{"-retries", "0", "-retry-interval", "1ms"}, args...)); code != want {
+		t.Fatalf("run(%q) = %d, want %d, stderr:\n%s", args, code, want, c.stderr)
+	}
+	return c.stdout.String()
+}
+
+func TestPublishAndGet(t *testing.T) {
+	c := newTestCLI()
+	c.exec(t, 0, "declare", "queue", "q")
+	c.exec(t, 0, "publish", "-key", "q", "-header", "n=1", "-persistent", "-confirm", "hello")
+	c.stdin = strings.NewReader("from stdin")
+	c.exec(t, 0, "publish", "-key", "q")
+	file := filepath.Join(t.TempDir(), "body")
+	if err := os.WriteFile(file, []byte("from file"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c.exec(t, 0, "publish", "-key", "q", "-file", file)
+
+	out := c.exec(t, 0, "get", "-verbose", "q")
+	if !strings.Contains(out, "header.n=1") || !strings.Contains(out, "persistent=true") || !strings.HasSuffix(out, "\nhello\n") {
+		t.Errorf("get -verbose output = %q", out)
+	}
+	if out = c.exec(t, 0, "get", "-count", "0", "q"); out != "from stdin\nfrom file\n" {
+		t.Errorf("get output = %q", out)
+	}
+	if n := c.broker.QueueDepth("q"); n != 0 {
+		t.Errorf("QueueDepth() = %d, want 0", n)
+	}
+}
+
+func TestPublish_retries(t *testing.T) {
+	c := newTestCLI()
+	c.exec(t, 0, "declare", "queue", "q")
+	// -retries 2 最多发送 3 次：第 4 次发送会成功，因此只有在重发次数受限时才会失败
+	c.broker.NackPublishes(3)
+	c.exec(t, 1, "-retries", "2", "publish", "-key", "q", "-confirm", "a")
+	c.broker.NackPublishes(2)
+	c.exec(t, 0, "-retries", "2", "publish", "-key", "q", "-confirm", "b")
+	if out := c.exec(t, 0, "get", "-count", "0", "q"); out != "b\n" {
+		t.Errorf("get output = %q, want b", out)
+	}
+}
+
+func TestGet_requeue(t *testing.T) {
+	c := newTestCLI()
+	c.exec(t, 0, "declare", "queue", "q")
+	c.exec(t, 0, "publish", "-key", "q", "a")
+	c.exec(t, 1, "get", "-ack", "requeue", "-count", "0", "q")
+	c.exec(t, 0, "get", "-ack", "requeue", "q")
+	if n := c.broker.QueueDepth("q"); n != 1 {
+		t.Errorf("QueueDepth() = %d, want 1", n)
+	}
+}
+
+func TestConsume_count(t *testing.T) {
+	c := newTestCLI()
+	c.exec(t, 0, "declare", "queue", "q")
+	for _, body := range []string{"a", "b", "c"} {
+		c.exec(t, 0, "publish", "-key", "q", body)
+	}
+	dir := t.TempDir()
+	c.exec(t, 0, "consume", "-count", "2", "-out", dir, "q")
+	for name, want := range map[string]string{"000001.msg": "a", "000002.msg": "b"} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(got) != want {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if out := c.exec(t, 0, "consume", "-count", "1", "q"); out != "c\n" {
+		t.Errorf("consume output = %q", out)
+	}
+}
+
+func TestConsume_missingQueue(t *testing.T) {
+	c := newTestCLI()
+	done := make(chan int, 1)
+	go func() { done <- c.run([]string{"-retries", "0", "-retry-interval", "1ms", "consume", "missing"}) }()
+	select {
+	case code := <-done:
+		if code != 1 {
+			t.Errorf("run() = %d, want 1", code)
+		}
+		if !strings.Contains(c.stderr.String(), "NOT_FOUND") {
+			t.Errorf("stderr = %q, want NOT_FOUND", c.stderr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("consume on a missing queue does not exit")
+	}
+}
+
+func TestTopology(t *testing.T) {
+	c := newTestCLI()
+	c.exec(t, 0, "declare", "exchange", "-type", "topic", "events")
+	c.exec(t, 0, "declare", "queue", "-exchange", "events", "-key", "order.*", "-arg", "x-max-length=10", "orders")
+	c.exec(t, 0, "declare", "queue", "audit")
+	c.exec(t, 0, "bind", "-key", "#", "audit", "events")
+	c.exec(t, 0, "publish", "-exchange", "events", "-key", "order.created", "x")
+	if c.broker.QueueDepth("orders") != 1 || c.broker.QueueDepth("audit") != 1 {
+		t.Fatalf("QueueDepth() = %d, %d, want 1, 1", c.broker.QueueDepth("orders"), c.broker.QueueDepth("audit"))
+	}
+	if out := c.exec(t, 0, "purge", "orders"); out != "purged 1 messages\n" {
+		t.Errorf("purge output = %q", out)
+	}
+	c.exec(t, 1, "delete", "queue", "-if-empty", "audit")
+	c.exec(t, 0, "delete", "queue", "audit")
+	c.exec(t, 0, "delete", "exchange", "events")
+	if c.broker.HasQueue("audit") || c.broker.HasExchange("events") {
+		t.Error("queue or exchange not deleted")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	c := newTestCLI()
+	c.exec(t, 2)
+	c.exec(t, 2, "unknown")
+	c.exec(t, 2, "declare", "binding")
+	c.exec(t, 2, "bind", "q")
+	c.exec(t, 1, "consume", "-ack", "never", "q")
+	c.exec(t, 2, "publish", "-header", "novalue", "x")
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		v    string
+		want interface{}
+	}{
+		{"60000", int64(60000)},
+		{"-1", int64(-1)},
+		{"true", true},
+		{"false", false},
+		{"t", "t"},
+		{"F", "F"},
+		{"TRUE", "TRUE"},
+		{"quorum", "quorum"},
+	}
+	for _, tt := range tests {
+		if got := parseValue(tt.v); got != tt.want {
+			t.Errorf("parseValue(%q) = %#v, want %#v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestDumpAndReplay(t *testing.T) {
+	c := newTestCLI()
+	c.exec(t, 0, "declare", "queue", "src")
+	c.exec(t, 0, "declare", "queue", "dst")
+	c.exec(t, 0, "publish", "-key", "src", "-header", "n=1", "a")
+	c.exec(t, 0, "publish", "-key", "src", "b")
+
+	file := filepath.Join(t.TempDir(), "src.ndjson")
+	c.exec(t, 0, "dump", "-o", file, "src")
+	if n := c.broker.QueueDepth("src"); n != 2 {
+		t.Fatalf("QueueDepth() after dump = %d, want 2", n)
+	}
+	dump := c.exec(t, 0, "dump", "-drain", "src")
+	if strings.Count(dump, "\n") != 2 || c.broker.QueueDepth("src") != 0 {
+		t.Fatalf("dump -drain output = %q, depth %d", dump, c.broker.QueueDepth("src"))
+	}
+
+	c.exec(t, 0, "replay", "-dry-run", file)
+	if c.stderr.String() != "would publish 2 messages\n" || c.broker.QueueDepth("dst") != 0 {
+		t.Errorf("replay -dry-run stderr = %q, depth %d", c.stderr, c.broker.QueueDepth("dst"))
+	}
+	c.stdin = strings.NewReader(dump)
+	c.exec(t, 0, "replay", "-key", "dst")
+	if out := c.exec(t, 0, "get", "-count", "0", "-verbose", "dst"); !strings.Contains(out, "header.n=1\na\n") || !strings.HasSuffix(out, "\nb\n") {
+		t.Errorf("get output = %q", out)
+	}
+	c.exec(t, 1, "replay", "-dry-run", filepath.Join(t.TempDir(), "missing"))
+}
+
+func TestTopologyCommand(t *testing.T) {
+	c := newTestCLI()
+	file := filepath.Join(t.TempDir(), "topology.yaml")
+	topology := "exchanges:\n  - {name: events, type: topic}\nqueues:\n  - name: orders\nbindings:\n  - {source: events, destination: orders, routing_key: '#'}\n"
+	if err := os.WriteFile(file, []byte(topology), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out := c.exec(t, 0, "topology", "plan", file); !strings.HasPrefix(out, "create    exchange events\ncreate    queue orders\n") {
+		t.Errorf("topology plan output = %q", out)
+	}
+	c.exec(t, 0, "topology", "apply", file)
+	if !c.broker.HasExchange("events") || !c.broker.HasQueue("orders") {
+		t.Error("topology not applied")
+	}
+	c.exec(t, 0, "delete", "queue", "orders")
+	c.exec(t, 0, "declare", "queue", "-durable=false", "orders")
+	if out := c.exec(t, 1, "topology", "apply", file); !strings.Contains(out, "conflict  queue orders") {
+		t.Errorf("topology apply output = %q", out)
+	}
+}
+
+func TestTopologyDefinitions(t *testing.T) {
+	c := newTestCLI()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "topology.yaml")
+	topology := "exchanges:\n  - {name: events, type: topic}\nqueues:\n  - name: orders\nbindings:\n  - {source: events, destination: orders}\n"
+	if err := os.WriteFile(file, []byte(topology), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := c.exec(t, 0, "topology", "export", "-vhost", "dev", file)
+	if !strings.Contains(out, `"vhost": "dev"`) {
+		t.Errorf("topology export output = %q", out)
+	}
+	definitions := filepath.Join(dir, "definitions.json")
+	if err := os.WriteFile(definitions, []byte(out), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out = c.exec(t, 0, "topology", "plan", "-definitions", definitions); strings.Contains(out, "orders") {
+		t.Errorf("topology plan of another vhost = %q", out)
+	}
+	c.exec(t, 0, "topology", "apply", "-definitions", "-vhost", "dev", definitions)
+	if !c.broker.HasExchange("events") || !c.broker.HasQueue("orders") {
+		t.Error("definitions not applied")
+	}
+}
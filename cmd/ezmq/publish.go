@@ -0,0 +1,119 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+)
+
+// publish 发送一条消息。消息体依次取自位置参数、-file 指定的文件，如果都没有提供则从标准输入读取。
+func (c *cli) publish(args []string) error {
+	fs := c.flagSet("publish", "[body]", "Publish a message. The body is read from the argument, -file or stdin.")
+	exchange := fs.String("exchange", "", "exchange to publish to, empty for the default exchange")
+	key := fs.String("key", "", "routing key")
+	file := fs.String("file", "", "read the body from `path`, - for stdin")
+	contentType := fs.String("content-type", "text/plain", "content type of the message")
+	persistent := fs.Bool("persistent", false, "publish a persistent message")
+	confirm := fs.Bool("confirm", false, "wait for the broker to confirm the message, resending on nack according to the global retry options")
+	mandatory := fs.Bool("mandatory", false, "set the mandatory flag")
+	messageID := fs.String("message-id", "", "message id")
+	expiration := fs.String("expiration", "", "per-message TTL in milliseconds")
+	headers := tableFlag{}
+	fs.Var(headers, "header", "message header `key=value`, may be repeated")
+	if err := parse(fs, args, 0, 1); err != nil {
+		return err
+	}
+	if fs.NArg() == 1 && *file != "" {
+		return errors.New("body argument and -file are mutually exclusive")
+	}
+	body, err := c.readBody(fs.Arg(0), fs.NArg() == 1, *file)
+	if err != nil {
+		return err
+	}
+
+	mode := amqp.Transient
+	if *persistent {
+		mode = amqp.Persistent
+	}
+	var factory ezmq.MessageFactory = func(body []byte) amqp.Publishing {
+		msg := amqp.Publishing{
+			ContentType:  *contentType,
+			DeliveryMode: mode,
+			MessageId:    *messageID,
+			Expiration:   *expiration,
+			Body:         body,
+		}
+		if len(headers) > 0 {
+			msg.Headers = amqp.Table(headers)
+		}
+		return msg
+	}
+	bld := ezmq.NewSendOptsBuilder().SetMandatory(*mandatory)
+	if *confirm {
+		bld.SetRetryable(c.resendRetryable(&factory))
+	} else {
+		bld.SetRetryable(nil)
+	}
+	bld.SetMessageFactory(factory)
+
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Producer().Send(*exchange, *key, body, bld.Build())
+}
+
+// resendRetryable 返回重发消息使用的 Retryable。TimesRetry 在放弃之前会一直重试，不受重试次数的限制，
+// 因此通过 factory 统计发送的次数，发送了 1 + -retries 次之后放弃重发。
+func (c *cli) resendRetryable(factory *ezmq.MessageFactory) ezmq.Retryable {
+	if c.retries < 0 {
+		return c.retryable()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	next, attempts := *factory, 0
+	*factory = func(body []byte) amqp.Publishing {
+		if attempts++; attempts > c.retries {
+			// 最后一次发送，仍会等待服务器的确认
+			cancel()
+		}
+		return next(body)
+	}
+	return ezmq.NewCtxRetry(ctx, c.retryInterval)
+}
+
+func (c *cli) readBody(arg string, hasArg bool, file string) ([]byte, error) {
+	switch {
+	case hasArg:
+		return []byte(arg), nil
+	case file == "" || file == "-":
+		return io.ReadAll(c.stdin)
+	}
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	return body, nil
+}
@@ -0,0 +1,85 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"ezmq"
+)
+
+// topology 根据拓扑文件输出变更计划、应用拓扑，或将其导出为管理插件的 definitions.json，详见 ezmq.Topology 和 ezmq.Definitions
+func (c *cli) topology(args []string) error {
+	if len(args) == 0 || (args[0] != "plan" && args[0] != "apply" && args[0] != "export") {
+		fmt.Fprintln(c.stderr, "Usage: ezmq topology plan|apply|export <file>")
+		return errUsage
+	}
+	action := args[0]
+	if action == "export" {
+		return c.topologyExport(args[1:])
+	}
+	fs := c.flagSet("topology "+action, "<file>", "Show what a YAML or JSON topology file would change (plan), or apply it (apply).\nApply changes nothing if any declaration conflicts with the broker.")
+	definitions := fs.Bool("definitions", false, "read a definitions.json exported by the management plugin")
+	vhost := fs.String("vhost", ezmq.DefaultVhost, "with -definitions, the `vhost` to take the exchanges, queues and bindings from")
+	if err := parse(fs, args[1:], 1, 1); err != nil {
+		return err
+	}
+	top, err := loadTopology(fs.Arg(0), *definitions, *vhost)
+	if err != nil {
+		return err
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var plan *ezmq.TopologyPlan
+	if action == "plan" {
+		plan, err = top.Plan(conn)
+	} else {
+		plan, err = top.Apply(conn)
+	}
+	if plan != nil {
+		fmt.Fprint(c.stdout, plan)
+	}
+	return err
+}
+
+// topologyExport 将拓扑文件导出为 definitions.json，不需要连接服务器
+func (c *cli) topologyExport(args []string) error {
+	fs := c.flagSet("topology export", "<file>", "Convert a YAML or JSON topology file to a definitions.json that the management plugin can import.")
+	vhost := fs.String("vhost", ezmq.DefaultVhost, "the `vhost` of the exported definitions")
+	if err := parse(fs, args, 1, 1); err != nil {
+		return err
+	}
+	top, err := ezmq.LoadTopologyFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return top.Definitions(*vhost).Write(c.stdout)
+}
+
+func loadTopology(path string, definitions bool, vhost string) (*ezmq.Topology, error) {
+	if !definitions {
+		return ezmq.LoadTopologyFile(path)
+	}
+	defs, err := ezmq.LoadDefinitionsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return defs.Topology(vhost)
+}
@@ -0,0 +1,177 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"mime"
+	"strings"
+	"sync"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeGob      = "application/x-gob"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/msgpack"
+)
+
+var ErrUnknownContentType = errors.New("no codec registered for content type")
+
+// Codec 用于将 Go 值编码为消息体，或将消息体解码为 Go 值。
+//
+// ContentType 返回的内容类型会被写入 amqp.Publishing.ContentType，
+// 消费者端会根据 amqp.Delivery.ContentType 选择对应的 Codec 解码。
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	GobCodec      Codec = gobCodec{}
+	ProtobufCodec Codec = &ProtoCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+)
+
+var (
+	codecs    = map[string]Codec{}
+	codecsMut sync.RWMutex
+)
+
+func init() {
+	RegisterCodec(JSONCodec)
+	RegisterCodec(GobCodec)
+	RegisterCodec(ProtobufCodec)
+	RegisterCodec(MsgpackCodec)
+	// 兼容旧版本 MessageJsonXxx 工厂方法使用的非标准内容类型
+	registerCodecAs("text/json", JSONCodec)
+}
+
+// RegisterCodec 注册 Codec。如果已存在相同内容类型的 Codec，则覆盖原有的 Codec。
+func RegisterCodec(codec Codec) {
+	if codec == nil {
+		panic("Codec must not be nil")
+	}
+	registerCodecAs(codec.ContentType(), codec)
+}
+
+func registerCodecAs(contentType string, codec Codec) {
+	codecsMut.Lock()
+	defer codecsMut.Unlock()
+	codecs[normalizeContentType(contentType)] = codec
+}
+
+// CodecFor 根据内容类型获取已注册的 Codec。内容类型中的参数（如 charset）会被忽略。
+func CodecFor(contentType string) (Codec, bool) {
+	codecsMut.RLock()
+	defer codecsMut.RUnlock()
+	codec, ok := codecs[normalizeContentType(contentType)]
+	return codec, ok
+}
+
+func normalizeContentType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// CodecMessageFactory 使用 factory 生产消息，并将消息的内容类型设置为 codec 的内容类型。
+// factory 如果为 nil，则使用 MessagePlainPersistent。
+func CodecMessageFactory(codec Codec, factory MessageFactory) MessageFactory {
+	factory = getNonNilMessageFactory(factory)
+	return func(body []byte) amqp.Publishing {
+		msg := factory(body)
+		msg.ContentType = codec.ContentType()
+		return msg
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                        { return ContentTypeJSON }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string { return ContentTypeGob }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string                        { return ContentTypeMsgpack }
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpackMarshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpackUnmarshal(data, v) }
+
+// ProtoCodec protobuf 编解码器。
+//
+// 为了不引入额外依赖，ProtoCodec 默认要求值实现 `Marshal() ([]byte, error)` 和
+// `Unmarshal([]byte) error` 方法（如 gogo/protobuf 生成的代码）。
+// google.golang.org/protobuf 生成的消息没有这两个方法，因此默认的 ProtobufCodec 无法编解码，
+// 必须注册设置了 MarshalFunc 和 UnmarshalFunc 的 ProtoCodec，例如：
+//
+//	ezmq.RegisterCodec(&ezmq.ProtoCodec{
+//		MarshalFunc:   func(v interface{}) ([]byte, error) { return proto.Marshal(v.(proto.Message)) },
+//		UnmarshalFunc: func(data []byte, v interface{}) error { return proto.Unmarshal(data, v.(proto.Message)) },
+//	})
+type ProtoCodec struct {
+	MarshalFunc   func(v interface{}) ([]byte, error)
+	UnmarshalFunc func(data []byte, v interface{}) error
+}
+
+func (c *ProtoCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (c *ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	if c.MarshalFunc != nil {
+		return c.MarshalFunc(v)
+	}
+	m, ok := v.(interface{ Marshal() ([]byte, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement Marshal() ([]byte, error), set ProtoCodec.MarshalFunc", v)
+	}
+	return m.Marshal()
+}
+
+func (c *ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	if c.UnmarshalFunc != nil {
+		return c.UnmarshalFunc(data, v)
+	}
+	m, ok := v.(interface{ Unmarshal([]byte) error })
+	if !ok {
+		return fmt.Errorf("%T does not implement Unmarshal([]byte) error, set ProtoCodec.UnmarshalFunc", v)
+	}
+	return m.Unmarshal(data)
+}
@@ -0,0 +1,311 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type codecPayload struct {
+	ID      int64             `msgpack:"id"`
+	Name    string            `msgpack:"name"`
+	Score   float64           `msgpack:"score"`
+	Tags    []string          `msgpack:"tags"`
+	Attrs   map[string]uint16 `msgpack:"attrs"`
+	Raw     []byte            `msgpack:"raw"`
+	Next    *codecPayload     `msgpack:"next,omitempty"`
+	At      time.Time         `msgpack:"at"`
+	Ignored string            `msgpack:"-"`
+}
+
+// protoPayload 模拟 gogo/protobuf 生成的消息
+type protoPayload struct {
+	data string
+}
+
+func (p *protoPayload) Marshal() ([]byte, error)    { return []byte(p.data), nil }
+func (p *protoPayload) Unmarshal(data []byte) error { p.data = string(data); return nil }
+
+func newCodecPayload() codecPayload {
+	return codecPayload{
+		ID:    -1 << 40,
+		Name:  "ezmq",
+		Score: 3.25,
+		Tags:  []string{"a", "b"},
+		Attrs: map[string]uint16{"port": 5672},
+		Raw:   []byte{0, 1, 2},
+		Next:  &codecPayload{ID: 1, Name: "next", At: time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)},
+		At:    time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+	}{
+		{name: "json", codec: JSONCodec},
+		{name: "gob", codec: GobCodec},
+		{name: "msgpack", codec: MsgpackCodec},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := newCodecPayload()
+			data, err := tt.codec.Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			var got codecPayload
+			if err = tt.codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Unmarshal() got = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodec_Protobuf(t *testing.T) {
+	data, err := ProtobufCodec.Marshal(&protoPayload{data: "proto"})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var got protoPayload
+	if err = ProtobufCodec.Unmarshal(data, &got); err != nil || got.data != "proto" {
+		t.Errorf("Unmarshal() got = %v, err = %v", got.data, err)
+	}
+	if _, err = ProtobufCodec.Marshal(struct{}{}); err == nil {
+		t.Errorf("Marshal() expect error for non proto message")
+	}
+}
+
+func TestMsgpack_Generic(t *testing.T) {
+	data, err := msgpackMarshal(map[string]interface{}{"n": 300, "s": "str", "l": []int{-100, 70000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got interface{}
+	if err = msgpackUnmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"n": int64(300), "s": "str", "l": []interface{}{int64(-100), int64(70000)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v, want %#v", got, want)
+	}
+	type embedded struct {
+		Tag string `msgpack:"tag"`
+	}
+	type outer struct {
+		embedded
+		Name string
+	}
+	data, err = msgpackMarshal(outer{embedded: embedded{Tag: "tag"}, Name: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flat map[string]string
+	if err = msgpackUnmarshal(data, &flat); err != nil || flat["tag"] != "tag" || flat["Name"] != "name" {
+		t.Errorf("got = %v, err = %v", flat, err)
+	}
+	var small int8
+	if err = msgpackUnmarshal([]byte{0xcd, 0x01, 0x00}, &small); err == nil {
+		t.Errorf("expect overflow error")
+	}
+	if err = msgpackUnmarshal([]byte{0xda, 0x00}, &got); err == nil {
+		t.Errorf("expect short data error")
+	}
+}
+
+func TestMsgpack_Depth(t *testing.T) {
+	nested := append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth-1), 0xc0)
+	var got interface{}
+	if err := msgpackUnmarshal(nested, &got); err != nil {
+		t.Errorf("%d levels: %v", msgpackMaxDepth, err)
+	}
+	// 大量嵌套的数组或映射不能耗尽栈空间
+	for _, code := range []byte{0x91, 0x81} {
+		hostile := bytes.Repeat([]byte{code}, 1<<20)
+		if err := msgpackUnmarshal(hostile, &got); !errors.Is(err, errMsgpackDepth) {
+			t.Errorf("0x%x: err = %v, want %v", code, err, errMsgpackDepth)
+		}
+	}
+
+	// 自引用的值不能导致无限递归
+	type node struct {
+		Next *node `msgpack:"next"`
+	}
+	n := &node{}
+	n.Next = n
+	s := []interface{}{nil}
+	s[0] = s
+	m := map[string]interface{}{}
+	m["m"] = m
+	var p interface{}
+	p = &p
+	for name, v := range map[string]interface{}{"pointer": n, "slice": s, "map": m, "interface": p} {
+		if _, err := MsgpackCodec.Marshal(v); !errors.Is(err, errMsgpackDepth) {
+			t.Errorf("%s: Marshal() err = %v, want %v", name, err, errMsgpackDepth)
+		}
+	}
+	// 编码的嵌套层数与解码的限制一致
+	var deep interface{} = "leaf"
+	for i := 0; i < msgpackMaxDepth; i++ {
+		deep = []interface{}{deep}
+	}
+	if _, err := MsgpackCodec.Marshal([]interface{}{deep}); !errors.Is(err, errMsgpackDepth) {
+		t.Errorf("%d levels: Marshal() err = %v, want %v", msgpackMaxDepth+1, err, errMsgpackDepth)
+	}
+	data, err := MsgpackCodec.Marshal(deep)
+	if err != nil {
+		t.Fatalf("%d levels: Marshal() err = %v", msgpackMaxDepth, err)
+	}
+	if err := msgpackUnmarshal(data, &got); err != nil {
+		t.Errorf("%d levels: Unmarshal() err = %v", msgpackMaxDepth, err)
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        Codec
+		ok          bool
+	}{
+		{contentType: "application/json", want: JSONCodec, ok: true},
+		{contentType: "Application/JSON; charset=utf-8", want: JSONCodec, ok: true},
+		{contentType: "text/json", want: JSONCodec, ok: true},
+		{contentType: ContentTypeMsgpack, want: MsgpackCodec, ok: true},
+		{contentType: "text/plain", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			got, ok := CodecFor(tt.contentType)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("CodecFor() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// recordAcknowledger 记录消息的确认情况
+type recordAcknowledger struct {
+	acked, nacked, requeued bool
+	multiple                bool
+}
+
+func (a *recordAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked, a.multiple = true, multiple
+	return nil
+}
+
+func (a *recordAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked, a.requeued, a.multiple = true, requeue, multiple
+	return nil
+}
+
+func (a *recordAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+// closedAcknowledger 模拟 Channel 已关闭时的确认失败
+type closedAcknowledger struct{}
+
+func (closedAcknowledger) Ack(uint64, bool) error        { return amqp.ErrClosed }
+func (closedAcknowledger) Nack(uint64, bool, bool) error { return amqp.ErrClosed }
+func (closedAcknowledger) Reject(uint64, bool) error     { return amqp.ErrClosed }
+
+func TestTypedConsumer_ConsumerFunc(t *testing.T) {
+	type msg struct {
+		Name string `json:"name"`
+	}
+	body, _ := MsgpackCodec.Marshal(msg{Name: "ezmq"})
+	tests := []struct {
+		name        string
+		delivery    amqp.Delivery
+		disposition Disposition
+		strict      bool
+		wantHandled bool
+		wantBrk     bool
+		wantAck     recordAcknowledger
+	}{
+		{name: "by content type", delivery: amqp.Delivery{ContentType: ContentTypeMsgpack, Body: body},
+			wantHandled: true},
+		{name: "default codec", delivery: amqp.Delivery{Body: []byte(`{"name":"ezmq"}`)},
+			wantHandled: true},
+		{name: "unregistered content type", delivery: amqp.Delivery{ContentType: "text/plain", Body: []byte(`{"name":"ezmq"}`)},
+			wantHandled: true},
+		{name: "strict", delivery: amqp.Delivery{ContentType: "text/plain", Body: []byte(`{"name":"ezmq"}`)},
+			strict: true, wantAck: recordAcknowledger{nacked: true}},
+		{name: "reject", delivery: amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte("bad")},
+			disposition: DispositionReject, wantAck: recordAcknowledger{nacked: true}},
+		{name: "requeue", delivery: amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte("bad")},
+			disposition: DispositionRequeue, wantAck: recordAcknowledger{nacked: true, requeued: true}},
+		{name: "ack", delivery: amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte("bad")},
+			disposition: DispositionAck, wantAck: recordAcknowledger{acked: true}},
+		{name: "stop", delivery: amqp.Delivery{ContentType: ContentTypeJSON, Body: []byte("bad")},
+			disposition: DispositionStop, wantBrk: true, wantAck: recordAcknowledger{nacked: true, requeued: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := &recordAcknowledger{}
+			tt.delivery.Acknowledger = ack
+			var handled bool
+			var decodeErr error
+			tc := NewTypedConsumer[msg](nil, nil).
+				SetDecodeErrDisposition(tt.disposition).
+				SetStrictContentType(tt.strict).
+				SetDecodeErrHandler(func(d *amqp.Delivery, err error) { decodeErr = err })
+			fn := tc.ConsumerFunc(func(m msg, d *amqp.Delivery) (brk bool) {
+				handled = m.Name == "ezmq"
+				return
+			}, false)
+			if brk := fn(&tt.delivery); brk != tt.wantBrk {
+				t.Errorf("brk = %v, want %v", brk, tt.wantBrk)
+			}
+			if handled != tt.wantHandled {
+				t.Errorf("handled = %v, want %v, decode error: %v", handled, tt.wantHandled, decodeErr)
+			}
+			if *ack != tt.wantAck {
+				t.Errorf("ack = %+v, want %+v", *ack, tt.wantAck)
+			}
+			if tt.strict && !errors.Is(decodeErr, ErrUnknownContentType) {
+				t.Errorf("decode error = %v, want %v", decodeErr, ErrUnknownContentType)
+			}
+		})
+	}
+}
+
+func TestTypedConsumer_logger(t *testing.T) {
+	conn, buf := newLogConnection(t)
+	fn := NewTypedConsumer[int](conn.Consumer(), nil).
+		SetDecodeErrDisposition(DispositionReject).
+		ConsumerFunc(func(int, *amqp.Delivery) (brk bool) { return }, false)
+	fn(&amqp.Delivery{Acknowledger: closedAcknowledger{}, DeliveryTag: 1, ContentType: ContentTypeJSON, Body: []byte("bad")})
+	for _, want := range []string{"decode message failed:", "settle message failed:", "delivery_tag=1"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("connection log %q does not contain %q", buf.String(), want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+	EncodingLZW     = "compress"
+)
+
+// Compressor 用于压缩和解压消息体。
+//
+// Encoding 返回的编码会被写入 amqp.Publishing.ContentEncoding，
+// 接收消息时会根据 amqp.Delivery.ContentEncoding 选择对应的 Compressor 解压。
+type Compressor interface {
+	Encoding() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	GzipCompressor  Compressor = NewGzipCompressor(gzip.DefaultCompression)
+	FlateCompressor Compressor = NewFlateCompressor(flate.DefaultCompression)
+	LZWCompressor   Compressor = lzwCompressor{}
+)
+
+var (
+	compressors    = map[string]Compressor{}
+	compressorsMut sync.RWMutex
+)
+
+// DefaultMaxDecompressedSize 解压后消息体的默认最大字节数
+const DefaultMaxDecompressedSize = 64 << 20
+
+var ErrDecompressedTooLarge = errors.New("decompressed body exceeds the size limit")
+
+var maxDecompressedSize int64 = DefaultMaxDecompressedSize
+
+// SetMaxDecompressedSize 设置内置 Compressor 解压后消息体的最大字节数，超过时 Decompress 返回 ErrDecompressedTooLarge，
+// 防止很小的恶意消息解压后耗尽内存。size 小于等于 0 时使用 DefaultMaxDecompressedSize。
+func SetMaxDecompressedSize(size int64) {
+	if size <= 0 {
+		size = DefaultMaxDecompressedSize
+	}
+	atomic.StoreInt64(&maxDecompressedSize, size)
+}
+
+func init() {
+	RegisterCompressor(GzipCompressor)
+	RegisterCompressor(FlateCompressor)
+	RegisterCompressor(LZWCompressor)
+}
+
+// RegisterCompressor 注册 Compressor。如果已存在相同编码的 Compressor，则覆盖原有的 Compressor。
+func RegisterCompressor(c Compressor) {
+	if c == nil {
+		panic("Compressor must not be nil")
+	}
+	compressorsMut.Lock()
+	defer compressorsMut.Unlock()
+	compressors[strings.ToLower(c.Encoding())] = c
+}
+
+// CompressorFor 根据编码获取已注册的 Compressor
+func CompressorFor(encoding string) (Compressor, bool) {
+	compressorsMut.RLock()
+	defer compressorsMut.RUnlock()
+	c, ok := compressors[strings.ToLower(strings.TrimSpace(encoding))]
+	return c, ok
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+// NewGzipCompressor 创建指定压缩级别的 gzip Compressor，level 详见 gzip.NewWriterLevel
+func NewGzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+func (c *gzipCompressor) Encoding() string { return EncodingGzip }
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	return writeAndClose(&buf, w, data)
+}
+
+func (c *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAllLimited(r)
+}
+
+type flateCompressor struct {
+	level int
+}
+
+// NewFlateCompressor 创建指定压缩级别的 deflate Compressor，level 详见 flate.NewWriter
+func NewFlateCompressor(level int) Compressor {
+	return &flateCompressor{level: level}
+}
+
+func (c *flateCompressor) Encoding() string { return EncodingDeflate }
+
+func (c *flateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	return writeAndClose(&buf, w, data)
+}
+
+func (c *flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readAllLimited(r)
+}
+
+type lzwCompressor struct{}
+
+func (lzwCompressor) Encoding() string { return EncodingLZW }
+
+func (lzwCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return writeAndClose(&buf, lzw.NewWriter(&buf, lzw.MSB, 8), data)
+}
+
+func (lzwCompressor) Decompress(data []byte) ([]byte, error) {
+	r := lzw.NewReader(bytes.NewReader(data), lzw.MSB, 8)
+	defer r.Close()
+	return readAllLimited(r)
+}
+
+// readAllLimited 读取解压后的全部内容，超过 SetMaxDecompressedSize 设置的大小时返回 ErrDecompressedTooLarge
+func readAllLimited(r io.Reader) ([]byte, error) {
+	limit := atomic.LoadInt64(&maxDecompressedSize)
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrDecompressedTooLarge
+	}
+	return data, nil
+}
+
+func writeAndClose(buf *bytes.Buffer, w io.WriteCloser, data []byte) ([]byte, error) {
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,106 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCompressor_RoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"name":"ezmq","value":12345}`), 100)
+	tests := []struct {
+		name       string
+		compressor Compressor
+	}{
+		{name: "gzip", compressor: GzipCompressor},
+		{name: "deflate", compressor: FlateCompressor},
+		{name: "lzw", compressor: LZWCompressor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := NewSendOptsBuilder().SetCompressor(tt.compressor, 16).Build()
+			msg, err := opts.publishing(body)
+			if err != nil {
+				t.Fatalf("publishing() error = %v", err)
+			}
+			if msg.ContentEncoding != tt.compressor.Encoding() || len(msg.Body) >= len(body) {
+				t.Fatalf("publishing() encoding = %q, size = %d", msg.ContentEncoding, len(msg.Body))
+			}
+
+			delivery := &amqp.Delivery{ContentEncoding: msg.ContentEncoding, Body: msg.Body}
+			if err = DefaultReceiveOpts().restore(delivery); err != nil {
+				t.Fatalf("restore() error = %v", err)
+			}
+			if !bytes.Equal(delivery.Body, body) || delivery.ContentEncoding != "" {
+				t.Errorf("restore() got = %q, encoding = %q", delivery.Body, delivery.ContentEncoding)
+			}
+		})
+	}
+}
+
+func TestCompressor_maxDecompressedSize(t *testing.T) {
+	SetMaxDecompressedSize(1 << 10)
+	defer SetMaxDecompressedSize(0)
+	for _, compressor := range []Compressor{GzipCompressor, FlateCompressor, LZWCompressor} {
+		for size, wantErr := range map[int]bool{1 << 10: false, 1<<10 + 1: true} {
+			data, err := compressor.Compress(make([]byte, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := compressor.Decompress(data)
+			if wantErr && !errors.Is(err, ErrDecompressedTooLarge) {
+				t.Errorf("%s: Decompress(%d bytes) error = %v, want %v", compressor.Encoding(), size, err, ErrDecompressedTooLarge)
+			} else if !wantErr && (err != nil || len(got) != size) {
+				t.Errorf("%s: Decompress(%d bytes) = %d bytes, %v", compressor.Encoding(), size, len(got), err)
+			}
+		}
+	}
+}
+
+func TestSendOpts_publishing_threshold(t *testing.T) {
+	opts := NewSendOptsBuilder().SetCompressor(GzipCompressor, 1024).Build()
+	msg, err := opts.publishing([]byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ContentEncoding != "" || string(msg.Body) != "small" {
+		t.Errorf("publishing() should not compress body under threshold, got encoding %q", msg.ContentEncoding)
+	}
+}
+
+func TestReceiveOpts_restore(t *testing.T) {
+	tests := []struct {
+		name     string
+		delivery amqp.Delivery
+		wantErr  bool
+	}{
+		{name: "no encoding", delivery: amqp.Delivery{Body: []byte("plain")}},
+		{name: "unknown encoding", delivery: amqp.Delivery{ContentEncoding: "utf-8", Body: []byte("plain")}},
+		{name: "corrupted", delivery: amqp.Delivery{ContentEncoding: EncodingGzip, Body: []byte("plain")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := DefaultReceiveOpts().restore(&tt.delivery); (err != nil) != tt.wantErr {
+				t.Errorf("restore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
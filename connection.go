@@ -23,6 +23,7 @@ import (
 	"os"
 	"sync"
 	"syscall"
+	"time"
 )
 
 const (
@@ -36,14 +37,23 @@ type Operations map[string]Operation
 
 // Connection ampq 连接。 Connection 创建后不会直接连接服务器，而是要调用 Dial 后才会执行连接服务器操作
 type Connection struct {
-	c             *amqp.Connection // 用于真正发起一个 amqp 连接
-	cMut          sync.RWMutex     // 用于读写 c 时加锁
-	url           string
-	retryable     Retryable // 重试配置
-	operations    Operations
-	oMut          sync.Mutex    // 用于读写 operations 时加锁
-	genOptKeyFunc func() string // 用于生成 operations 的 key，每次调用都会生成新的 key
-	sync.Once                   // 用于保证 Dial 只被调用一次
+	c               AMQPConnection // 用于真正发起一个 amqp 连接
+	cMut            sync.RWMutex   // 用于读写 c 时加锁
+	url             string
+	dialer          Dialer
+	lg              Logger          // 为 nil 时使用全局的 Logger
+	metricsRecorder MetricsRecorder // 为 nil 时使用全局的 MetricsRecorder
+	propagator      Propagator      // 为 nil 时使用全局的 Propagator 和 Tracer
+	tracer          Tracer
+	blocked         amqp.Blocking              // 服务器是否阻塞了发布（如内存或磁盘告警）
+	downSince       time.Time                  // 最近一次断线的时间，连接正常时为零值
+	subs            map[*Subscription]struct{} // 由 Consumer.Receive 创建且尚未结束的订阅
+	hMut            sync.Mutex                 // 用于读写 blocked、downSince 和 subs 时加锁
+	retryable       Retryable                  // 重试配置
+	operations      Operations
+	oMut            sync.Mutex    // 用于读写 operations 时加锁
+	genOptKeyFunc   func() string // 用于生成 operations 的 key，每次调用都会生成新的 key
+	sync.Once                     // 用于保证 Dial 只被调用一次
 }
 
 // retryable 如果为 nil，则使用 emptyRetryable 替换。emptyRetryable 不会尝试重试操作。
@@ -51,12 +61,29 @@ func NewConnection(url string, retryable Retryable) *Connection {
 	return &Connection{
 		url:           url,
 		retryable:     getNonNilRetryable(retryable),
+		dialer:        DefaultDialer,
 		operations:    make(Operations, 0),
 		genOptKeyFunc: NewDefaultSAdder(),
 	}
 }
 
-func (c *Connection) setConn(conn *amqp.Connection) {
+// SetDialer 设置连接服务器使用的 Dialer，必须在 Dial 之前调用。dialer 为 nil 时使用 DefaultDialer。
+func (c *Connection) SetDialer(dialer Dialer) *Connection {
+	if dialer == nil {
+		dialer = DefaultDialer
+	}
+	c.dialer = dialer
+	return c
+}
+
+// SetLogger 设置该 Connection 及其创建的 Channel、Producer、Consumer 等使用的 Logger，必须在 Dial 之前调用。
+// lg 为 nil 时使用全局的 Logger（见 SetLogger）。
+func (c *Connection) SetLogger(lg Logger) *Connection {
+	c.lg = lg
+	return c
+}
+
+func (c *Connection) setConn(conn AMQPConnection) {
 	c.cMut.Lock()
 	defer c.cMut.Unlock()
 	c.c = conn
@@ -74,7 +101,7 @@ func (c *Connection) Dial() error {
 // dial 连接服务器，但不提供断线重连
 func (c *Connection) dial() error {
 	var err error
-	conn, err := amqp.Dial(c.url)
+	conn, err := c.dialer.Dial(c.url)
 	if err != nil {
 		return err
 	}
@@ -99,6 +126,10 @@ func (c *Connection) reDial() error {
 	// 执行监听操作
 	monitor := c.c.NotifyClose(make(chan *amqp.Error))
 	go c.reconnectListener(monitor)
+	c.hMut.Lock()
+	c.blocked, c.downSince = amqp.Blocking{}, time.Time{}
+	c.hMut.Unlock()
+	go c.blockedListener(c.c.NotifyBlocked(make(chan amqp.Blocking, 1)))
 
 	return nil
 }
@@ -107,14 +138,16 @@ func (c *Connection) reDial() error {
 func (c *Connection) doReDial() error {
 	retryable := c.retryable
 	var err error
+	attempt := 0
 	retryable.retry(func() (brk bool) {
+		attempt++
 		err = c.dial()
 		// 连接成功，退出循环；
 		// 不是网络连接错误，退出循环。
 		if err == nil || !isConnectedErr(err) {
 			return true
 		}
-		debug("try to re-dial...")
+		c.debug("try to re-dial:", err, urlField(c.url), attemptField(attempt))
 		return false
 	})
 	return err
@@ -125,11 +158,11 @@ func (c *Connection) reconnect(err error) bool {
 	if err == nil {
 		return true
 	}
-	for true {
-		debug("try to reconnect...")
+	for attempt := 1; ; attempt++ {
+		c.debug("try to reconnect:", err, urlField(c.url), attemptField(attempt))
 
 		if !isAmqpConnectedErr(err) {
-			info("reconnect failed: ", err)
+			c.info("reconnect failed:", err, urlField(c.url), attemptField(attempt))
 			return false
 		}
 
@@ -137,8 +170,9 @@ func (c *Connection) reconnect(err error) bool {
 		_ = c.Close()
 
 		err = c.reDial()
+		c.metrics().Reconnect(err)
 		if err == nil {
-			debug("reconnected!")
+			c.info("reconnected", urlField(c.url), attemptField(attempt))
 			break
 		}
 	}
@@ -158,9 +192,13 @@ func (c *Connection) Channel() (*Channel, error) {
 	return newChannel(ch, c), nil
 }
 
-func (c *Connection) channel() (*amqp.Channel, error) {
+func (c *Connection) channel() (AMQPChannel, error) {
 	c.cMut.RLock()
 	defer c.cMut.RUnlock()
+	if c.c == nil {
+		// 尚未连接或正在重连
+		return nil, amqp.ErrClosed
+	}
 	return c.c.Channel()
 }
 
@@ -201,7 +239,8 @@ func (c *Connection) execOperation(key string, opt Operation) error {
 		return err
 	}
 	go func() {
-		defer channel.Close()
+		// Operation 中可能会重建 channel.Channel，因此需要在最后再取值
+		defer func() { _ = channel.Close() }()
 		opt(key, channel)
 	}()
 	return nil
@@ -230,18 +269,17 @@ func (c *Connection) exec() {
 		fn := opt
 		err := c.execOperation(key, fn)
 		if err != nil {
-			warn(err)
+			c.warn("execute operation failed:", err, urlField(c.url), Field{Key: "operation", Value: key})
 			return
 		}
 	}
 }
 
+// RemoveOperation 移除 Operation。返回后，重连成功时不会再执行该 Operation。
 func (c *Connection) RemoveOperation(key string) {
-	go func() {
-		c.oMut.Lock()
-		defer c.oMut.Unlock()
-		delete(c.operations, key)
-	}()
+	c.oMut.Lock()
+	defer c.oMut.Unlock()
+	delete(c.operations, key)
 }
 
 // Close 关闭 Connection。
@@ -257,6 +295,11 @@ func (c *Connection) Close() error {
 	return nil
 }
 
+// URI 返回解析后的连接地址，其中包括用户名、密码和虚拟主机，可用于连接管理插件等其他服务
+func (c *Connection) URI() (amqp.URI, error) {
+	return amqp.ParseURI(c.url)
+}
+
 func (c *Connection) IsOpen() bool {
 	c.cMut.RLock()
 	defer c.cMut.RUnlock()
@@ -272,7 +315,7 @@ func (c *Connection) Consumer() *Consumer {
 }
 
 func (c *Connection) Producer() *Producer {
-	return &Producer{c}
+	return &Producer{c: c}
 }
 
 func (c *Connection) QueueBuilder() *QueueBuilder {
@@ -289,6 +332,9 @@ func (c *Connection) reconnectListener(monitor chan *amqp.Error) {
 	if !ok {
 		return
 	}
+	c.hMut.Lock()
+	c.downSince = time.Now()
+	c.hMut.Unlock()
 	if c.reconnect(err) {
 		c.exec()
 	}
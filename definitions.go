@@ -0,0 +1,264 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultVhost 是 RabbitMQ 的默认虚拟主机
+const DefaultVhost = "/"
+
+// Definitions 管理插件导出的 definitions.json，即 `rabbitmqctl export_definitions` 或 GET /api/definitions 的结果。
+// 只解析交换器、队列、绑定和策略，用户、权限和参数等其他内容会被忽略。
+// 按虚拟主机导出（GET /api/definitions/{vhost}）时，各项定义中没有 vhost 字段，此时 Vhost 为空。
+//
+// 通过 Topology 可以取出某个虚拟主机下的拓扑，再通过 Topology.Apply 在没有管理插件的情况下声明，例如：
+//
+//	defs, err := ezmq.LoadDefinitionsFile("definitions.json")
+//	top, err := defs.Topology("orders")
+//	plan, err := top.Apply(conn)
+type Definitions struct {
+	RabbitVersion string               `json:"rabbit_version,omitempty"`
+	Vhosts        []DefinitionVhost    `json:"vhosts,omitempty"`
+	Policies      []DefinitionPolicy   `json:"policies"`
+	Queues        []DefinitionQueue    `json:"queues"`
+	Exchanges     []DefinitionExchange `json:"exchanges"`
+	Bindings      []DefinitionBinding  `json:"bindings"`
+}
+
+type DefinitionVhost struct {
+	Name string `json:"name"`
+}
+
+type DefinitionExchange struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost,omitempty"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Internal   bool                   `json:"internal"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+type DefinitionQueue struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost,omitempty"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Type       string                 `json:"type,omitempty"` // 新版本 RabbitMQ 导出的队列类型，与 x-queue-type 参数等价
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+type DefinitionBinding struct {
+	Source          string                 `json:"source"`
+	Vhost           string                 `json:"vhost,omitempty"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+}
+
+type DefinitionPolicy struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost,omitempty"`
+	Pattern    string                 `json:"pattern"`
+	ApplyTo    string                 `json:"apply-to"`
+	Priority   int                    `json:"priority"`
+	Definition map[string]interface{} `json:"definition"`
+}
+
+// LoadDefinitions 解析管理插件导出的 definitions.json
+func LoadDefinitions(r io.Reader) (*Definitions, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	d := &Definitions{}
+	if err = dec.Decode(d); err != nil {
+		return nil, fmt.Errorf("invalid definitions: %w", err)
+	}
+	return d, nil
+}
+
+// LoadDefinitionsFile 从文件解析 definitions.json，详见 LoadDefinitions
+func LoadDefinitionsFile(path string) (*Definitions, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadDefinitions(f)
+}
+
+// Topology 取出虚拟主机 vhost 下的交换器、队列、绑定和策略，并校验其中的内容。vhost 为空时使用 DefaultVhost。
+// 没有 vhost 字段的定义（按虚拟主机导出的文件）视为属于 vhost。
+func (d *Definitions) Topology(vhost string) (*Topology, error) {
+	if vhost == "" {
+		vhost = DefaultVhost
+	}
+	in := func(v string) bool { return v == "" || v == vhost }
+	t := &Topology{}
+	for _, ex := range d.Exchanges {
+		if in(ex.Vhost) {
+			t.Exchanges = append(t.Exchanges, ExchangeDef{
+				Name:       ex.Name,
+				Type:       ex.Type,
+				Durable:    ex.Durable,
+				AutoDelete: ex.AutoDelete,
+				Internal:   ex.Internal,
+				Arguments:  tableOf(ex.Arguments),
+			})
+		}
+	}
+	for _, q := range d.Queues {
+		if in(q.Vhost) {
+			args := tableOf(q.Arguments)
+			if _, ok := args["x-queue-type"]; !ok && q.Type != "" && q.Type != "classic" {
+				if args == nil {
+					args = make(map[string]interface{})
+				}
+				args["x-queue-type"] = q.Type
+			}
+			t.Queues = append(t.Queues, QueueDef{
+				Name:       q.Name,
+				Durable:    q.Durable,
+				AutoDelete: q.AutoDelete,
+				Arguments:  args,
+			})
+		}
+	}
+	for _, b := range d.Bindings {
+		if in(b.Vhost) {
+			t.Bindings = append(t.Bindings, BindingDef{
+				Source:          b.Source,
+				Destination:     b.Destination,
+				DestinationType: b.DestinationType,
+				RoutingKey:      b.RoutingKey,
+				Arguments:       tableOf(b.Arguments),
+			})
+		}
+	}
+	for _, p := range d.Policies {
+		if in(p.Vhost) {
+			t.Policies = append(t.Policies, PolicyDef{
+				Name:       p.Name,
+				Pattern:    p.Pattern,
+				ApplyTo:    p.ApplyTo,
+				Priority:   p.Priority,
+				Definition: tableOf(p.Definition),
+			})
+		}
+	}
+	if err := t.normalize(); err != nil {
+		return nil, fmt.Errorf("vhost %s: %w", vhost, err)
+	}
+	return t, nil
+}
+
+// tableOf 将空的参数视为 nil，与 LoadTopology 的结果保持一致
+func tableOf(m map[string]interface{}) map[string]interface{} {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// Definitions 将拓扑导出为管理插件的 definitions.json 格式，各项定义都属于虚拟主机 vhost，vhost 为空时使用 DefaultVhost。
+// 导出的结果可以通过管理插件或 `rabbitmqctl import_definitions` 导入。
+// 排他队列只在声明它的连接上存在，definitions.json 无法表示，因此会被忽略。
+func (t *Topology) Definitions(vhost string) *Definitions {
+	if vhost == "" {
+		vhost = DefaultVhost
+	}
+	d := &Definitions{
+		Vhosts:    []DefinitionVhost{{Name: vhost}},
+		Policies:  make([]DefinitionPolicy, 0, len(t.Policies)),
+		Queues:    make([]DefinitionQueue, 0, len(t.Queues)),
+		Exchanges: make([]DefinitionExchange, 0, len(t.Exchanges)),
+		Bindings:  make([]DefinitionBinding, 0, len(t.Bindings)),
+	}
+	for _, ex := range t.Exchanges {
+		d.Exchanges = append(d.Exchanges, DefinitionExchange{
+			Name:       ex.Name,
+			Vhost:      vhost,
+			Type:       ex.Type,
+			Durable:    ex.Durable,
+			AutoDelete: ex.AutoDelete,
+			Internal:   ex.Internal,
+			Arguments:  argumentsOf(ex.Arguments),
+		})
+	}
+	for _, q := range t.Queues {
+		if q.Exclusive {
+			continue
+		}
+		d.Queues = append(d.Queues, DefinitionQueue{
+			Name:       q.Name,
+			Vhost:      vhost,
+			Durable:    q.Durable,
+			AutoDelete: q.AutoDelete,
+			Arguments:  argumentsOf(q.Arguments),
+		})
+	}
+	for _, b := range t.Bindings {
+		d.Bindings = append(d.Bindings, DefinitionBinding{
+			Source:          b.Source,
+			Vhost:           vhost,
+			Destination:     b.Destination,
+			DestinationType: b.DestinationType,
+			RoutingKey:      b.RoutingKey,
+			Arguments:       argumentsOf(b.Arguments),
+		})
+	}
+	for _, p := range t.Policies {
+		applyTo := p.ApplyTo
+		if applyTo == "" {
+			applyTo = "all"
+		}
+		d.Policies = append(d.Policies, DefinitionPolicy{
+			Name:       p.Name,
+			Vhost:      vhost,
+			Pattern:    p.Pattern,
+			ApplyTo:    applyTo,
+			Priority:   p.Priority,
+			Definition: argumentsOf(p.Definition),
+		})
+	}
+	return d
+}
+
+// argumentsOf 管理插件导出的参数总是 JSON 对象，不会是 null
+func argumentsOf(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return map[string]interface{}{}
+	}
+	return m
+}
+
+// Write 将 definitions.json 以缩进格式写入 w
+func (d *Definitions) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
@@ -0,0 +1,119 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const definitionsJSON = `{
+  "rabbit_version": "3.12.10",
+  "users": [{"name": "guest", "password_hash": "x", "tags": ["administrator"]}],
+  "vhosts": [{"name": "/"}, {"name": "orders"}],
+  "permissions": [],
+  "parameters": [],
+  "policies": [
+    {"vhost": "orders", "name": "max-length", "pattern": "^orders$", "apply-to": "queues", "definition": {"max-length": 1000}, "priority": 1}
+  ],
+  "queues": [
+    {"name": "orders", "vhost": "orders", "durable": true, "auto_delete": false, "arguments": {"x-queue-type": "quorum", "x-message-ttl": 60000}},
+    {"name": "orders.dlq", "vhost": "orders", "durable": true, "auto_delete": false, "type": "stream", "arguments": {}},
+    {"name": "other", "vhost": "/", "durable": true, "auto_delete": false, "arguments": {}}
+  ],
+  "exchanges": [
+    {"name": "events", "vhost": "orders", "type": "topic", "durable": true, "auto_delete": false, "internal": false, "arguments": {}},
+    {"name": "other", "vhost": "/", "type": "fanout", "durable": true, "auto_delete": false, "internal": false, "arguments": {}}
+  ],
+  "bindings": [
+    {"source": "events", "vhost": "orders", "destination": "orders", "destination_type": "queue", "routing_key": "order.*", "arguments": {}},
+    {"source": "other", "vhost": "/", "destination": "other", "destination_type": "queue", "routing_key": "", "arguments": {}}
+  ]
+}`
+
+func TestDefinitions_Topology(t *testing.T) {
+	defs, err := LoadDefinitions(strings.NewReader(definitionsJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := defs.Topology("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Topology{
+		Exchanges: []ExchangeDef{{Name: "events", Type: "topic", Durable: true}},
+		Queues: []QueueDef{
+			{Name: "orders", Durable: true, Arguments: map[string]interface{}{"x-queue-type": "quorum", "x-message-ttl": int64(60000)}},
+			{Name: "orders.dlq", Durable: true, Arguments: map[string]interface{}{"x-queue-type": "stream"}},
+		},
+		Bindings: []BindingDef{{Source: "events", Destination: "orders", DestinationType: DestinationQueue, RoutingKey: "order.*"}},
+		Policies: []PolicyDef{{Name: "max-length", Pattern: "^orders$", ApplyTo: "queues", Priority: 1, Definition: map[string]interface{}{"max-length": int64(1000)}}},
+	}
+	if !reflect.DeepEqual(top, want) {
+		t.Errorf("Topology(orders) = %+v, want %+v", top, want)
+	}
+
+	top, err = defs.Topology("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top.Exchanges) != 1 || top.Exchanges[0].Name != "other" || len(top.Queues) != 1 || len(top.Bindings) != 1 || len(top.Policies) != 0 {
+		t.Errorf("Topology(/) = %+v", top)
+	}
+}
+
+func TestDefinitions_TopologyInvalid(t *testing.T) {
+	defs, err := LoadDefinitions(strings.NewReader(`{"bindings": [{"source": "missing", "destination": "q", "destination_type": "queue"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = defs.Topology("/"); err == nil || !strings.Contains(err.Error(), "exchange missing is not declared") {
+		t.Errorf("Topology() error = %v", err)
+	}
+	if _, err = LoadDefinitions(strings.NewReader(`{"queues": {}}`)); err == nil {
+		t.Error("LoadDefinitions() expected an error")
+	}
+}
+
+func TestTopology_Definitions(t *testing.T) {
+	top, err := LoadTopology(strings.NewReader(topologyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := *top
+	exported.Queues = append(exported.Queues, QueueDef{Name: "local", Exclusive: true})
+	var buf bytes.Buffer
+	if err = exported.Definitions("orders").Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"apply-to": "queues"`) || !strings.Contains(buf.String(), `"arguments": {}`) {
+		t.Errorf("Write() = %s", buf.String())
+	}
+	defs, err := LoadDefinitions(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := defs.Topology("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, top) {
+		t.Errorf("round trip = %+v, want %+v", got, top) // 排他队列不会被导出
+	}
+}
@@ -0,0 +1,636 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DumpRecord 队列导出文件中的一条消息。
+//
+// 导出文件为 NDJSON 格式，每行一条消息，保留消息体、属性和消息头。消息头中 JSON 无法准确表示的类型
+// （如 int32、float64、[]byte、time.Time、amqp.Decimal）会被编码为 {"$type": 类型, "value": 值}，
+// 导入时会还原为原来的类型。消息体如果是合法的 UTF-8 文本则原样保存，否则使用 base64 编码。
+type DumpRecord struct {
+	Exchange    string
+	RoutingKey  string
+	Redelivered bool
+	Publishing  amqp.Publishing
+}
+
+// NewDumpRecord 根据接收到的消息创建 DumpRecord
+func NewDumpRecord(d *amqp.Delivery) *DumpRecord {
+	return &DumpRecord{
+		Exchange:    d.Exchange,
+		RoutingKey:  d.RoutingKey,
+		Redelivered: d.Redelivered,
+		Publishing:  publishingOf(d),
+	}
+}
+
+// publishingOf 返回与接收到的消息相同的 amqp.Publishing
+func publishingOf(d *amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         d.Headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// dumpJSON DumpRecord 的 JSON 格式
+type dumpJSON struct {
+	Exchange     string                 `json:"exchange"`
+	RoutingKey   string                 `json:"routing_key"`
+	Redelivered  bool                   `json:"redelivered,omitempty"`
+	Properties   dumpProperties         `json:"properties"`
+	Headers      map[string]interface{} `json:"headers,omitempty"`
+	Body         string                 `json:"body"`
+	BodyEncoding string                 `json:"body_encoding,omitempty"` // 为空表示 UTF-8 文本
+}
+
+type dumpProperties struct {
+	ContentType     string     `json:"content_type,omitempty"`
+	ContentEncoding string     `json:"content_encoding,omitempty"`
+	DeliveryMode    uint8      `json:"delivery_mode,omitempty"`
+	Priority        uint8      `json:"priority,omitempty"`
+	CorrelationId   string     `json:"correlation_id,omitempty"`
+	ReplyTo         string     `json:"reply_to,omitempty"`
+	Expiration      string     `json:"expiration,omitempty"`
+	MessageId       string     `json:"message_id,omitempty"`
+	Timestamp       *time.Time `json:"timestamp,omitempty"`
+	Type            string     `json:"type,omitempty"`
+	UserId          string     `json:"user_id,omitempty"`
+	AppId           string     `json:"app_id,omitempty"`
+}
+
+const bodyEncodingBase64 = "base64"
+
+func (r *DumpRecord) MarshalJSON() ([]byte, error) {
+	p := &r.Publishing
+	j := dumpJSON{
+		Exchange:    r.Exchange,
+		RoutingKey:  r.RoutingKey,
+		Redelivered: r.Redelivered,
+		Properties: dumpProperties{
+			ContentType:     p.ContentType,
+			ContentEncoding: p.ContentEncoding,
+			DeliveryMode:    p.DeliveryMode,
+			Priority:        p.Priority,
+			CorrelationId:   p.CorrelationId,
+			ReplyTo:         p.ReplyTo,
+			Expiration:      p.Expiration,
+			MessageId:       p.MessageId,
+			Type:            p.Type,
+			UserId:          p.UserId,
+			AppId:           p.AppId,
+		},
+	}
+	if !p.Timestamp.IsZero() {
+		ts := p.Timestamp.UTC()
+		j.Properties.Timestamp = &ts
+	}
+	if len(p.Headers) > 0 {
+		headers, err := encodeHeaderValue(p.Headers)
+		if err != nil {
+			return nil, err
+		}
+		j.Headers = headers.(map[string]interface{})
+	}
+	if utf8.Valid(p.Body) {
+		j.Body = string(p.Body)
+	} else {
+		j.Body = base64.StdEncoding.EncodeToString(p.Body)
+		j.BodyEncoding = bodyEncodingBase64
+	}
+	return json.Marshal(&j)
+}
+
+func (r *DumpRecord) UnmarshalJSON(data []byte) error {
+	var j struct {
+		dumpJSON
+		Headers json.RawMessage `json:"headers"`
+	}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	prop := j.Properties
+	*r = DumpRecord{
+		Exchange:    j.Exchange,
+		RoutingKey:  j.RoutingKey,
+		Redelivered: j.Redelivered,
+		Publishing: amqp.Publishing{
+			ContentType:     prop.ContentType,
+			ContentEncoding: prop.ContentEncoding,
+			DeliveryMode:    prop.DeliveryMode,
+			Priority:        prop.Priority,
+			CorrelationId:   prop.CorrelationId,
+			ReplyTo:         prop.ReplyTo,
+			Expiration:      prop.Expiration,
+			MessageId:       prop.MessageId,
+			Type:            prop.Type,
+			UserId:          prop.UserId,
+			AppId:           prop.AppId,
+		},
+	}
+	if prop.Timestamp != nil {
+		r.Publishing.Timestamp = *prop.Timestamp
+	}
+	if len(j.Headers) > 0 && !bytes.Equal(j.Headers, []byte("null")) {
+		// 使用 json.Number 解析数字，防止整数被解析为 float64
+		dec := json.NewDecoder(bytes.NewReader(j.Headers))
+		dec.UseNumber()
+		var headers map[string]interface{}
+		if err := dec.Decode(&headers); err != nil {
+			return fmt.Errorf("invalid headers: %w", err)
+		}
+		table, err := decodeHeaderValue(headers)
+		if err != nil {
+			return fmt.Errorf("invalid headers: %w", err)
+		}
+		r.Publishing.Headers = table.(amqp.Table)
+	}
+	switch j.BodyEncoding {
+	case "":
+		r.Publishing.Body = []byte(j.Body)
+	case bodyEncodingBase64:
+		body, err := base64.StdEncoding.DecodeString(j.Body)
+		if err != nil {
+			return fmt.Errorf("invalid body: %w", err)
+		}
+		r.Publishing.Body = body
+	default:
+		return fmt.Errorf("unknown body encoding %q", j.BodyEncoding)
+	}
+	return nil
+}
+
+// typedValue 带类型的消息头的值
+func typedValue(typ string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"$type": typ, "value": value}
+}
+
+func encodeHeaderValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil, string, bool, int64, int:
+		return v, nil
+	case int8:
+		return typedValue("int8", v), nil
+	case int16:
+		return typedValue("int16", v), nil
+	case int32:
+		return typedValue("int32", v), nil
+	case uint8:
+		return typedValue("uint8", v), nil
+	case uint16:
+		return typedValue("uint16", v), nil
+	case uint32:
+		return typedValue("uint32", v), nil
+	case float32:
+		return typedValue("float32", v), nil
+	case float64:
+		return typedValue("float64", v), nil
+	case []byte:
+		return typedValue("bytes", base64.StdEncoding.EncodeToString(v)), nil
+	case time.Time:
+		return typedValue("timestamp", v.UTC().Format(time.RFC3339)), nil
+	case amqp.Decimal:
+		return typedValue("decimal", map[string]interface{}{"scale": v.Scale, "value": v.Value}), nil
+	case amqp.Table:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			encoded, err := encodeHeaderValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = encoded
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			encoded, err := encodeHeaderValue(e)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = encoded
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported header value type %T", v)
+}
+
+func decodeHeaderValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		if typ, ok := v["$type"].(string); ok && len(v) == 2 {
+			if value, ok := v["value"]; ok {
+				return decodeTypedValue(typ, value)
+			}
+		}
+		table := make(amqp.Table, len(v))
+		for k, e := range v {
+			decoded, err := decodeHeaderValue(e)
+			if err != nil {
+				return nil, err
+			}
+			table[k] = decoded
+		}
+		return table, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			decoded, err := decodeHeaderValue(e)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = decoded
+		}
+		return s, nil
+	}
+	return v, nil
+}
+
+func decodeTypedValue(typ string, value interface{}) (interface{}, error) {
+	num, _ := value.(json.Number)
+	str, _ := value.(string)
+	parseInt := func(bits int) (int64, error) { return strconv.ParseInt(num.String(), 10, bits) }
+	parseUint := func(bits int) (uint64, error) { return strconv.ParseUint(num.String(), 10, bits) }
+	var (
+		v   interface{}
+		err error
+	)
+	switch typ {
+	case "int8":
+		var i int64
+		i, err = parseInt(8)
+		v = int8(i)
+	case "int16":
+		var i int64
+		i, err = parseInt(16)
+		v = int16(i)
+	case "int32":
+		var i int64
+		i, err = parseInt(32)
+		v = int32(i)
+	case "uint8":
+		var u uint64
+		u, err = parseUint(8)
+		v = uint8(u)
+	case "uint16":
+		var u uint64
+		u, err = parseUint(16)
+		v = uint16(u)
+	case "uint32":
+		var u uint64
+		u, err = parseUint(32)
+		v = uint32(u)
+	case "float32":
+		var f float64
+		f, err = strconv.ParseFloat(num.String(), 32)
+		v = float32(f)
+	case "float64":
+		v, err = strconv.ParseFloat(num.String(), 64)
+	case "bytes":
+		v, err = base64.StdEncoding.DecodeString(str)
+	case "timestamp":
+		v, err = time.Parse(time.RFC3339, str)
+	case "decimal":
+		m, _ := value.(map[string]interface{})
+		scale, _ := m["scale"].(json.Number)
+		val, _ := m["value"].(json.Number)
+		var s, i int64
+		if s, err = strconv.ParseInt(scale.String(), 10, 8); err == nil {
+			i, err = strconv.ParseInt(val.String(), 10, 32)
+		}
+		v = amqp.Decimal{Scale: uint8(s), Value: int32(i)}
+	default:
+		return nil, fmt.Errorf("unknown header value type %q", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header value %v: %w", typ, value, err)
+	}
+	return v, nil
+}
+
+// DumpWriter 将消息以 NDJSON 格式写入 io.Writer
+type DumpWriter struct {
+	w *bufio.Writer
+}
+
+func NewDumpWriter(w io.Writer) *DumpWriter {
+	return &DumpWriter{bufio.NewWriter(w)}
+}
+
+// Write 写入一条消息。写入的内容可能被缓存，需要调用 Flush 确保写入底层的 io.Writer。
+func (w *DumpWriter) Write(r *DumpRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err = w.w.Write(data); err != nil {
+		return err
+	}
+	return w.w.WriteByte('\n')
+}
+
+func (w *DumpWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// DumpReader 读取 DumpWriter 写入的 NDJSON。空行会被忽略。
+type DumpReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewDumpReader(r io.Reader) *DumpReader {
+	return &DumpReader{r: bufio.NewReader(r)}
+}
+
+// Read 读取下一条消息。没有更多消息时返回 io.EOF。
+func (r *DumpReader) Read() (*DumpRecord, error) {
+	for {
+		data, err := r.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(data) == 0) {
+			return nil, err
+		}
+		r.line++
+		if data = bytes.TrimSpace(data); len(data) == 0 {
+			continue
+		}
+		var rec DumpRecord
+		if err = json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return &rec, nil
+	}
+}
+
+// DumpOpts 导出队列的选项。
+//
+// drain 表示导出后从队列中移除消息。默认为 false，即导出后将消息放回队列。
+//
+// limit 表示最多导出的消息数，默认为 0，表示导出队列中的所有消息。
+type DumpOpts struct {
+	drain bool
+	limit int
+}
+
+func DefaultDumpOpts() *DumpOpts {
+	return &DumpOpts{}
+}
+
+type DumpOptsBuilder struct {
+	opts *DumpOpts
+}
+
+func NewDumpOptsBuilder() *DumpOptsBuilder {
+	return &DumpOptsBuilder{DefaultDumpOpts()}
+}
+
+func (bld *DumpOptsBuilder) SetDrain(b bool) *DumpOptsBuilder {
+	bld.opts.drain = b
+	return bld
+}
+
+func (bld *DumpOptsBuilder) SetLimit(limit int) *DumpOptsBuilder {
+	bld.opts.limit = limit
+	return bld
+}
+
+func (bld *DumpOptsBuilder) Build() *DumpOpts {
+	return bld.opts
+}
+
+// DumpQueue 使用 basic.get 逐条获取队列中的消息并写入 w（格式见 DumpRecord），返回导出的消息数。
+// opts 如果为 nil，将使用 DefaultDumpOpts() 作为默认配置。
+//
+// 导出期间获取的消息都不会被确认，因此不会被重复获取，也不会投递给其他消费者。全部写入后，
+// 如果设置了 drain，则确认所有消息，将其从队列中移除；否则拒绝所有消息并重新入队，消息会保持原来的顺序，但会被标记为 redelivered。
+// 导出失败时消息总是会重新入队。
+//
+// 注意：如果在确认消息前连接断开，消息会被服务器重新入队。因此使用 drain 时，消息可能既被导出，又留在队列中。
+func (c *Connection) DumpQueue(ctx context.Context, queue string, w io.Writer, opts *DumpOpts) (n int, err error) {
+	if opts == nil {
+		opts = DefaultDumpOpts()
+	}
+	ch, err := c.Channel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	dw := NewDumpWriter(w)
+	var last uint64 // 最后获取的消息的 delivery tag
+	for opts.limit <= 0 || n < opts.limit {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		d, ok, e := ch.Get(queue, false)
+		if err = e; err != nil || !ok {
+			break
+		}
+		last = d.DeliveryTag
+		if err = dw.Write(NewDumpRecord(&d)); err != nil {
+			break
+		}
+		n++
+	}
+	if err == nil {
+		err = dw.Flush()
+	}
+	if last == 0 {
+		return n, err
+	}
+	if opts.drain && err == nil {
+		if err = ch.Ack(last, true); err != nil {
+			return n, fmt.Errorf("ack dumped messages: %w", err)
+		}
+		return n, nil
+	}
+	if e := ch.Nack(last, true, true); e != nil {
+		c.warn("requeue dumped messages failed:", e, ch.logField(), queueField(queue))
+	}
+	return n, err
+}
+
+// ReplayOpts 导入消息的选项。
+//
+// exchange 和 routingKey 如果设置了，会替换导出时记录的交换器和路由键。例如重新发送到原来的队列，
+// 可以将 exchange 设为 ""（默认交换器），routingKey 设为队列名。
+//
+// rate 表示每秒最多发送的消息数，默认为 0，表示不限制。
+//
+// dryRun 表示只读取并校验消息，不发送。
+//
+// retryable 表示未收到服务器确认（nack 或连接断开）时的重发配置，默认为 DefaultTimesRetry()。
+// 每条消息都使用 retryable 的独立副本，互不影响。消息总是使用 Confirm Mode 发送。
+type ReplayOpts struct {
+	exchange, routingKey       string
+	setExchange, setRoutingKey bool
+	rate                       float64
+	dryRun                     bool
+	retryable                  Retryable
+}
+
+func DefaultReplayOpts() *ReplayOpts {
+	return &ReplayOpts{retryable: DefaultTimesRetry()}
+}
+
+type ReplayOptsBuilder struct {
+	opts *ReplayOpts
+}
+
+func NewReplayOptsBuilder() *ReplayOptsBuilder {
+	return &ReplayOptsBuilder{DefaultReplayOpts()}
+}
+
+func (bld *ReplayOptsBuilder) SetExchange(exchange string) *ReplayOptsBuilder {
+	bld.opts.exchange, bld.opts.setExchange = exchange, true
+	return bld
+}
+
+func (bld *ReplayOptsBuilder) SetRoutingKey(routingKey string) *ReplayOptsBuilder {
+	bld.opts.routingKey, bld.opts.setRoutingKey = routingKey, true
+	return bld
+}
+
+func (bld *ReplayOptsBuilder) SetRate(perSecond float64) *ReplayOptsBuilder {
+	bld.opts.rate = perSecond
+	return bld
+}
+
+func (bld *ReplayOptsBuilder) SetDryRun(b bool) *ReplayOptsBuilder {
+	bld.opts.dryRun = b
+	return bld
+}
+
+func (bld *ReplayOptsBuilder) SetRetryable(retryable Retryable) *ReplayOptsBuilder {
+	bld.opts.retryable = retryable
+	return bld
+}
+
+func (bld *ReplayOptsBuilder) Build() *ReplayOpts {
+	return bld.opts
+}
+
+// Replay 读取 DumpQueue 导出的消息（格式见 DumpRecord），并按顺序使用 Confirm Mode 重新发送，返回发送（或 dryRun 时读取）的消息数。
+// opts 如果为 nil，将使用 DefaultReplayOpts() 作为默认配置。
+//
+// 消息的属性和消息头会原样发送。发送失败时立即返回，已发送的消息数可用于从断点继续导入。
+func (c *Connection) Replay(ctx context.Context, r io.Reader, opts *ReplayOpts) (n int, err error) {
+	if opts == nil {
+		opts = DefaultReplayOpts()
+	}
+	var ch *Channel
+	if !opts.dryRun {
+		if ch, err = c.Channel(); err != nil {
+			return 0, err
+		}
+		defer ch.Close()
+	}
+
+	var (
+		msg      amqp.Publishing
+		sendOpts = &SendOpts{
+			messageFactory: func([]byte) amqp.Publishing { return msg },
+		}
+		interval time.Duration
+		next     time.Time
+	)
+	if opts.rate > 0 {
+		interval = time.Duration(float64(time.Second) / opts.rate)
+	}
+	dr := NewDumpReader(r)
+	for {
+		rec, err := dr.Read()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if opts.dryRun {
+			n++
+			continue
+		}
+		if interval > 0 {
+			if err = sleepCtx(ctx, time.Until(next)); err != nil {
+				return n, err
+			}
+			next = time.Now().Add(interval)
+		} else if err = ctx.Err(); err != nil {
+			return n, err
+		}
+		exchange, routingKey := rec.Exchange, rec.RoutingKey
+		if opts.setExchange {
+			exchange = opts.exchange
+		}
+		if opts.setRoutingKey {
+			routingKey = opts.routingKey
+		}
+		msg = rec.Publishing
+		sendOpts.retryable = cloneRetryable(opts.retryable)
+		if err = ch.SendCtx(ctx, exchange, routingKey, msg.Body, sendOpts); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// sleepCtx 等待 d 或 ctx 结束
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,130 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+	"ezmq/ezmqtest"
+)
+
+func TestDumpAndReplay(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	for _, q := range []string{"src", "dst"} {
+		if _, err = ch.QueueDeclare(q, true, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, body := range []string{"a", "b", "c"} {
+		msg := amqp.Publishing{Body: []byte(body), MessageId: body, Headers: amqp.Table{"n": int32(1)}}
+		if err = ch.Publish("", "src", false, false, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	// 不移除消息
+	var buf bytes.Buffer
+	n, err := conn.DumpQueue(ctx, "src", &buf, nil)
+	if err != nil || n != 3 {
+		t.Fatalf("DumpQueue() = %d, %v, want 3", n, err)
+	}
+	if depth := b.QueueDepth("src"); depth != 3 {
+		t.Fatalf("QueueDepth() after dump = %d, want 3", depth)
+	}
+	d, ok, err := ch.Get("src", true)
+	if err != nil || !ok || string(d.Body) != "a" || !d.Redelivered {
+		t.Fatalf("Get() = %q, redelivered %v, %v, %v, want a", d.Body, d.Redelivered, ok, err)
+	}
+
+	// 移除消息
+	buf.Reset()
+	n, err = conn.DumpQueue(ctx, "src", &buf, ezmq.NewDumpOptsBuilder().SetDrain(true).SetLimit(1).Build())
+	if err != nil || n != 1 || b.QueueDepth("src") != 1 {
+		t.Fatalf("DumpQueue(drain) = %d, %v, depth %d, want 1, 1", n, err, b.QueueDepth("src"))
+	}
+	if _, err = conn.DumpQueue(ctx, "src", &buf, ezmq.NewDumpOptsBuilder().SetDrain(true).Build()); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.Bytes()
+
+	n, err = conn.Replay(ctx, bytes.NewReader(dump), ezmq.NewReplayOptsBuilder().SetDryRun(true).Build())
+	if err != nil || n != 2 || b.QueueDepth("dst") != 0 {
+		t.Fatalf("Replay(dry run) = %d, %v, depth %d, want 2, 0", n, err, b.QueueDepth("dst"))
+	}
+	start := time.Now()
+	opts := ezmq.NewReplayOptsBuilder().SetExchange("").SetRoutingKey("dst").SetRate(20).Build()
+	n, err = conn.Replay(ctx, bytes.NewReader(dump), opts)
+	if err != nil || n != 2 {
+		t.Fatalf("Replay() = %d, %v, want 2", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Replay() took %v, rate limit not applied", elapsed)
+	}
+	for _, want := range []string{"b", "c"} {
+		d, ok, err = ch.Get("dst", true)
+		if err != nil || !ok || string(d.Body) != want || d.MessageId != want || d.Headers["n"] != int32(1) {
+			t.Fatalf("Get() = %+v, %v, %v, want %s", d, ok, err, want)
+		}
+	}
+}
+
+func TestReplay_resend(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err = ch.QueueDeclare("q", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	dump := `{"routing_key":"q","body":"a"}` + "\n" + `{"routing_key":"q","body":"b"}` + "\n"
+	// 被 nack 的消息会被重发，且保持原来的顺序
+	b.NackPublishes(2)
+	opts := ezmq.NewReplayOptsBuilder().SetRetryable(ezmq.NewTimesRetry(false, time.Millisecond, 5)).Build()
+	n, err := conn.Replay(context.Background(), bytes.NewBufferString(dump), opts)
+	if err != nil || n != 2 {
+		t.Fatalf("Replay() = %d, %v, want 2", n, err)
+	}
+	for _, want := range []string{"a", "b"} {
+		if d, ok, err := ch.Get("q", true); err != nil || !ok || string(d.Body) != want {
+			t.Fatalf("Get() = %q, %v, %v, want %s", d.Body, ok, err, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDumpRecord_roundTrip(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	rec := &DumpRecord{
+		Exchange:    "events",
+		RoutingKey:  "order.created",
+		Redelivered: true,
+		Publishing: amqp.Publishing{
+			Headers: amqp.Table{
+				"string": "s",
+				"bool":   true,
+				"int64":  int64(1) << 40,
+				"int32":  int32(-7),
+				"uint8":  uint8(200),
+				"float":  1.0,
+				"bytes":  []byte{0, 1, 2},
+				"time":   ts,
+				"dec":    amqp.Decimal{Scale: 2, Value: 12345},
+				"x-death": []interface{}{
+					amqp.Table{"count": int64(3), "queue": "orders", "routing-keys": []interface{}{"a", "b"}},
+				},
+			},
+			ContentType:   "application/octet-stream",
+			DeliveryMode:  amqp.Persistent,
+			Priority:      5,
+			CorrelationId: "c1",
+			MessageId:     "m1",
+			Timestamp:     ts,
+			AppId:         "app",
+			Body:          []byte{0xff, 0xfe, 'x'},
+		},
+	}
+	data, err := rec.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"body_encoding":"base64"`)) {
+		t.Errorf("binary body not base64 encoded: %s", data)
+	}
+	var got DumpRecord
+	if err = got.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, rec) {
+		t.Errorf("round trip = %+v\nwant %+v", got, *rec)
+	}
+}
+
+func TestDumpRecord_textBody(t *testing.T) {
+	data, err := (&DumpRecord{Publishing: amqp.Publishing{Body: []byte("你好")}}).MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"body":"你好"`)) || bytes.Contains(data, []byte("body_encoding")) {
+		t.Errorf("MarshalJSON() = %s", data)
+	}
+}
+
+func TestDumpReader(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewDumpWriter(&buf)
+	for _, body := range []string{"a", "b"} {
+		if err := w.Write(&DumpRecord{RoutingKey: "q", Publishing: amqp.Publishing{Body: []byte(body)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// 末尾没有换行的行和空行都应当能被正确处理
+	input := buf.String() + "\n" + `{"routing_key":"q","body":"c"}`
+	r := NewDumpReader(strings.NewReader(input))
+	var bodies []string
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, string(rec.Publishing.Body))
+	}
+	if strings.Join(bodies, ",") != "a,b,c" {
+		t.Errorf("bodies = %v", bodies)
+	}
+
+	r = NewDumpReader(strings.NewReader(`{"body":"a"}` + "\n" + `{"headers":{"n":{"$type":"int8","value":300}}}`))
+	if _, err := r.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("Read() error = %v, want line 2 error", err)
+	}
+}
@@ -16,25 +16,133 @@
 
 package ezmq
 
+import (
+	"context"
+	"errors"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrConsumerCanceled = errors.New("consumer canceled by server")
+
 type Consumer struct {
 	c *Connection
 }
 
+// conn 返回 Consumer 所属的 Connection，Consumer 为 nil 时返回 nil（日志使用全局的 Logger）
+func (c *Consumer) conn() *Connection {
+	if c == nil {
+		return nil
+	}
+	return c.c
+}
+
 // Receive 持续接收消息并消费。如果期望只接收一次消息，可以使用 Get 方法。
 // 此方法是异步方法，内部使用了 go routine 执行接收操作，因此即便没有消息
 // 可以接收时，该方法也不会阻塞。
 //
+// 返回的 Subscription 可用于停止、暂停和恢复消费，详见 Subscription。
+//
+// 如果消费者被服务器取消（如队列被删除），会通知实现了 CancelListener 的 lis，
+// 然后按照 ReceiveOpts.resubscribe 的配置自动重新订阅。
+//
 // 详见 Channel.ReceiveOpts
-func (c *Consumer) Receive(queue string, opts *ReceiveOpts, lis ReceiveListener) {
-	c.c.RegisterAndExec(func(key string, ch *Channel) {
-		err := ch.ReceiveOpts(queue, lis.Consumer, opts)
-		if err == nil {
-			lis.Remove(key, ch)
+func (c *Consumer) Receive(queue string, opts *ReceiveOpts, lis ReceiveListener) *Subscription {
+	return c.subscribe(queue, opts, lis, func(ch *Channel, o *ReceiveOpts) (brk bool, err error) {
+		err = ch.ReceiveCtx(queue, func(ctx context.Context, d *amqp.Delivery) bool {
+			if l, ok := lis.(ContextListener); ok {
+				brk = l.ConsumerContext(ctx, d)
+			} else {
+				brk = lis.Consumer(d)
+			}
+			return brk
+		}, o)
+		return brk, err
+	})
+}
+
+// subscribe 创建 Subscription 并注册执行订阅的 Operation。consume 在 Channel 上消费一次，
+// 返回是否主动放弃接收，以及消费结束的原因。
+func (c *Consumer) subscribe(queue string, opts *ReceiveOpts, lis ReceiveListener, consume func(ch *Channel, o *ReceiveOpts) (brk bool, err error)) *Subscription {
+	if opts == nil {
+		opts = DefaultReceiveOpts()
+	}
+	s := newSubscription(c.c, lis)
+	o := *opts
+	if o.consumerTag == "" {
+		// Subscription 需要通过 consumer tag 取消订阅
+		o.consumerTag = "ezmq-sub-" + subscriptionTag()
+	}
+	s.tag = o.consumerTag
+	o.consuming = s.consuming
+	opt := func(key string, ch *Channel) {
+		s.run(ch, func() (brk bool, err error) {
+			err = c.receive(ch, queue, &o, lis, s.stopping, func() error {
+				brk, err = consume(ch, &o)
+				return err
+			})
+			return brk, err
+		})
+	}
+	s.key = c.c.addOperation(opt)
+	c.c.addSubscription(s)
+	if err := c.c.execOperation(s.key, opt); err != nil {
+		c.c.debug("receive failed:", err, queueField(queue), consumerField(s.tag))
+	}
+	return s
+}
+
+// receive 执行 consume，并在消费者被服务器取消后按照 opts 的配置重新订阅。stopped 返回 true 时不再重新订阅。
+func (c *Consumer) receive(ch *Channel, queue string, opts *ReceiveOpts, lis ReceiveListener, stopped func() bool, consume func() error) error {
+	for {
+		err := consume()
+		if !errors.Is(err, ErrConsumerCanceled) || stopped() {
+			return err
+		}
+		c.c.warn(err, ch.logField(), queueField(queue), consumerField(opts.consumerTag))
+		if l, ok := lis.(CancelListener); ok {
+			l.Canceled(err)
+		}
+		if !opts.resubscribe {
+			return err
+		}
+		if err = ch.awaitQueue(queue, opts.redeclare, stopped); err != nil {
+			return err
 		}
-		lis.Finish(err)
+		if stopped() {
+			// 等待队列期间调用了 Stop
+			return nil
+		}
+		c.c.debug("resubscribe to queue", ch.logField(), queueField(queue), consumerField(opts.consumerTag))
+	}
+}
+
+// ReceiveBatch 持续接收消息，并按批交给 consumer 处理。参数 finish 可以为 nil，每次消费结束时都会以结束的原因调用。
+// 与 Receive 一样，此方法是异步方法，断线重连或消费者被服务器取消后会自动重新订阅，返回的 Subscription 可用于停止、暂停和恢复消费。
+//
+// 详见 Channel.ReceiveBatch
+func (c *Consumer) ReceiveBatch(queue string, opts *ReceiveOpts, batch *BatchOpts, consumer BatchConsumerFunc, finish func(err error)) *Subscription {
+	batch = checkBatch(consumer, batch)
+	return c.subscribe(queue, opts, batchListener(finish), func(ch *Channel, o *ReceiveOpts) (brk bool, err error) {
+		return ch.receiveBatch(queue, consumer, o, batch)
 	})
 }
 
+// batchListener 将 ReceiveBatch 的 finish 适配为 ReceiveListener
+type batchListener func(err error)
+
+func (f batchListener) Consumer(*amqp.Delivery) bool { return false }
+
+func (f batchListener) Finish(err error) {
+	if f != nil {
+		f(err)
+	}
+}
+
+func (f batchListener) Remove(key string, ch *Channel) {
+	ch.RemoveOperation(key)
+}
+
 // TO FIX: 当前不能直接使用 consumer.Get()，会导致关闭错误。
 //// When autoAck is true, the server will automatically acknowledge this message so you don't have to.
 //// But if you are unable to fully process this message before the channel or connection is closed,
@@ -53,7 +161,8 @@ func (c *Consumer) Receive(queue string, opts *ReceiveOpts, lis ReceiveListener)
 //}
 
 type Producer struct {
-	c *Connection
+	c   *Connection
+	buf *sendBuffer // 发送缓冲区，详见 EnableBuffer
 }
 
 // Send 发送消息。
@@ -62,11 +171,30 @@ type Producer struct {
 //
 // 参数 opts 即发送消息需要配置的选项。如果 opts 为 nil，则表示使用默认配置。可以通过配置 SendOpts.retryable
 // 启用消息重发的能力。请注意，由于消息重发使用的是同步的方式处理 ack，因此启用消息重发会极大降低 QPS。
+//
+// 如果启用了发送缓冲区（见 EnableBuffer），连接断开时消息会进入缓冲区，待重连成功后再发送。
 func (p *Producer) Send(exchange string, routingKey string, body []byte, opts *SendOpts) error {
+	return p.SendCtx(context.Background(), exchange, routingKey, body, opts)
+}
+
+// SendCtx 与 Send 相同，并将 ctx 中的链路上下文写入消息头，详见 Channel.SendCtx。
+// 进入发送缓冲区的消息会保留链路上下文，但不会创建发送消息的 Span。
+func (p *Producer) SendCtx(ctx context.Context, exchange string, routingKey string, body []byte, opts *SendOpts) error {
+	if p.buf != nil && (!p.c.IsOpen() || p.buf.len() > 0) {
+		return p.bufferSend(exchange, routingKey, body, p.c.traceOpts(ctx, opts))
+	}
+	err := p.send(ctx, exchange, routingKey, body, opts)
+	if err != nil && p.buf != nil && isConnectedErr(err) {
+		return p.bufferSend(exchange, routingKey, body, p.c.traceOpts(ctx, opts))
+	}
+	return err
+}
+
+func (p *Producer) send(ctx context.Context, exchange string, routingKey string, body []byte, opts *SendOpts) error {
 	ch, err := p.c.Channel()
 	if err != nil {
 		return err
 	}
 	defer ch.Close()
-	return ch.SendOpts(exchange, routingKey, body, opts)
+	return ch.SendCtx(ctx, exchange, routingKey, body, opts)
 }
@@ -0,0 +1,297 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderKeyID      = "x-ezmq-key-id"      // 加密密钥 ID
+	HeaderSignKeyID  = "x-ezmq-sign-key-id" // 签名密钥 ID
+	HeaderSignature  = "x-ezmq-signature"   // HMAC-SHA256 签名
+	HeaderEncryption = "x-ezmq-encryption"  // 加密算法
+	encryptionAESGCM = "aes-gcm"
+)
+
+var (
+	ErrUnknownKey        = errors.New("unknown key id")
+	ErrNotEncrypted      = errors.New("message is not encrypted")
+	ErrMissingSignature  = errors.New("message is not signed")
+	ErrSignatureMismatch = errors.New("message signature mismatch")
+)
+
+// KeyProvider 提供加密或签名使用的密钥。通过密钥 ID 支持密钥轮换：
+// 发送时总是使用 CurrentKey 返回的密钥，并将密钥 ID 写入消息头；
+// 接收时根据消息头中的密钥 ID 调用 Key 获取对应的密钥。
+type KeyProvider interface {
+	CurrentKey() (keyID string, key []byte, err error)
+	Key(keyID string) ([]byte, error)
+}
+
+// KeyRing 基于内存的 KeyProvider 实现
+type KeyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing 创建 KeyRing。current 为当前使用的密钥 ID，必须存在于 keys 中。
+func NewKeyRing(current string, keys map[string][]byte) *KeyRing {
+	if _, ok := keys[current]; !ok {
+		panic("current key must be in keys")
+	}
+	return &KeyRing{current: current, keys: keys}
+}
+
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	return r.current, r.keys[r.current], nil
+}
+
+func (r *KeyRing) Key(keyID string) ([]byte, error) {
+	key, ok := r.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	return key, nil
+}
+
+// Envelope 端到端的消息加密与签名配置，可同时用于 SendOpts 和 ReceiveOpts。
+//
+// Keys 如果不为 nil，消息体会使用 AES-GCM 加密（密钥长度必须为 16、24 或 32 字节）。
+// 接收时，未加密的消息会被视为非法消息。
+//
+// SignKeys 如果不为 nil，消息的 ContentType、ContentEncoding、MessageId、Type、
+// 消息头以及（加密后的）消息体会使用 HMAC-SHA256 签名。接收时，未签名或签名不匹配的消息会被视为非法消息。
+//
+// 非法消息按照 ReceiveOpts 的 errDisposition 处置。
+type Envelope struct {
+	Keys     KeyProvider
+	SignKeys KeyProvider
+}
+
+// seal 加密并签名消息
+func (e *Envelope) seal(msg *amqp.Publishing) error {
+	headers := make(amqp.Table, len(msg.Headers)+4)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	msg.Headers = headers
+
+	if e.Keys != nil {
+		keyID, key, err := e.Keys.CurrentKey()
+		if err != nil {
+			return err
+		}
+		body, err := aesGCMSeal(key, keyID, msg.Body)
+		if err != nil {
+			return err
+		}
+		msg.Body = body
+		headers[HeaderKeyID] = keyID
+		headers[HeaderEncryption] = encryptionAESGCM
+	}
+
+	if e.SignKeys != nil {
+		keyID, key, err := e.SignKeys.CurrentKey()
+		if err != nil {
+			return err
+		}
+		headers[HeaderSignKeyID] = keyID
+		headers[HeaderSignature] = sign(key, msg.ContentType, msg.ContentEncoding, msg.MessageId, msg.Type, headers, msg.Body)
+	}
+	return nil
+}
+
+// open 校验签名并解密消息
+func (e *Envelope) open(delivery *amqp.Delivery) error {
+	if e.SignKeys != nil {
+		signature, ok := delivery.Headers[HeaderSignature].([]byte)
+		keyID, _ := delivery.Headers[HeaderSignKeyID].(string)
+		if !ok {
+			return ErrMissingSignature
+		}
+		key, err := e.SignKeys.Key(keyID)
+		if err != nil {
+			return err
+		}
+		expected := sign(key, delivery.ContentType, delivery.ContentEncoding, delivery.MessageId, delivery.Type, delivery.Headers, delivery.Body)
+		if !hmac.Equal(signature, expected) {
+			return ErrSignatureMismatch
+		}
+	}
+
+	if e.Keys != nil {
+		keyID, ok := delivery.Headers[HeaderKeyID].(string)
+		if !ok || delivery.Headers[HeaderEncryption] != encryptionAESGCM {
+			return ErrNotEncrypted
+		}
+		key, err := e.Keys.Key(keyID)
+		if err != nil {
+			return err
+		}
+		body, err := aesGCMOpen(key, keyID, delivery.Body)
+		if err != nil {
+			return err
+		}
+		delivery.Body = body
+	}
+	return nil
+}
+
+// aesGCMSeal 加密 plaintext，返回 nonce+密文。keyID 作为附加数据参与认证。
+func aesGCMSeal(key []byte, keyID string, plaintext []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(keyID)), nil
+}
+
+func aesGCMOpen(key []byte, keyID string, data []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// brokerHeaders 由服务器在死信、重新投递或转发时添加的消息头，不参与签名，否则消息被转发后无法通过校验
+var brokerHeaders = []string{"x-death", "x-delivery-count", "x-received-from", "x-stream-offset"}
+
+// brokerHeaderPrefixes 同 brokerHeaders，如 x-first-death-reason 和 x-last-death-queue
+var brokerHeaderPrefixes = []string{"x-first-death-", "x-last-death-"}
+
+// signedHeaders 返回参与签名的消息头，去掉签名头本身和服务器添加的消息头
+func signedHeaders(headers amqp.Table) amqp.Table {
+	signed := make(amqp.Table, len(headers))
+	for k, v := range headers {
+		if k == HeaderSignature || isBrokerHeader(k) {
+			continue
+		}
+		signed[k] = v
+	}
+	return signed
+}
+
+func isBrokerHeader(k string) bool {
+	if containsString(brokerHeaders, k) {
+		return true
+	}
+	for _, prefix := range brokerHeaderPrefixes {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign 计算消息的 HMAC-SHA256 签名。签名头本身和服务器添加的消息头（见 brokerHeaders）不参与签名。
+func sign(key []byte, contentType, contentEncoding, messageID, typ string, headers amqp.Table, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	writeField(mac, []byte(contentType))
+	writeField(mac, []byte(contentEncoding))
+	writeField(mac, []byte(messageID))
+	writeField(mac, []byte(typ))
+	writeTable(mac, signedHeaders(headers))
+	writeField(mac, body)
+	return mac.Sum(nil)
+}
+
+// writeField 写入带长度前缀的字段，避免字段拼接产生歧义
+func writeField(h hash.Hash, b []byte) {
+	var l [8]byte
+	binary.BigEndian.PutUint64(l[:], uint64(len(b)))
+	h.Write(l[:])
+	h.Write(b)
+}
+
+// writeTable 按键排序后写入 amqp.Table
+func writeTable(h hash.Hash, table amqp.Table) {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeField(h, []byte(fmt.Sprintf("table:%d", len(keys))))
+	for _, k := range keys {
+		writeField(h, []byte(k))
+		writeValue(h, table[k])
+	}
+}
+
+func writeValue(h hash.Hash, v interface{}) {
+	switch t := v.(type) {
+	case amqp.Table:
+		writeTable(h, t)
+	case []interface{}:
+		writeField(h, []byte(fmt.Sprintf("array:%d", len(t))))
+		for _, e := range t {
+			writeValue(h, e)
+		}
+	case []byte:
+		writeField(h, []byte("bytes"))
+		writeField(h, t)
+	case time.Time:
+		// AMQP 中的时间戳精度为秒
+		writeField(h, []byte(fmt.Sprintf("time:%d", t.Unix())))
+	// 整数在传输过程中可能会改变类型（如 int 会被编码为 int32），因此统一按数值签名。
+	// int 按完整的数值签名，超出 32 位的值在传输中被截断后无法通过校验，而不是被当作可信的值接收
+	case int, int8, int16, int32, int64, uint8:
+		writeField(h, []byte(fmt.Sprintf("int:%d", t)))
+	default:
+		writeField(h, []byte(fmt.Sprintf("%T:%v", v, v)))
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
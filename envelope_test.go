@@ -0,0 +1,131 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// toDelivery 模拟消息经过服务器后的样子（int 类型的消息头会变为 int32）
+func toDelivery(msg amqp.Publishing) *amqp.Delivery {
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		if i, ok := v.(int); ok {
+			v = int32(i)
+		}
+		headers[k] = v
+	}
+	return &amqp.Delivery{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		MessageId:       msg.MessageId,
+		Body:            msg.Body,
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	oldKeys := NewKeyRing("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	keys := NewKeyRing("k2", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 16),
+	})
+	signKeys := NewKeyRing("s1", map[string][]byte{"s1": []byte("secret")})
+	body := bytes.Repeat([]byte("pii "), 64)
+	factory := func(body []byte) amqp.Publishing {
+		msg := MessageJsonPersistent(body)
+		msg.Headers = amqp.Table{"tenant": "ezmq", "attempt": 1}
+		return msg
+	}
+
+	tests := []struct {
+		name    string
+		send    *Envelope
+		receive *Envelope
+		tamper  func(d *amqp.Delivery)
+		wantErr error
+	}{
+		{name: "encrypt and sign", send: &Envelope{Keys: keys, SignKeys: signKeys}, receive: &Envelope{Keys: keys, SignKeys: signKeys}},
+		{name: "rotated key", send: &Envelope{Keys: oldKeys}, receive: &Envelope{Keys: keys}},
+		{name: "sign only", send: &Envelope{SignKeys: signKeys}, receive: &Envelope{SignKeys: signKeys}},
+		{name: "tampered body", send: &Envelope{Keys: keys, SignKeys: signKeys}, receive: &Envelope{Keys: keys, SignKeys: signKeys},
+			tamper: func(d *amqp.Delivery) { d.Body[len(d.Body)-1] ^= 1 }, wantErr: ErrSignatureMismatch},
+		{name: "tampered header", send: &Envelope{SignKeys: signKeys}, receive: &Envelope{SignKeys: signKeys},
+			tamper: func(d *amqp.Delivery) { d.Headers["tenant"] = "other" }, wantErr: ErrSignatureMismatch},
+		{name: "dead-lettered", send: &Envelope{Keys: keys, SignKeys: signKeys}, receive: &Envelope{Keys: keys, SignKeys: signKeys},
+			tamper: func(d *amqp.Delivery) {
+				d.Headers["x-death"] = []interface{}{amqp.Table{"queue": "orders", "reason": "rejected", "count": int64(1)}}
+				d.Headers["x-first-death-reason"] = "rejected"
+				d.Headers["x-delivery-count"] = int64(2)
+			}},
+		{name: "tampered ciphertext", send: &Envelope{Keys: keys}, receive: &Envelope{Keys: keys},
+			tamper: func(d *amqp.Delivery) { d.Body[len(d.Body)-1] ^= 1 }, wantErr: errors.New("cipher: message authentication failed")},
+		{name: "unsigned", send: &Envelope{Keys: keys}, receive: &Envelope{Keys: keys, SignKeys: signKeys}, wantErr: ErrMissingSignature},
+		{name: "unencrypted", send: &Envelope{SignKeys: signKeys}, receive: &Envelope{Keys: keys, SignKeys: signKeys}, wantErr: ErrNotEncrypted},
+		{name: "unknown key", send: &Envelope{Keys: keys}, receive: &Envelope{Keys: oldKeys}, wantErr: ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendOpts := NewSendOptsBuilder().
+				SetMessageFactory(factory).
+				SetCompressor(GzipCompressor, 0).
+				SetEnvelope(tt.send).
+				Build()
+			msg, err := sendOpts.publishing(body)
+			if err != nil {
+				t.Fatalf("publishing() error = %v", err)
+			}
+			if tt.send.Keys != nil && bytes.Contains(msg.Body, []byte("pii")) {
+				t.Fatalf("publishing() body is not encrypted")
+			}
+
+			delivery := toDelivery(msg)
+			if tt.tamper != nil {
+				tt.tamper(delivery)
+			}
+			err = NewReceiveOptsBuilder().SetEnvelope(tt.receive).Build().restore(delivery)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("restore() error = %v", err)
+			case tt.wantErr != nil && (err == nil || !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error()):
+				t.Fatalf("restore() error = %v, want %v", err, tt.wantErr)
+			case tt.wantErr == nil && !bytes.Equal(delivery.Body, body):
+				t.Errorf("restore() body = %q", delivery.Body)
+			}
+		})
+	}
+}
+
+func TestEnvelope_intHeader(t *testing.T) {
+	signKeys := NewKeyRing("s1", map[string][]byte{"s1": []byte("secret")})
+	envelope := &Envelope{SignKeys: signKeys}
+	for value, wantErr := range map[int]error{1 << 30: nil, 1 << 40: ErrSignatureMismatch} {
+		msg := MessageJsonPersistent([]byte("{}"))
+		msg.Headers = amqp.Table{"offset": value}
+		if err := envelope.seal(&msg); err != nil {
+			t.Fatal(err)
+		}
+		// 超出 32 位的 int 在传输中会被截断
+		if err := envelope.open(toDelivery(msg)); !errors.Is(err, wantErr) {
+			t.Errorf("open() with int header %d error = %v, want %v", value, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmqtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+)
+
+func dial(t *testing.T, b *Broker) *ezmq.Connection {
+	t.Helper()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func openChannel(t *testing.T, conn *ezmq.Connection) *ezmq.Channel {
+	t.Helper()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("Channel() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ch.Close() })
+	return ch
+}
+
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+	return amqp.Delivery{}
+}
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"a.*.c", "a.b.c", true},
+		{"a.*.c", "a.c", false},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"#.c", "a.b.c", true},
+		{"#", "", true},
+		{"a.#.c", "a.c", true},
+		{"a.#.c", "a.b.d", false},
+		{"*", "a.b", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatch(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestBroker_route(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, dial(t, b))
+	declare := func(name, exchange, key string, args amqp.Table) {
+		if _, err := ch.QueueDeclare(name, true, false, false, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ch.QueueBind(name, key, exchange, false, args); err != nil {
+			t.Fatal(err)
+		}
+	}
+	declare("direct", "amq.direct", "key", nil)
+	declare("fanout", "amq.fanout", "", nil)
+	declare("topic", "amq.topic", "order.*", nil)
+	declare("headers", "amq.headers", "", amqp.Table{"x-match": "any", "type": "order", "region": "eu"})
+
+	publish := func(exchange, key string, headers amqp.Table) {
+		if err := ch.Publish(exchange, key, false, false, amqp.Publishing{Headers: headers}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	publish("amq.direct", "key", nil)
+	publish("amq.direct", "other", nil)
+	publish("amq.fanout", "any", nil)
+	publish("amq.topic", "order.created", nil)
+	publish("amq.topic", "order.created.eu", nil)
+	publish("amq.headers", "", amqp.Table{"region": "eu"})
+	publish("amq.headers", "", amqp.Table{"region": "us"})
+	publish("", "direct", nil) // 默认交换器
+
+	for queue, want := range map[string]int{"direct": 2, "fanout": 1, "topic": 1, "headers": 1} {
+		if got := b.QueueDepth(queue); got != want {
+			t.Errorf("QueueDepth(%q) = %d, want %d", queue, got, want)
+		}
+	}
+}
+
+func TestBroker_ackAndRequeue(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, dial(t, b))
+	if _, err := ch.QueueDeclare("q", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"1", "2"} {
+		_ = ch.Publish("", "q", false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	_ = ch.Qos(1, 0, false)
+	deliveries, err := ch.Consume("q", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := receive(t, deliveries)
+	if string(first.Body) != "1" || b.Unacked("q") != 1 || b.QueueDepth("q") != 1 {
+		t.Fatalf("unexpected state: body = %s, unacked = %d, depth = %d", first.Body, b.Unacked("q"), b.QueueDepth("q"))
+	}
+	// 预取数量为 1，确认之前不会投递下一条消息
+	_ = first.Nack(false, true)
+	again := receive(t, deliveries)
+	if string(again.Body) != "1" || !again.Redelivered {
+		t.Errorf("requeued delivery = %s (redelivered: %v), want 1 (redelivered: true)", again.Body, again.Redelivered)
+	}
+	_ = again.Ack(false)
+	second := receive(t, deliveries)
+	_ = second.Ack(false)
+	time.Sleep(10 * time.Millisecond)
+	if b.Unacked("q") != 0 || b.QueueDepth("q") != 0 {
+		t.Errorf("unacked = %d, depth = %d, want 0, 0", b.Unacked("q"), b.QueueDepth("q"))
+	}
+}
+
+func TestBroker_confirmAndReturn(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, dial(t, b))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	b.NackPublishes(1)
+	_ = ch.Publish("amq.direct", "nowhere", true, false, amqp.Publishing{})
+	_ = ch.Publish("amq.direct", "nowhere", true, false, amqp.Publishing{Body: []byte("returned")})
+
+	if c := <-confirms; c.Ack || c.DeliveryTag != 1 {
+		t.Errorf("confirm = %+v, want nack of tag 1", c)
+	}
+	if ret := <-returns; string(ret.Body) != "returned" || ret.ReplyCode != amqp.NoRoute {
+		t.Errorf("return = %+v", ret)
+	}
+	if c := <-confirms; !c.Ack || c.DeliveryTag != 2 {
+		t.Errorf("confirm = %+v, want ack of tag 2", c)
+	}
+}
+
+func TestBroker_channelError(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, dial(t, b))
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	_, err := ch.QueueDeclarePassive("missing", false, false, false, false, nil)
+	if e, ok := err.(*amqp.Error); !ok || e.Code != amqp.NotFound {
+		t.Fatalf("QueueDeclarePassive() error = %v, want NOT_FOUND", err)
+	}
+	if e := <-closes; e == nil || e.Code != amqp.NotFound {
+		t.Errorf("close error = %v, want NOT_FOUND", e)
+	}
+	if !ch.IsClosed() {
+		t.Error("channel should be closed")
+	}
+}
+
+func TestBroker_producerConsumer(t *testing.T) {
+	b := NewBroker()
+	conn := dial(t, b)
+	_, err := openChannel(t, conn).QueueDeclare("queue.direct", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 2)
+	sub := conn.Consumer().Receive("queue.direct", ezmq.NewReceiveOptsBuilder().SetAutoAck(false).Build(),
+		&ezmq.AbsReceiveListener{ConsumerMethod: func(d *amqp.Delivery) bool {
+			received <- string(d.Body)
+			_ = d.Ack(false)
+			return false
+		}})
+	producer := conn.Producer()
+	opts := ezmq.NewSendOptsBuilder().SetRetryable(ezmq.NewTimesRetry(false, 10*time.Millisecond, 3)).Build()
+	// 第一次发送会被 nack，之后重发成功
+	b.NackPublishes(1)
+	if err = producer.Send("", "queue.direct", []byte("hello"), opts); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	select {
+	case body := <-received:
+		if body != "hello" {
+			t.Errorf("received %q, want %q", body, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = sub.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if n := b.Consumers("queue.direct"); n != 0 {
+		t.Errorf("Consumers() = %d, want 0", n)
+	}
+}
+
+func TestBroker_reconnect(t *testing.T) {
+	b := NewBroker()
+	conn := dial(t, b)
+	_, err := openChannel(t, conn).QueueDeclare("queue.direct", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	conn.Consumer().Receive("queue.direct", nil, &ezmq.AbsReceiveListener{
+		ConsumerMethod: func(d *amqp.Delivery) bool {
+			received <- string(d.Body)
+			return false
+		}})
+
+	b.CloseConnections()
+	// 等待重连成功并重新订阅
+	deadline := time.Now().Add(time.Second)
+	for b.Consumers("queue.direct") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = conn.Producer().Send("", "queue.direct", []byte("after reconnect"), nil); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	select {
+	case body := <-received:
+		if body != "after reconnect" {
+			t.Errorf("received %q, want %q", body, "after reconnect")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+}
+
+func TestBroker_resubscribe(t *testing.T) {
+	b := NewBroker()
+	conn := dial(t, b)
+	declare := func() error {
+		_, err := openChannel(t, conn).QueueDeclare("queue.direct", true, false, false, false, nil)
+		return err
+	}
+	if err := declare(); err != nil {
+		t.Fatal(err)
+	}
+	canceled := make(chan error, 1)
+	received := make(chan string, 1)
+	opts := ezmq.NewReceiveOptsBuilder().SetRedeclare(declare).Build()
+	conn.Consumer().Receive("queue.direct", opts, &ezmq.AbsReceiveListener{
+		ConsumerMethod: func(d *amqp.Delivery) bool {
+			received <- string(d.Body)
+			return false
+		},
+		CancelMethod: func(err error) { canceled <- err },
+	})
+	for b.Consumers("queue.direct") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.DeleteQueue("queue.direct")
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("cancel notification timeout")
+	}
+	for b.Consumers("queue.direct") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = conn.Producer().Send("", "queue.direct", []byte("resubscribed"), nil)
+	select {
+	case body := <-received:
+		if body != "resubscribed" {
+			t.Errorf("received %q, want %q", body, "resubscribed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+}
+
+func TestBroker_tx(t *testing.T) {
+	b := NewBroker()
+	ch := openChannel(t, dial(t, b))
+	_, _ = ch.QueueDeclare("q", true, false, false, false, nil)
+	_ = ch.WithTx(func(tx *ezmq.TxChannel) error {
+		_ = tx.Send("", "q", []byte("rollback"), nil)
+		return context.Canceled
+	})
+	if n := b.QueueDepth("q"); n != 0 {
+		t.Fatalf("QueueDepth() = %d after rollback, want 0", n)
+	}
+	if err := ch.WithTx(func(tx *ezmq.TxChannel) error {
+		return tx.Send("", "q", []byte("commit"), nil)
+	}); err != nil {
+		t.Fatalf("WithTx() error = %v", err)
+	}
+	if n := b.QueueDepth("q"); n != 1 {
+		t.Errorf("QueueDepth() = %d after commit, want 1", n)
+	}
+}
+
+func TestChannel_AMQP(t *testing.T) {
+	if ch := openChannel(t, dial(t, NewBroker())).AMQP(); ch != nil {
+		t.Errorf("AMQP() = %v, want nil for the fake broker", ch)
+	}
+}
@@ -0,0 +1,781 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmqtest
+
+import (
+	"sort"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// channel 实现 ezmq.AMQPChannel，同时也是投递的消息的 amqp.Acknowledger。
+// 所有状态都由 Broker 的锁保护，通知则通过 mailbox 按顺序异步发送。
+type channel struct {
+	b        *Broker
+	conn     *connection
+	closed   bool
+	closeErr *amqp.Error
+
+	confirming  bool
+	tx          bool
+	txOps       []func() // 事务中尚未提交的发布和确认
+	publishSeq  uint64
+	deliveryTag uint64
+	prefetch    int
+	consumers   map[string]*consumer
+	unacked     map[uint64]*unacked
+
+	closes    []chan *amqp.Error
+	publishes []chan amqp.Confirmation
+	returns   []chan amqp.Return
+	cancels   []chan string
+	mb        *mailbox
+}
+
+// unacked 已投递但尚未确认的消息
+type unacked struct {
+	msg *message
+	q   *queue
+	c   *consumer // 通过 Get 获取的消息为 nil
+}
+
+func newChannel(conn *connection) *channel {
+	return &channel{
+		b:         conn.b,
+		conn:      conn,
+		consumers: make(map[string]*consumer),
+		unacked:   make(map[uint64]*unacked),
+		mb:        newMailbox(),
+	}
+}
+
+// fail 以 err 关闭 Channel，并返回 err。调用时必须持有 Broker 的锁。
+func (ch *channel) fail(code int, format string, args ...interface{}) error {
+	err := newError(code, format, args...)
+	ch.shutdown(err)
+	return err
+}
+
+// shutdown 关闭 Channel：未确认的消息重新入队，消费者的 deliveries 和所有通知通道都会被关闭。
+// err 不为 nil 时，会先将 err 发送给 NotifyClose 注册的通道。调用时必须持有 Broker 的锁。
+func (ch *channel) shutdown(err *amqp.Error) {
+	if ch.closed {
+		return
+	}
+	ch.closed = true
+	ch.closeErr = err
+	delete(ch.conn.channels, ch)
+
+	var consumers []*consumer
+	for _, c := range ch.consumers {
+		consumers = append(consumers, c)
+		ch.detachConsumer(c)
+	}
+	ch.requeueAll()
+
+	closes, publishes, returns, cancels := ch.closes, ch.publishes, ch.returns, ch.cancels
+	ch.closes, ch.publishes, ch.returns, ch.cancels = nil, nil, nil, nil
+	ch.mb.close(func() {
+		if err != nil {
+			for _, c := range closes {
+				c <- err
+			}
+		}
+		for _, c := range consumers {
+			close(c.quit)
+		}
+		for _, c := range closes {
+			close(c)
+		}
+		for _, c := range publishes {
+			close(c)
+		}
+		for _, c := range returns {
+			close(c)
+		}
+		for _, c := range cancels {
+			close(c)
+		}
+	})
+}
+
+// requeueAll 将所有未确认的消息按照投递顺序重新入队
+func (ch *channel) requeueAll() {
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	ch.settle(tags, settleRequeue)
+}
+
+// closedErr 返回 Channel 关闭后调用方法时的错误
+func (ch *channel) closedErr() error {
+	if ch.closeErr != nil {
+		return ch.closeErr
+	}
+	return amqp.ErrClosed
+}
+
+func (ch *channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	// 不区分 global，预取数量只对之后创建的消费者生效
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *channel) Cancel(consumer string, noWait bool) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if c, ok := ch.consumers[consumer]; ok {
+		ch.removeConsumer(c, false)
+	}
+	return nil
+}
+
+func (ch *channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if name == "" {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange")
+	}
+	if ex, ok := ch.b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s' in vhost '/': received '%s' but current is '%s'", name, kind, ex.kind)
+		}
+		if ex.durable != durable {
+			return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg 'durable' for exchange '%s' in vhost '/': received '%t' but current is '%t'", name, durable, ex.durable)
+		}
+		return nil
+	}
+	if strings.HasPrefix(name, "amq.") {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - exchange name '%s' contains reserved prefix 'amq.*'", name)
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+	default:
+		return ch.fail(amqp.CommandInvalid, "COMMAND_INVALID - invalid exchange type '%s'", kind)
+	}
+	ch.b.exchanges[name] = &exchange{name: name, kind: kind, durable: durable, autoDelete: autoDelete, internal: internal}
+	return nil
+}
+
+func (ch *channel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if _, ok := ch.b.exchanges[name]; !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", name)
+	}
+	return nil
+}
+
+func (ch *channel) ExchangeDelete(name string, ifUnused, noWait bool) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	ex, ok := ch.b.exchanges[name]
+	if !ok {
+		return nil
+	}
+	if name == "" || strings.HasPrefix(name, "amq.") {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on exchange '%s'", name)
+	}
+	if ifUnused && len(ex.bindings) > 0 {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - exchange '%s' in vhost '/' in use", name)
+	}
+	delete(ch.b.exchanges, name)
+	for _, other := range ch.b.exchanges {
+		other.bindings = removeBindings(other.bindings, func(bd *binding) bool {
+			return bd.toExchange && bd.destination == name
+		})
+	}
+	return nil
+}
+
+func (ch *channel) ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error {
+	return ch.bind(destination, true, key, source, args)
+}
+
+func (ch *channel) ExchangeUnbind(destination, key, source string, noWait bool, args amqp.Table) error {
+	return ch.unbind(destination, true, key, source, args)
+}
+
+func (ch *channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return amqp.Queue{}, ch.closedErr()
+	}
+	if name == "" {
+		name = ch.b.genName("amq.gen-")
+	} else if strings.HasPrefix(name, "amq.") {
+		return amqp.Queue{}, ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - queue name '%s' contains reserved prefix 'amq.*'", name)
+	}
+	if q, ok := ch.b.queues[name]; ok {
+		if err := ch.checkExclusive(q); err != nil {
+			return amqp.Queue{}, err
+		}
+		for _, arg := range []struct {
+			name              string
+			received, current bool
+		}{{"durable", durable, q.durable}, {"auto_delete", autoDelete, q.autoDelete}, {"exclusive", exclusive, q.exclusive}} {
+			if arg.received != arg.current {
+				return amqp.Queue{}, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg '%s' for queue '%s' in vhost '/': received '%t' but current is '%t'", arg.name, name, arg.received, arg.current)
+			}
+		}
+		if !equalTable(q.args, args) {
+			return amqp.Queue{}, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - inequivalent arg for queue '%s' in vhost '/'", name)
+		}
+		return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+	}
+	q := &queue{name: name, durable: durable, autoDelete: autoDelete, exclusive: exclusive, args: args}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	ch.b.queues[name] = q
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *channel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	q, err := ch.queue(name)
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	return amqp.Queue{Name: name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *channel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return ch.bind(name, false, key, exchange, args)
+}
+
+func (ch *channel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	return ch.unbind(name, false, key, exchange, args)
+}
+
+func (ch *channel) QueuePurge(name string, noWait bool) (int, error) {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	q, err := ch.queue(name)
+	if err != nil {
+		return 0, err
+	}
+	n := len(q.ready)
+	q.ready = nil
+	return n, nil
+}
+
+func (ch *channel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return 0, ch.closedErr()
+	}
+	q, ok := ch.b.queues[name]
+	if !ok {
+		return 0, nil
+	}
+	if err := ch.checkExclusive(q); err != nil {
+		return 0, err
+	}
+	if ifUnused && len(q.consumers) > 0 {
+		return 0, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' in use", name)
+	}
+	if ifEmpty && len(q.ready) > 0 {
+		return 0, ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - queue '%s' in vhost '/' is not empty", name)
+	}
+	n := len(q.ready)
+	ch.b.deleteQueue(q)
+	return n, nil
+}
+
+func (ch *channel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	// 复制消息体，防止调用者修改
+	msg.Body = append([]byte(nil), msg.Body...)
+	if ch.tx {
+		ch.txOps = append(ch.txOps, func() { ch.publish(exchange, key, mandatory, immediate, msg) })
+		return nil
+	}
+	ch.publish(exchange, key, mandatory, immediate, msg)
+	return nil
+}
+
+func (ch *channel) publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) {
+	b := ch.b
+	if immediate {
+		_ = ch.fail(amqp.NotImplemented, "NOT_IMPLEMENTED - immediate=true")
+		return
+	}
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		_ = ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", exchange)
+		return
+	}
+	if ex.internal {
+		_ = ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - cannot publish to internal exchange '%s' in vhost '/'", exchange)
+		return
+	}
+	var seq uint64
+	if ch.confirming {
+		ch.publishSeq++
+		seq = ch.publishSeq
+		if b.nacks > 0 {
+			b.nacks--
+			ch.confirm(seq, false)
+			return
+		}
+	}
+
+	queues := b.route(ex, key, msg.Headers)
+	if len(queues) == 0 && mandatory {
+		ret := amqp.Return{
+			ReplyCode:       amqp.NoRoute,
+			ReplyText:       "NO_ROUTE",
+			Exchange:        exchange,
+			RoutingKey:      key,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			Headers:         msg.Headers,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Body:            msg.Body,
+		}
+		returns := ch.returns
+		ch.mb.post(func() {
+			for _, c := range returns {
+				c <- ret
+			}
+		})
+	}
+	for _, q := range queues {
+		q.ready = append(q.ready, &message{exchange: exchange, routingKey: key, publishing: msg})
+		b.dispatch(q)
+	}
+	if ch.confirming {
+		ch.confirm(seq, true)
+	}
+}
+
+func (ch *channel) confirm(seq uint64, ack bool) {
+	publishes := ch.publishes
+	ch.mb.post(func() {
+		for _, c := range publishes {
+			c <- amqp.Confirmation{DeliveryTag: seq, Ack: ack}
+		}
+	})
+}
+
+func (ch *channel) Consume(queue, consumerTag string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	q, err := ch.queue(queue)
+	if err != nil {
+		return nil, err
+	}
+	if consumerTag == "" {
+		consumerTag = ch.b.genName("ctag-ezmqtest-")
+	}
+	if _, ok := ch.consumers[consumerTag]; ok {
+		return nil, ch.fail(amqp.NotAllowed, "NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumerTag)
+	}
+	for _, c := range q.consumers {
+		if c.exclusive || exclusive {
+			return nil, ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - queue '%s' in vhost '/' in exclusive use", queue)
+		}
+	}
+	c := newConsumer(ch, q, consumerTag, autoAck, exclusive)
+	ch.consumers[consumerTag] = c
+	q.consumers = append(q.consumers, c)
+	q.consumed = true
+	go c.run(ch.b)
+	ch.b.dispatch(q)
+	return c.out, nil
+}
+
+func (ch *channel) Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error) {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	q, err := ch.queue(queue)
+	if err != nil {
+		return msg, false, err
+	}
+	if len(q.ready) == 0 {
+		return msg, false, nil
+	}
+	m := q.ready[0]
+	q.ready[0] = nil
+	q.ready = q.ready[1:]
+	ch.deliveryTag++
+	if !autoAck {
+		ch.unacked[ch.deliveryTag] = &unacked{msg: m, q: q}
+		q.unacked++
+	}
+	d := m.delivery(ch, ch.deliveryTag, "")
+	d.MessageCount = uint32(len(q.ready))
+	return d, true, nil
+}
+
+func (ch *channel) Ack(tag uint64, multiple bool) error {
+	return ch.ack(tag, multiple, settleAck)
+}
+
+func (ch *channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		return ch.ack(tag, multiple, settleRequeue)
+	}
+	return ch.ack(tag, multiple, settleReject)
+}
+
+func (ch *channel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+type settlement int
+
+const (
+	settleAck settlement = iota
+	settleRequeue
+	settleReject
+)
+
+func (ch *channel) ack(tag uint64, multiple bool, s settlement) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if ch.tx {
+		ch.txOps = append(ch.txOps, func() { ch.doAck(tag, multiple, s) })
+		return nil
+	}
+	ch.doAck(tag, multiple, s)
+	return nil
+}
+
+func (ch *channel) doAck(tag uint64, multiple bool, s settlement) {
+	var tags []uint64
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag || tag == 0 {
+				tags = append(tags, t)
+			}
+		}
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = []uint64{tag}
+	}
+	if len(tags) == 0 {
+		_ = ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - unknown delivery tag %d", tag)
+		return
+	}
+	ch.settle(tags, s)
+}
+
+// settle 确认或拒绝消息。重新入队的消息会按照投递顺序放回队列头部。
+func (ch *channel) settle(tags []uint64, s settlement) {
+	sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+	touched := make(map[*queue]bool)
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		u.q.unacked--
+		if u.c != nil {
+			u.c.inflight--
+		}
+		if ch.b.queues[u.q.name] != u.q {
+			// 队列已被删除
+			continue
+		}
+		touched[u.q] = true
+		switch s {
+		case settleRequeue:
+			u.msg.redelivered = true
+			u.q.ready = append([]*message{u.msg}, u.q.ready...)
+		case settleReject:
+			ch.b.deadLetter(u.q, u.msg, "rejected")
+		}
+	}
+	for q := range touched {
+		ch.b.dispatch(q)
+	}
+}
+
+func (ch *channel) Confirm(noWait bool) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if ch.tx {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - cannot switch from tx to confirm mode")
+	}
+	ch.confirming = true
+	return nil
+}
+
+func (ch *channel) Tx() error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if ch.confirming {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - cannot switch from confirm to tx mode")
+	}
+	ch.tx = true
+	return nil
+}
+
+func (ch *channel) TxCommit() error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if !ch.tx {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - channel is not transactional")
+	}
+	ops := ch.txOps
+	ch.txOps = nil
+	for _, op := range ops {
+		if ch.closed {
+			break
+		}
+		op()
+	}
+	if ch.closed {
+		return ch.closedErr()
+	}
+	return nil
+}
+
+func (ch *channel) TxRollback() error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if !ch.tx {
+		return ch.fail(amqp.PreconditionFailed, "PRECONDITION_FAILED - channel is not transactional")
+	}
+	ch.txOps = nil
+	return nil
+}
+
+func (ch *channel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		close(confirm)
+	} else {
+		ch.publishes = append(ch.publishes, confirm)
+	}
+	return confirm
+}
+
+func (ch *channel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		close(c)
+	} else {
+		ch.returns = append(ch.returns, c)
+	}
+	return c
+}
+
+func (ch *channel) NotifyCancel(c chan string) chan string {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		close(c)
+	} else {
+		ch.cancels = append(ch.cancels, c)
+	}
+	return c
+}
+
+func (ch *channel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		close(c)
+	} else {
+		ch.closes = append(ch.closes, c)
+	}
+	return c
+}
+
+func (ch *channel) IsClosed() bool {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	return ch.closed
+}
+
+func (ch *channel) Close() error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.shutdown(nil)
+	return nil
+}
+
+// queue 返回可以访问的队列，否则关闭 Channel 并返回错误
+func (ch *channel) queue(name string) (*queue, error) {
+	if ch.closed {
+		return nil, ch.closedErr()
+	}
+	q, ok := ch.b.queues[name]
+	if !ok {
+		return nil, ch.fail(amqp.NotFound, "NOT_FOUND - no queue '%s' in vhost '/'", name)
+	}
+	if err := ch.checkExclusive(q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (ch *channel) checkExclusive(q *queue) error {
+	if q.exclusive && q.owner != ch.conn {
+		return ch.fail(amqp.ResourceLocked, "RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s' in vhost '/'", q.name)
+	}
+	return nil
+}
+
+func (ch *channel) bind(destination string, toExchange bool, key, source string, args amqp.Table) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if source == "" {
+		return ch.fail(amqp.AccessRefused, "ACCESS_REFUSED - operation not permitted on the default exchange")
+	}
+	ex, ok := ch.b.exchanges[source]
+	if !ok {
+		return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", source)
+	}
+	if toExchange {
+		if _, ok := ch.b.exchanges[destination]; !ok {
+			return ch.fail(amqp.NotFound, "NOT_FOUND - no exchange '%s' in vhost '/'", destination)
+		}
+	} else if _, err := ch.queue(destination); err != nil {
+		return err
+	}
+	for _, bd := range ex.bindings {
+		if bd.sameAs(destination, toExchange, key, args) {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, &binding{destination: destination, toExchange: toExchange, key: key, args: args})
+	return nil
+}
+
+func (ch *channel) unbind(destination string, toExchange bool, key, source string, args amqp.Table) error {
+	ch.b.mut.Lock()
+	defer ch.b.mut.Unlock()
+	if ch.closed {
+		return ch.closedErr()
+	}
+	if ex, ok := ch.b.exchanges[source]; ok {
+		ex.bindings = removeBindings(ex.bindings, func(bd *binding) bool {
+			return bd.sameAs(destination, toExchange, key, args)
+		})
+	}
+	return nil
+}
+
+func (bd *binding) sameAs(destination string, toExchange bool, key string, args amqp.Table) bool {
+	return bd.destination == destination && bd.toExchange == toExchange && bd.key == key &&
+		equalValue(map[string]interface{}(bd.args), map[string]interface{}(args))
+}
+
+// removeConsumer 移除消费者。尚未交给调用者的消息会重新入队。
+// serverCancel 为 true 表示由服务器取消（如队列被删除），会通知 NotifyCancel 注册的通道。
+func (ch *channel) removeConsumer(c *consumer, serverCancel bool) {
+	if c.stopped {
+		return
+	}
+	ch.detachConsumer(c)
+	q := c.q
+	cancels := ch.cancels
+	ch.mb.post(func() {
+		if serverCancel {
+			for _, cc := range cancels {
+				cc <- c.tag
+			}
+		}
+		close(c.quit)
+	})
+	if q.autoDelete && q.consumed && len(q.consumers) == 0 && ch.b.queues[q.name] == q {
+		ch.b.deleteQueue(q)
+	}
+}
+
+// detachConsumer 停止向消费者投递消息，并将其缓冲区中的消息重新入队
+func (ch *channel) detachConsumer(c *consumer) {
+	delete(ch.consumers, c.tag)
+	c.q.consumers = withoutConsumer(c.q.consumers, c)
+	c.stopped = true
+	var tags []uint64
+	for _, d := range c.buf {
+		if _, ok := ch.unacked[d.DeliveryTag]; ok {
+			tags = append(tags, d.DeliveryTag)
+		}
+	}
+	c.buf = nil
+	ch.settle(tags, settleRequeue)
+}
+
+func withoutConsumer(consumers []*consumer, c *consumer) []*consumer {
+	for i, e := range consumers {
+		if e == c {
+			return append(consumers[:i:i], consumers[i+1:]...)
+		}
+	}
+	return consumers
+}
@@ -0,0 +1,90 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmqtest
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+)
+
+// connection 实现 ezmq.AMQPConnection
+type connection struct {
+	b        *Broker
+	channels map[*channel]struct{}
+	closed   bool
+	closes   []chan *amqp.Error
+	blocks   []chan amqp.Blocking
+	mb       *mailbox
+}
+
+func newConnection(b *Broker) *connection {
+	return &connection{b: b, channels: make(map[*channel]struct{}), mb: newMailbox()}
+}
+
+func (c *connection) Channel() (ezmq.AMQPChannel, error) {
+	c.b.mut.Lock()
+	defer c.b.mut.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := newChannel(c)
+	c.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (c *connection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.b.mut.Lock()
+	defer c.b.mut.Unlock()
+	if c.closed {
+		close(receiver)
+	} else {
+		c.closes = append(c.closes, receiver)
+	}
+	return receiver
+}
+
+func (c *connection) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	c.b.mut.Lock()
+	defer c.b.mut.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.blocks = append(c.blocks, receiver)
+	if c.b.blocked != nil {
+		b := *c.b.blocked
+		c.mb.post(func() { receiver <- b })
+	}
+	return receiver
+}
+
+func (c *connection) IsClosed() bool {
+	c.b.mut.Lock()
+	defer c.b.mut.Unlock()
+	return c.closed
+}
+
+func (c *connection) Close() error {
+	c.b.mut.Lock()
+	defer c.b.mut.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.b.closeConnection(c, nil)
+	return nil
+}
@@ -0,0 +1,135 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmqtest
+
+import (
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type consumer struct {
+	ch        *channel
+	q         *queue
+	tag       string
+	autoAck   bool
+	exclusive bool
+	prefetch  int
+	inflight  int             // 未确认的消息数，用于限制预取数量
+	buf       []amqp.Delivery // 等待交给调用者的消息
+	stopped   bool            // 是否已停止投递
+	signal    chan struct{}   // 有新的消息进入 buf
+	quit      chan struct{}   // 关闭后 run 协程会关闭 out
+	out       chan amqp.Delivery
+}
+
+func newConsumer(ch *channel, q *queue, tag string, autoAck, exclusive bool) *consumer {
+	return &consumer{
+		ch:        ch,
+		q:         q,
+		tag:       tag,
+		autoAck:   autoAck,
+		exclusive: exclusive,
+		prefetch:  ch.prefetch,
+		signal:    make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		out:       make(chan amqp.Delivery),
+	}
+}
+
+// available 是否可以继续投递消息
+func (c *consumer) available() bool {
+	return !c.stopped && (c.autoAck || c.prefetch <= 0 || c.inflight < c.prefetch)
+}
+
+// deliver 将消息投递给消费者。调用时必须持有 Broker 的锁。
+func (c *consumer) deliver(b *Broker, q *queue, msg *message) {
+	c.ch.deliveryTag++
+	tag := c.ch.deliveryTag
+	if !c.autoAck {
+		c.ch.unacked[tag] = &unacked{msg: msg, q: q, c: c}
+		c.inflight++
+		q.unacked++
+	}
+	c.buf = append(c.buf, msg.delivery(c.ch, tag, c.tag))
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// run 将 buf 中的消息依次交给调用者，quit 关闭后关闭 out
+func (c *consumer) run(b *Broker) {
+	defer close(c.out)
+	for {
+		b.mut.Lock()
+		var d amqp.Delivery
+		var ok bool
+		if !c.stopped && len(c.buf) > 0 {
+			d, ok = c.buf[0], true
+			c.buf = c.buf[1:]
+		}
+		b.mut.Unlock()
+		if ok {
+			select {
+			case c.out <- d:
+			case <-c.quit:
+				c.requeue(b, d.DeliveryTag)
+				return
+			}
+			continue
+		}
+		select {
+		case <-c.signal:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// requeue 将尚未交给调用者的消息重新入队
+func (c *consumer) requeue(b *Broker, tag uint64) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	if u, ok := c.ch.unacked[tag]; ok && u.c == c {
+		c.ch.settle([]uint64{tag}, settleRequeue)
+	}
+}
+
+func (m *message) delivery(ack amqp.Acknowledger, tag uint64, consumerTag string) amqp.Delivery {
+	p := m.publishing
+	return amqp.Delivery{
+		Acknowledger:    ack,
+		Headers:         p.Headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		UserId:          p.UserId,
+		AppId:           p.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.routingKey,
+		Body:            p.Body,
+	}
+}
@@ -0,0 +1,141 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmqtest
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+)
+
+// Faults 包装 ezmq.Dialer，按顺序注入故障，用于编写确定性的断线重连和消息重发测试。
+//
+//	broker := ezmqtest.NewBroker()
+//	faults := ezmqtest.NewFaults(broker)
+//	conn := ezmq.NewConnection(ezmqtest.URL, retryable).SetDialer(faults)
+//	faults.FailDials(ezmqtest.ErrConnRefused(), ezmqtest.ErrConnRefused())
+//	broker.CloseConnections() // 之后的两次重连会失败，第三次成功
+type Faults struct {
+	dialer      ezmq.Dialer
+	mut         sync.Mutex
+	dialErrs    []error
+	publishErrs []error
+	dials       int
+	publishes   int
+}
+
+// NewFaults 包装 dialer。dialer 可以是 Broker，也可以是 ezmq.DefaultDialer。
+func NewFaults(dialer ezmq.Dialer) *Faults {
+	return &Faults{dialer: dialer}
+}
+
+// ErrConnRefused 返回连接被拒绝的网络错误，ezmq 会对其进行重试
+func ErrConnRefused() error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+}
+
+// FailDials 使接下来的 Dial 依次返回 errs 中的错误
+func (f *Faults) FailDials(errs ...error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.dialErrs = append(f.dialErrs, errs...)
+}
+
+// FailPublishes 使接下来的 Publish 依次返回 errs 中的错误，消息不会被发送。
+// 如果错误是 amqp.ErrClosed，发送消息的 Channel 会被关闭，与真实的断线情况一致。
+func (f *Faults) FailPublishes(errs ...error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.publishErrs = append(f.publishErrs, errs...)
+}
+
+// Dials 返回调用 Dial 的次数（包括失败的次数）
+func (f *Faults) Dials() int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.dials
+}
+
+// Publishes 返回调用 Publish 的次数（包括失败的次数）
+func (f *Faults) Publishes() int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.publishes
+}
+
+func (f *Faults) Dial(url string) (ezmq.AMQPConnection, error) {
+	f.mut.Lock()
+	f.dials++
+	if len(f.dialErrs) > 0 {
+		err := f.dialErrs[0]
+		f.dialErrs = f.dialErrs[1:]
+		f.mut.Unlock()
+		return nil, err
+	}
+	f.mut.Unlock()
+	conn, err := f.dialer.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyConnection{AMQPConnection: conn, f: f}, nil
+}
+
+// nextPublishErr 记录 Publish 的调用，并返回需要注入的错误
+func (f *Faults) nextPublishErr() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.publishes++
+	if len(f.publishErrs) == 0 {
+		return nil
+	}
+	err := f.publishErrs[0]
+	f.publishErrs = f.publishErrs[1:]
+	return err
+}
+
+type faultyConnection struct {
+	ezmq.AMQPConnection
+	f *Faults
+}
+
+func (c *faultyConnection) Channel() (ezmq.AMQPChannel, error) {
+	ch, err := c.AMQPConnection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return &faultyChannel{AMQPChannel: ch, f: c.f}, nil
+}
+
+type faultyChannel struct {
+	ezmq.AMQPChannel
+	f *Faults
+}
+
+func (ch *faultyChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ch.f.nextPublishErr(); err != nil {
+		if err == amqp.ErrClosed {
+			_ = ch.AMQPChannel.Close()
+		}
+		return err
+	}
+	return ch.AMQPChannel.Publish(exchange, key, mandatory, immediate, msg)
+}
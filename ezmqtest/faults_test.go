@@ -0,0 +1,77 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmqtest
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+)
+
+func TestFaults_reconnect(t *testing.T) {
+	b := NewBroker()
+	faults := NewFaults(b)
+	conn, err := ezmq.DialWithDialer(URL, ezmq.NewTimesRetry(true, 10*time.Millisecond, 0), faults)
+	if err != nil {
+		t.Fatalf("DialWithDialer() error = %v", err)
+	}
+	defer conn.Close()
+
+	// 断线后的前两次重连失败
+	faults.FailDials(ErrConnRefused(), ErrConnRefused())
+	b.CloseConnections()
+	deadline := time.Now().Add(time.Second)
+	for b.Connections() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.Connections() != 1 || !conn.IsOpen() {
+		t.Fatalf("connections = %d, open = %v, want reconnected", b.Connections(), conn.IsOpen())
+	}
+	if n := faults.Dials(); n != 4 {
+		t.Errorf("Dials() = %d, want 4", n)
+	}
+}
+
+func TestFaults_resend(t *testing.T) {
+	b := NewBroker()
+	faults := NewFaults(b)
+	conn, err := ezmq.DialWithDialer(URL, ezmq.NewTimesRetry(true, 10*time.Millisecond, 0), faults)
+	if err != nil {
+		t.Fatalf("DialWithDialer() error = %v", err)
+	}
+	defer conn.Close()
+	ch, _ := conn.Channel()
+	defer ch.Close()
+	_, _ = ch.QueueDeclare("q", true, false, false, false, nil)
+
+	// 第一次发送时 Channel 断开，第二次被服务器 nack，第三次成功
+	faults.FailPublishes(amqp.ErrClosed)
+	b.NackPublishes(1)
+	opts := ezmq.NewSendOptsBuilder().SetRetryable(ezmq.NewTimesRetry(false, 10*time.Millisecond, 5)).Build()
+	if err = conn.Producer().Send("", "q", []byte("resend"), opts); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	if n := faults.Publishes(); n != 3 {
+		t.Errorf("Publishes() = %d, want 3", n)
+	}
+	if n := b.QueueDepth("q"); n != 1 {
+		t.Errorf("QueueDepth() = %d, want 1", n)
+	}
+}
@@ -0,0 +1,73 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmqtest
+
+import "sync"
+
+// mailbox 按顺序异步执行通知操作，避免在持有 Broker 锁的情况下向调用者的通道发送数据。
+// 与 amqp091 的读协程一样，向调用者的通道发送数据是阻塞的。
+type mailbox struct {
+	mut    sync.Mutex
+	cond   *sync.Cond
+	fns    []func()
+	closed bool
+}
+
+func newMailbox() *mailbox {
+	m := &mailbox{}
+	m.cond = sync.NewCond(&m.mut)
+	go m.run()
+	return m
+}
+
+// post 添加通知操作。mailbox 关闭后添加的操作会被忽略。
+func (m *mailbox) post(fn func()) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.closed {
+		return
+	}
+	m.fns = append(m.fns, fn)
+	m.cond.Signal()
+}
+
+// close 添加最后一个通知操作，执行完后 mailbox 退出
+func (m *mailbox) close(fn func()) {
+	m.post(fn)
+	m.mut.Lock()
+	m.closed = true
+	m.cond.Signal()
+	m.mut.Unlock()
+}
+
+func (m *mailbox) run() {
+	for {
+		m.mut.Lock()
+		for len(m.fns) == 0 && !m.closed {
+			m.cond.Wait()
+		}
+		if len(m.fns) == 0 {
+			m.mut.Unlock()
+			return
+		}
+		fn := m.fns[0]
+		m.fns[0] = nil
+		m.fns = m.fns[1:]
+		m.mut.Unlock()
+		fn()
+	}
+}
@@ -0,0 +1,105 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmqtest
+
+import (
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// matches 判断消息是否匹配绑定
+func matches(kind string, bd *binding, key string, headers amqp.Table) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatch(bd.key, key)
+	case amqp.ExchangeHeaders:
+		return headersMatch(bd.args, headers)
+	default:
+		return bd.key == key
+	}
+}
+
+// topicMatch 判断路由键是否匹配 topic 交换器的绑定键。
+// 绑定键中的 * 匹配一个单词，# 匹配零个或多个单词，单词之间以 . 分隔。
+func topicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+// headersMatch 判断消息头是否匹配 headers 交换器的绑定参数。
+// x-match 为 any 时匹配任意一个参数即可，否则（all）需要匹配所有参数。以 x- 开头的参数不参与匹配。
+func headersMatch(args, headers amqp.Table) bool {
+	matchAny := args["x-match"] == "any"
+	var n int
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		n++
+		h, ok := headers[k]
+		matched := ok && equalValue(h, v)
+		if matchAny && matched {
+			return true
+		}
+		if !matchAny && !matched {
+			return false
+		}
+	}
+	return !matchAny || n == 0
+}
+
+// equalValue 比较 amqp.Table 中的值。整数在传输过程中可能会改变类型，因此按照字符串形式比较。
+func equalValue(a, b interface{}) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// equalTable 比较 amqp.Table 中以 x- 开头的参数
+func equalTable(a, b amqp.Table) bool {
+	for k, v := range a {
+		if strings.HasPrefix(k, "x-") && !equalValue(v, b[k]) {
+			return false
+		}
+	}
+	for k, v := range b {
+		if strings.HasPrefix(k, "x-") && !equalValue(v, a[k]) {
+			return false
+		}
+	}
+	return true
+}
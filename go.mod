@@ -1,6 +1,6 @@
 module ezmq
 
-go 1.15
+go 1.18
 
 require (
 	github.com/rabbitmq/amqp091-go v1.9.0
@@ -0,0 +1,225 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultReconnectGrace = 30 * time.Second
+
+// HealthStatus 健康状态
+type HealthStatus string
+
+const (
+	HealthUp       HealthStatus = "up"
+	HealthDegraded HealthStatus = "degraded"
+	HealthDown     HealthStatus = "down"
+)
+
+// Health HealthChecker 检查的结果
+type Health struct {
+	Status            HealthStatus `json:"status"`
+	Connected         bool         `json:"connected"`
+	CanRetry          bool         `json:"can_retry"`                    // 见 Connection.CanRetry
+	DisconnectedSince *time.Time   `json:"disconnected_since,omitempty"` // 断线重连开始的时间
+	Blocked           bool         `json:"blocked"`                      // 服务器是否阻塞了发布
+	BlockedReason     string       `json:"blocked_reason,omitempty"`
+	Consumers         int          `json:"consumers"`         // 由 Consumer.Receive 创建且未暂停的订阅数
+	RunningConsumers  int          `json:"running_consumers"` // 其中正在消费的订阅数
+	Reasons           []string     `json:"reasons,omitempty"` // 状态不为 up 的原因
+}
+
+// HealthOpts 健康检查选项。
+//
+// reconnectGrace 表示断线重连的宽限期，断线不超过该时长时状态为 degraded，超过后为 down。默认为 30 秒。
+//
+// blockedDown 为 true 时，服务器阻塞发布（connection.blocked）会使状态变为 down，否则为 degraded。
+//
+// consumersRequired 为 true 时，存在未在消费的订阅会使状态变为 down，否则为 degraded。
+//
+// degradedReady 为 true 时，degraded 状态下就绪检查仍然通过。
+type HealthOpts struct {
+	reconnectGrace    time.Duration
+	blockedDown       bool
+	consumersRequired bool
+	degradedReady     bool
+}
+
+func DefaultHealthOpts() *HealthOpts {
+	return &HealthOpts{reconnectGrace: defaultReconnectGrace}
+}
+
+type HealthOptsBuilder struct {
+	opts *HealthOpts
+}
+
+func NewHealthOptsBuilder() *HealthOptsBuilder {
+	return &HealthOptsBuilder{DefaultHealthOpts()}
+}
+
+func (bld *HealthOptsBuilder) SetReconnectGrace(grace time.Duration) *HealthOptsBuilder {
+	bld.opts.reconnectGrace = grace
+	return bld
+}
+
+func (bld *HealthOptsBuilder) SetBlockedDown(b bool) *HealthOptsBuilder {
+	bld.opts.blockedDown = b
+	return bld
+}
+
+func (bld *HealthOptsBuilder) SetConsumersRequired(b bool) *HealthOptsBuilder {
+	bld.opts.consumersRequired = b
+	return bld
+}
+
+func (bld *HealthOptsBuilder) SetDegradedReady(b bool) *HealthOptsBuilder {
+	bld.opts.degradedReady = b
+	return bld
+}
+
+func (bld *HealthOptsBuilder) Build() *HealthOpts {
+	return bld.opts
+}
+
+// HealthChecker 检查 Connection 的健康状态，可用于 Kubernetes 等的存活检查和就绪检查：
+//
+//	checker := ezmq.NewHealthChecker(conn, nil)
+//	http.Handle("/livez", checker.LivenessHandler())
+//	http.Handle("/readyz", checker.ReadinessHandler())
+type HealthChecker struct {
+	c    *Connection
+	opts *HealthOpts
+}
+
+// NewHealthChecker 创建 HealthChecker。opts 如果为 nil，将使用 DefaultHealthOpts() 作为默认配置。
+func NewHealthChecker(c *Connection, opts *HealthOpts) *HealthChecker {
+	if opts == nil {
+		opts = DefaultHealthOpts()
+	}
+	return &HealthChecker{c: c, opts: opts}
+}
+
+// Check 检查 Connection 当前的健康状态
+func (h *HealthChecker) Check() Health {
+	c := h.c
+	health := Health{Status: HealthUp, Connected: c.IsOpen(), CanRetry: c.CanRetry()}
+	c.hMut.Lock()
+	blocked, downSince := c.blocked, c.downSince
+	for s := range c.subs {
+		running, paused := s.state()
+		if paused {
+			continue
+		}
+		health.Consumers++
+		if running {
+			health.RunningConsumers++
+		}
+	}
+	c.hMut.Unlock()
+
+	degrade := func(down bool, reason string) {
+		if down {
+			health.Status = HealthDown
+		} else if health.Status == HealthUp {
+			health.Status = HealthDegraded
+		}
+		health.Reasons = append(health.Reasons, reason)
+	}
+	if !health.Connected {
+		switch {
+		case downSince.IsZero():
+			degrade(true, "not connected")
+		case !health.CanRetry:
+			degrade(true, "gave up reconnecting")
+		default:
+			health.DisconnectedSince = &downSince
+			elapsed := time.Since(downSince)
+			degrade(elapsed >= h.opts.reconnectGrace, fmt.Sprintf("reconnecting for %v", elapsed.Truncate(time.Millisecond)))
+		}
+	}
+	if blocked.Active {
+		health.Blocked, health.BlockedReason = true, blocked.Reason
+		degrade(h.opts.blockedDown, "publishing blocked by the server: "+blocked.Reason)
+	}
+	if stopped := health.Consumers - health.RunningConsumers; stopped > 0 {
+		degrade(h.opts.consumersRequired, fmt.Sprintf("%d of %d consumers are not running", stopped, health.Consumers))
+	}
+	return health
+}
+
+// LivenessHandler 返回存活检查的 http.Handler。状态不为 down 时返回 200，否则返回 503，响应体为 JSON 格式的 Health。
+func (h *HealthChecker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := h.Check()
+		writeHealth(w, health, health.Status != HealthDown)
+	})
+}
+
+// ReadinessHandler 返回就绪检查的 http.Handler。状态为 up（或者 degraded 且 HealthOpts.degradedReady 为 true）时返回 200，
+// 否则返回 503，响应体为 JSON 格式的 Health。
+func (h *HealthChecker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := h.Check()
+		writeHealth(w, health, health.Status == HealthUp || health.Status == HealthDegraded && h.opts.degradedReady)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, health Health, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(health)
+}
+
+// blockedListener 记录服务器的 connection.blocked 和 connection.unblocked 通知，连接关闭时退出
+func (c *Connection) blockedListener(blocked chan amqp.Blocking) {
+	for b := range blocked {
+		if b.Active {
+			c.warn("publishing blocked by the server:", b.Reason, urlField(c.url))
+		} else {
+			c.info("publishing unblocked by the server", urlField(c.url))
+		}
+		c.hMut.Lock()
+		c.blocked = b
+		c.hMut.Unlock()
+	}
+}
+
+func (c *Connection) addSubscription(s *Subscription) {
+	c.hMut.Lock()
+	defer c.hMut.Unlock()
+	if c.subs == nil {
+		c.subs = make(map[*Subscription]struct{})
+	}
+	c.subs[s] = struct{}{}
+}
+
+func (c *Connection) removeSubscription(s *Subscription) {
+	c.hMut.Lock()
+	defer c.hMut.Unlock()
+	delete(c.subs, s)
+}
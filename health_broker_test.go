@@ -0,0 +1,97 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+	"ezmq/ezmqtest"
+)
+
+func TestHealthChecker(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	faults := ezmqtest.NewFaults(b)
+	conn, err := ezmq.DialWithDialer(ezmqtest.URL, ezmq.NewTimesRetry(true, 10*time.Millisecond, 0), faults)
+	if err != nil {
+		t.Fatalf("DialWithDialer() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err = ch.QueueDeclare("queue.direct", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	sub := conn.Consumer().Receive("queue.direct", nil, &ezmq.AbsReceiveListener{
+		ConsumerMethod: func(*amqp.Delivery) bool { return false },
+	})
+	checker := ezmq.NewHealthChecker(conn, nil)
+	status := func(want ezmq.HealthStatus) ezmq.Health {
+		t.Helper()
+		var health ezmq.Health
+		deadline := time.Now().Add(time.Second)
+		for health = checker.Check(); health.Status != want && time.Now().Before(deadline); health = checker.Check() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if health.Status != want {
+			t.Fatalf("Check() = %+v, want %v", health, want)
+		}
+		return health
+	}
+
+	if health := status(ezmq.HealthUp); health.Consumers != 1 || health.RunningConsumers != 1 {
+		t.Errorf("Check() = %+v, want 1 running consumer", health)
+	}
+
+	b.Block("low on memory")
+	if health := status(ezmq.HealthDegraded); health.BlockedReason != "low on memory" {
+		t.Errorf("Check().BlockedReason = %q", health.BlockedReason)
+	}
+	b.Unblock()
+	status(ezmq.HealthUp)
+
+	// 暂停的订阅不影响健康状态，停止后不再计数
+	sub.Pause()
+	if health := status(ezmq.HealthUp); health.Consumers != 0 {
+		t.Errorf("Check().Consumers = %d, want 0", health.Consumers)
+	}
+	sub.Resume()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = sub.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 断线后重连期间状态为 degraded
+	refused := make([]error, 20)
+	for i := range refused {
+		refused[i] = ezmqtest.ErrConnRefused()
+	}
+	faults.FailDials(refused...)
+	b.CloseConnections()
+	if health := status(ezmq.HealthDegraded); health.DisconnectedSince == nil {
+		t.Errorf("Check() = %+v, want DisconnectedSince", health)
+	}
+	status(ezmq.HealthUp)
+}
@@ -0,0 +1,93 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestHealthChecker_Check(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      *HealthOpts
+		downSince time.Duration // 断线多久，0 表示没有断线重连
+		blocked   bool
+		want      HealthStatus
+	}{
+		{"never connected", nil, 0, false, HealthDown},
+		{"reconnecting within grace", nil, time.Second, false, HealthDegraded},
+		{"reconnecting beyond grace", nil, time.Minute, false, HealthDown},
+		{"custom grace", NewHealthOptsBuilder().SetReconnectGrace(time.Hour).Build(), time.Minute, false, HealthDegraded},
+		{"blocked while reconnecting", NewHealthOptsBuilder().SetBlockedDown(true).Build(), time.Second, true, HealthDown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConnection(defaultURL, DefaultTimesRetry())
+			if tt.downSince > 0 {
+				c.downSince = time.Now().Add(-tt.downSince)
+			}
+			if tt.blocked {
+				c.blocked = amqp.Blocking{Active: true, Reason: "low on memory"}
+			}
+			health := NewHealthChecker(c, tt.opts).Check()
+			if health.Status != tt.want {
+				t.Errorf("Check().Status = %v, want %v, reasons: %v", health.Status, tt.want, health.Reasons)
+			}
+			if health.Blocked != tt.blocked {
+				t.Errorf("Check().Blocked = %v, want %v", health.Blocked, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestHealthChecker_handlers(t *testing.T) {
+	c := NewConnection(defaultURL, DefaultTimesRetry())
+	c.downSince = time.Now()
+	serve := func(h http.Handler) (int, Health) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		var health Health
+		if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+			t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+		}
+		return rec.Code, health
+	}
+
+	// 断线重连期间状态为 degraded：存活检查通过，默认就绪检查不通过
+	checker := NewHealthChecker(c, nil)
+	if code, health := serve(checker.LivenessHandler()); code != http.StatusOK || health.Status != HealthDegraded {
+		t.Errorf("liveness = %d %v, want 200 degraded", code, health.Status)
+	}
+	if code, _ := serve(checker.ReadinessHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("readiness = %d, want 503", code)
+	}
+	checker = NewHealthChecker(c, NewHealthOptsBuilder().SetDegradedReady(true).Build())
+	if code, _ := serve(checker.ReadinessHandler()); code != http.StatusOK {
+		t.Errorf("readiness = %d, want 200", code)
+	}
+
+	c.downSince = time.Time{}
+	if code, health := serve(checker.LivenessHandler()); code != http.StatusServiceUnavailable || health.Status != HealthDown {
+		t.Errorf("liveness = %d %v, want 503 down", code, health.Status)
+	}
+}
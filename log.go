@@ -16,50 +16,145 @@
 
 package ezmq
 
+import (
+	"io"
+	"net/url"
+	"sync/atomic"
+)
+
 var (
-	_default Logger = &printLogger{}
+	_default Logger = NewPrintLogger(nil)
+	_level          = int32(LevelInfo)
 )
 
 func SetLogger(lg Logger) {
 	_default = lg
 }
 
-// erro will print only when printLogger's Level is erro, warn, info or debug.
+// SetLogLevel 设置最低的日志级别，低于该级别的日志不会传给 Logger。默认为 LevelInfo。
+func SetLogLevel(level Level) {
+	atomic.StoreInt32(&_level, int32(level))
+}
+
+// SetLogOutput 使用默认的文本格式将日志写入 w，等同于 SetLogger(NewPrintLogger(w))
+func SetLogOutput(w io.Writer) {
+	SetLogger(NewPrintLogger(w))
+}
+
+func enabled(level Level) bool {
+	return Level(atomic.LoadInt32(&_level)) <= level
+}
+
+// erro will print only when the log level is LevelError or lower.
 func erro(v ...interface{}) {
-	_default.Error(v...)
+	if enabled(LevelError) {
+		_default.Error(v...)
+	}
 }
 
-// errorf will print only when printLogger's Level is erro, warn, info or debug.
+// errorf will print only when the log level is LevelError or lower.
 func errorf(format string, args ...interface{}) {
-	_default.Errorf(format, args...)
+	if enabled(LevelError) {
+		_default.Errorf(format, args...)
+	}
 }
 
-// warn will print when printLogger's Level is warn, info or debug.
+// warn will print when the log level is LevelWarn or lower.
 func warn(v ...interface{}) {
-	_default.Warn(v...)
+	if enabled(LevelWarn) {
+		_default.Warn(v...)
+	}
 }
 
-// warnf will print when printLogger's Level is warn, info or debug.
+// warnf will print when the log level is LevelWarn or lower.
 func warnf(format string, args ...interface{}) {
-	_default.Warnf(format, args...)
+	if enabled(LevelWarn) {
+		_default.Warnf(format, args...)
+	}
 }
 
-// info will print when printLogger's Level is info or debug.
+// info will print when the log level is LevelInfo or lower.
 func info(v ...interface{}) {
-	_default.Info(v...)
+	if enabled(LevelInfo) {
+		_default.Info(v...)
+	}
 }
 
-// infof will print when printLogger's Level is info or debug.
+// infof will print when the log level is LevelInfo or lower.
 func infof(format string, args ...interface{}) {
-	_default.Infof(format, args...)
+	if enabled(LevelInfo) {
+		_default.Infof(format, args...)
+	}
 }
 
-// debug will print when printLogger's Level is debug.
+// debug will print when the log level is LevelDebug.
 func debug(v ...interface{}) {
-	_default.Debug(v...)
+	if enabled(LevelDebug) {
+		_default.Debug(v...)
+	}
 }
 
-// debugf will print when printLogger's Level is debug.
+// debugf will print when the log level is LevelDebug.
 func debugf(format string, args ...interface{}) {
-	_default.Debugf(format, args...)
+	if enabled(LevelDebug) {
+		_default.Debugf(format, args...)
+	}
+}
+
+// ---- Connection 的内部日志函数，使用 Connection.SetLogger 设置的 Logger ----
+
+// logger 返回 Connection 使用的 Logger。c 为 nil 或者没有设置 Logger 时，返回全局的 Logger。
+func (c *Connection) logger() Logger {
+	if c != nil && c.lg != nil {
+		return c.lg
+	}
+	return _default
+}
+
+func (c *Connection) debug(v ...interface{}) {
+	if enabled(LevelDebug) {
+		c.logger().Debug(v...)
+	}
+}
+
+func (c *Connection) info(v ...interface{}) {
+	if enabled(LevelInfo) {
+		c.logger().Info(v...)
+	}
+}
+
+func (c *Connection) warn(v ...interface{}) {
+	if enabled(LevelWarn) {
+		c.logger().Warn(v...)
+	}
+}
+
+// ---- 内部日志使用的字段 ----
+
+// urlField 服务器地址，不包含密码
+func urlField(rawURL string) Field {
+	if u, err := url.Parse(rawURL); err == nil {
+		rawURL = u.Redacted()
+	}
+	return Field{Key: "url", Value: rawURL}
+}
+
+func channelField(id uint64) Field {
+	return Field{Key: "channel", Value: id}
+}
+
+func queueField(queue string) Field {
+	return Field{Key: "queue", Value: queue}
+}
+
+func consumerField(tag string) Field {
+	return Field{Key: "consumer", Value: tag}
+}
+
+func attemptField(attempt int) Field {
+	return Field{Key: "attempt", Value: attempt}
+}
+
+func deliveryTagField(tag uint64) Field {
+	return Field{Key: "delivery_tag", Value: tag}
 }
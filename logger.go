@@ -2,11 +2,19 @@ package ezmq
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Logger 日志接口。
+//
+// ezmq 的内部日志会在参数末尾附加若干 Field（如 url、channel、queue、consumer、attempt），
+// 自定义的 Logger 可以通过类型断言取出这些字段；直接使用 fmt 打印时，Field 会被输出为 key=value。
 type Logger interface {
 	Debug(v ...interface{})
 	Info(v ...interface{})
@@ -18,43 +26,120 @@ type Logger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// Level 日志级别
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// LevelOff 关闭所有日志
+	LevelOff
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return debugLevel
+	case LevelInfo:
+		return infoLevel
+	case LevelWarn:
+		return warnLevel
+	case LevelError:
+		return errorLevel
+	case LevelOff:
+		return "OFF"
+	}
+	return fmt.Sprintf("Level(%d)", int32(l))
+}
+
+// Field 结构化的日志字段
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func (f Field) String() string {
+	if s, ok := f.Value.(string); ok && (s == "" || strings.ContainsAny(s, " \t\n\"=")) {
+		return fmt.Sprintf("%s=%q", f.Key, s)
+	}
+	return fmt.Sprintf("%s=%v", f.Key, f.Value)
+}
+
 type printLogger struct {
+	out io.Writer
+	mut sync.Mutex
+}
+
+// NewPrintLogger 返回以文本格式将日志写入 w 的 Logger，每条日志一行，Field 类型的参数以 key=value 的格式输出在行末。
+// w 为 nil 时写入 os.Stdout。
+func NewPrintLogger(w io.Writer) Logger {
+	if w == nil {
+		w = os.Stdout
+	}
+	return &printLogger{out: w}
 }
 
 func (l *printLogger) Debug(v ...interface{}) {
-	nv := append([]interface{}{debugLevel, time.Now().Format(time.DateTime), fileLine()}, v...)
-	fmt.Println(nv...)
+	l.print(debugLevel, v)
 }
 
 func (l *printLogger) Info(v ...interface{}) {
-	nv := append([]interface{}{infoLevel, time.Now().Format(time.DateTime), fileLine()}, v...)
-	fmt.Println(nv...)
+	l.print(infoLevel, v)
 }
 
 func (l *printLogger) Warn(v ...interface{}) {
-	nv := append([]interface{}{warnLevel, time.Now().Format(time.DateTime), fileLine()}, v...)
-	fmt.Println(nv...)
+	l.print(warnLevel, v)
 }
 
 func (l *printLogger) Error(v ...interface{}) {
-	nv := append([]interface{}{errorLevel, time.Now().Format(time.DateTime), fileLine()}, v...)
-	fmt.Println(nv...)
+	l.print(errorLevel, v)
 }
 
 func (l *printLogger) Debugf(f string, args ...interface{}) {
-	fmt.Printf(fmt.Sprintf("%s %s %s %s", debugLevel, time.Now().Format(time.DateTime), fileLine(), f), args...)
+	l.print(debugLevel, []interface{}{fmt.Sprintf(f, args...)})
 }
 
 func (l *printLogger) Infof(f string, args ...interface{}) {
-	fmt.Printf(fmt.Sprintf("%s %s %s %s", infoLevel, time.Now().Format(time.DateTime), fileLine(), f), args...)
+	l.print(infoLevel, []interface{}{fmt.Sprintf(f, args...)})
 }
 
 func (l *printLogger) Warnf(f string, args ...interface{}) {
-	fmt.Printf(fmt.Sprintf("%s %s %s %s", warnLevel, time.Now().Format(time.DateTime), fileLine(), f), args...)
+	l.print(warnLevel, []interface{}{fmt.Sprintf(f, args...)})
 }
 
 func (l *printLogger) Errorf(f string, args ...interface{}) {
-	fmt.Printf(fmt.Sprintf("%s %s %s %s", errorLevel, time.Now().Format(time.DateTime), fileLine(), f), args...)
+	l.print(errorLevel, []interface{}{fmt.Sprintf(f, args...)})
+}
+
+// print 输出一行日志。消息与字段分开输出，字段总是位于行末。
+func (l *printLogger) print(level string, v []interface{}) {
+	msg := make([]interface{}, 0, len(v))
+	var fields []Field
+	for _, e := range v {
+		if f, ok := e.(Field); ok {
+			fields = append(fields, f)
+		} else {
+			msg = append(msg, e)
+		}
+	}
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(time.Now().Format("2006-01-02 15:04:05"))
+	b.WriteByte(' ')
+	b.WriteString(fileLine())
+	b.WriteString(strings.TrimRight(fmt.Sprintln(msg...), "\n"))
+	for _, f := range fields {
+		b.WriteByte(' ')
+		b.WriteString(f.String())
+	}
+	b.WriteByte('\n')
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	_, _ = io.WriteString(l.out, b.String())
 }
 
 const (
@@ -69,10 +154,14 @@ var filePrefixFunc = func() string {
 	return filepath.Dir(abs)
 }()
 
+// fileLine 返回内部日志函数（如 debug）的调用者所在的位置
 func fileLine() string {
-	pc, absPath, line, _ := runtime.Caller(3)
+	pc, absPath, line, _ := runtime.Caller(4)
 	caller := runtime.FuncForPC(pc)
-	relPath := absPath[len(filePrefixFunc)+1:]
-	simpleCaller := caller.Name()[len("ezmq."):]
+	relPath := strings.TrimPrefix(absPath, filePrefixFunc+string(filepath.Separator))
+	var simpleCaller string
+	if caller != nil {
+		simpleCaller = strings.TrimPrefix(caller.Name(), "ezmq.")
+	}
 	return fmt.Sprintf("%s:%v %s(): ", relPath, line, simpleCaller)
 }
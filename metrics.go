@@ -0,0 +1,315 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsRecorder 记录 ezmq 的运行指标。实现必须是并发安全的，并且不能阻塞。
+//
+// 可以通过 SetMetricsRecorder 设置全局的 MetricsRecorder，或通过 Connection.SetMetricsRecorder 为单个连接设置。
+type MetricsRecorder interface {
+	// Published 发送了一条消息。err 为 nil 表示消息已写入 Channel，不代表已被服务器确认。
+	Published(exchange string, err error)
+	// Confirmed 收到了服务器对消息的确认（Confirm Mode），ack 为 false 表示 nack
+	Confirmed(exchange string, ack bool)
+	// Returned 消息因为无法路由而被服务器退回（Basic.Return）
+	Returned(exchange string, routingKey string)
+	// Retried 重发了一条消息
+	Retried(exchange string)
+	// Reconnect 尝试了一次重连，err 为 nil 表示重连成功
+	Reconnect(err error)
+	// Consumed 消费者处理了一条消息，elapsed 为 ConsumerFunc 的耗时。
+	// 批量消费时每条消息各记录一次，elapsed 为 BatchConsumerFunc 处理整批消息的耗时。
+	Consumed(queue string, elapsed time.Duration)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Published(string, error)        {}
+func (noopMetrics) Confirmed(string, bool)         {}
+func (noopMetrics) Returned(string, string)        {}
+func (noopMetrics) Retried(string)                 {}
+func (noopMetrics) Reconnect(error)                {}
+func (noopMetrics) Consumed(string, time.Duration) {}
+
+var _metrics MetricsRecorder = noopMetrics{}
+
+// SetMetricsRecorder 设置全局的 MetricsRecorder。m 为 nil 时不记录指标。
+func SetMetricsRecorder(m MetricsRecorder) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	_metrics = m
+}
+
+// SetMetricsRecorder 设置该 Connection 及其创建的 Channel 使用的 MetricsRecorder，必须在 Dial 之前调用。
+// m 为 nil 时使用全局的 MetricsRecorder（见 SetMetricsRecorder）。
+func (c *Connection) SetMetricsRecorder(m MetricsRecorder) *Connection {
+	c.metricsRecorder = m
+	return c
+}
+
+// metrics 返回 Connection 使用的 MetricsRecorder。c 为 nil 或者没有设置时，返回全局的 MetricsRecorder。
+func (c *Connection) metrics() MetricsRecorder {
+	if c != nil && c.metricsRecorder != nil {
+		return c.metricsRecorder
+	}
+	return _metrics
+}
+
+// DefaultBuckets 处理耗时直方图默认的桶（单位：秒），与 Prometheus 客户端的默认值相同
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusRecorder 以 Prometheus 文本格式（0.0.4）暴露指标的 MetricsRecorder，同时也是 http.Handler：
+//
+//	recorder := ezmq.NewPrometheusRecorder()
+//	ezmq.SetMetricsRecorder(recorder)
+//	http.Handle("/metrics", recorder)
+//
+// 暴露的指标：
+//
+//	ezmq_published_total{exchange,result}             发送的消息数，result 为 ok 或 error
+//	ezmq_confirms_total{exchange,result}              服务器确认数，result 为 ack 或 nack
+//	ezmq_returns_total{exchange}                      被服务器退回的消息数
+//	ezmq_retries_total{exchange}                      重发的消息数
+//	ezmq_reconnects_total{result}                     重连次数，result 为 ok 或 error
+//	ezmq_consume_duration_seconds{queue}              消费者处理消息的耗时（直方图）
+type PrometheusRecorder struct {
+	buckets    []float64
+	mut        sync.Mutex
+	published  map[[2]string]uint64
+	confirms   map[[2]string]uint64
+	returns    map[string]uint64
+	retries    map[string]uint64
+	reconnects map[string]uint64
+	consumed   map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // 每个桶（不累计）的计数，最后一个元素为 +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusRecorder 创建 PrometheusRecorder。buckets 为处理耗时直方图的桶（单位：秒），为空时使用 DefaultBuckets。
+func NewPrometheusRecorder(buckets ...float64) *PrometheusRecorder {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &PrometheusRecorder{
+		buckets:    buckets,
+		published:  make(map[[2]string]uint64),
+		confirms:   make(map[[2]string]uint64),
+		returns:    make(map[string]uint64),
+		retries:    make(map[string]uint64),
+		reconnects: make(map[string]uint64),
+		consumed:   make(map[string]*histogram),
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (r *PrometheusRecorder) Published(exchange string, err error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.published[[2]string{exchange, result(err)}]++
+}
+
+func (r *PrometheusRecorder) Confirmed(exchange string, ack bool) {
+	res := "nack"
+	if ack {
+		res = "ack"
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.confirms[[2]string{exchange, res}]++
+}
+
+func (r *PrometheusRecorder) Returned(exchange string, routingKey string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.returns[exchange]++
+}
+
+func (r *PrometheusRecorder) Retried(exchange string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.retries[exchange]++
+}
+
+func (r *PrometheusRecorder) Reconnect(err error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.reconnects[result(err)]++
+}
+
+func (r *PrometheusRecorder) Consumed(queue string, elapsed time.Duration) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	h, ok := r.consumed[queue]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(r.buckets)+1)}
+		r.consumed[queue] = h
+	}
+	seconds := elapsed.Seconds()
+	h.counts[sort.SearchFloat64s(r.buckets, seconds)]++
+	h.sum += seconds
+	h.count++
+}
+
+// ServeHTTP 以 Prometheus 文本格式输出所有指标
+func (r *PrometheusRecorder) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+// WriteTo 以 Prometheus 文本格式将所有指标写入 w
+func (r *PrometheusRecorder) WriteTo(w io.Writer) (int64, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	pw := &promWriter{w: bufio.NewWriter(w)}
+
+	pw.header("ezmq_published_total", "counter", "Number of published messages.")
+	for _, k := range sortedPairs(r.published) {
+		pw.sample("ezmq_published_total", r.published[k], "exchange", k[0], "result", k[1])
+	}
+	pw.header("ezmq_confirms_total", "counter", "Number of publisher confirms received.")
+	for _, k := range sortedPairs(r.confirms) {
+		pw.sample("ezmq_confirms_total", r.confirms[k], "exchange", k[0], "result", k[1])
+	}
+	pw.header("ezmq_returns_total", "counter", "Number of messages returned by the server.")
+	for _, k := range sortedKeys(r.returns) {
+		pw.sample("ezmq_returns_total", r.returns[k], "exchange", k)
+	}
+	pw.header("ezmq_retries_total", "counter", "Number of message resends.")
+	for _, k := range sortedKeys(r.retries) {
+		pw.sample("ezmq_retries_total", r.retries[k], "exchange", k)
+	}
+	pw.header("ezmq_reconnects_total", "counter", "Number of reconnection attempts.")
+	for _, k := range sortedKeys(r.reconnects) {
+		pw.sample("ezmq_reconnects_total", r.reconnects[k], "result", k)
+	}
+	pw.header("ezmq_consume_duration_seconds", "histogram", "Time spent handling a delivery.")
+	for _, queue := range sortedKeys(r.consumed) {
+		h := r.consumed[queue]
+		var cumulative uint64
+		for i, le := range r.buckets {
+			cumulative += h.counts[i]
+			pw.sample("ezmq_consume_duration_seconds_bucket", cumulative, "queue", queue, "le", formatFloat(le))
+		}
+		pw.sample("ezmq_consume_duration_seconds_bucket", h.count, "queue", queue, "le", "+Inf")
+		pw.line("ezmq_consume_duration_seconds_sum", formatFloat(h.sum), "queue", queue)
+		pw.sample("ezmq_consume_duration_seconds_count", h.count, "queue", queue)
+	}
+	if pw.err == nil {
+		pw.err = pw.w.Flush()
+	}
+	return pw.n, pw.err
+}
+
+// promWriter 输出 Prometheus 文本格式，记录第一个错误
+type promWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (pw *promWriter) write(s string) {
+	if pw.err != nil {
+		return
+	}
+	n, err := pw.w.WriteString(s)
+	pw.n += int64(n)
+	pw.err = err
+}
+
+func (pw *promWriter) header(name, typ, help string) {
+	pw.write(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ))
+}
+
+func (pw *promWriter) sample(name string, value uint64, labels ...string) {
+	pw.line(name, strconv.FormatUint(value, 10), labels...)
+}
+
+// line 输出一个样本。labels 为成对的标签名和标签值。
+func (pw *promWriter) line(name string, value string, labels ...string) {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(value)
+	b.WriteByte('\n')
+	pw.write(b.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedPairs(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
@@ -0,0 +1,144 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+	"ezmq/ezmqtest"
+)
+
+func TestMetrics(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	r := ezmq.NewPrometheusRecorder()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0)).SetMetricsRecorder(r)
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err = ch.QueueDeclare("queue.direct", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{}, 1)
+	conn.Consumer().Receive("queue.direct", nil, &ezmq.AbsReceiveListener{
+		ConsumerMethod: func(d *amqp.Delivery) bool {
+			received <- struct{}{}
+			return false
+		}})
+
+	// 第一次发送被 nack，重发一次后成功
+	b.NackPublishes(1)
+	opts := ezmq.NewSendOptsBuilder().SetRetryable(ezmq.NewTimesRetry(false, 10*time.Millisecond, 3)).Build()
+	if err := conn.Producer().Send("", "queue.direct", []byte("hello"), opts); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	<-received
+	// 无法路由的消息被退回
+	opts = ezmq.NewSendOptsBuilder().SetMandatory(true).SetRetryable(ezmq.NewTimesRetry(false, 10*time.Millisecond, 3)).Build()
+	if err := conn.Producer().Send("", "queue.missing", []byte("hello"), opts); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	b.CloseConnections()
+	waitFor(t, time.Second, func() bool { return b.Connections() == 1 })
+
+	want := []string{
+		`ezmq_published_total{exchange="",result="ok"} 3`,
+		`ezmq_confirms_total{exchange="",result="ack"} 2`,
+		`ezmq_confirms_total{exchange="",result="nack"} 1`,
+		`ezmq_returns_total{exchange=""} 1`,
+		`ezmq_retries_total{exchange=""} 1`,
+		`ezmq_reconnects_total{result="ok"} 1`,
+		`ezmq_consume_duration_seconds_count{queue="queue.direct"} 1`,
+	}
+	waitFor(t, time.Second, func() bool {
+		var buf bytes.Buffer
+		_, _ = r.WriteTo(&buf)
+		for _, w := range want {
+			if !strings.Contains(buf.String(), w+"\n") {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestMetrics_batch(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	r := ezmq.NewPrometheusRecorder()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0)).SetMetricsRecorder(r)
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err = ch.QueueDeclare("queue.batch", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan int, 10)
+	batch := ezmq.NewBatchOptsBuilder().SetSize(2).SetMaxWait(20 * time.Millisecond).Build()
+	conn.Consumer().ReceiveBatch("queue.batch", nil, batch, func(ds []*amqp.Delivery) error {
+		received <- len(ds)
+		return nil
+	}, nil)
+
+	msgs := []ezmq.Message{{RoutingKey: "queue.batch", Body: []byte("1")}, {RoutingKey: "queue.batch", Body: []byte("2")}}
+	if _, err := conn.Producer().SendBatch(context.Background(), msgs, nil); err != nil {
+		t.Fatalf("SendBatch() error = %v", err)
+	}
+	store, err := ezmq.NewFileOutboxStore(filepath.Join(t.TempDir(), "outbox.wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox := ezmq.NewOutbox(conn, store, ezmq.NewOutboxOptsBuilder().SetInterval(10*time.Millisecond).Build())
+	defer outbox.Close()
+	if err := outbox.Send("", "queue.batch", []byte("3"), nil); err != nil {
+		t.Fatalf("Outbox.Send() error = %v", err)
+	}
+
+	want := []string{
+		`ezmq_published_total{exchange="",result="ok"} 3`,
+		`ezmq_confirms_total{exchange="",result="ack"} 3`,
+		`ezmq_consume_duration_seconds_count{queue="queue.batch"} 3`,
+	}
+	waitFor(t, time.Second, func() bool {
+		var buf bytes.Buffer
+		_, _ = r.WriteTo(&buf)
+		for _, w := range want {
+			if !strings.Contains(buf.String(), w+"\n") {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,78 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusRecorder(t *testing.T) {
+	r := NewPrometheusRecorder(0.1, 1)
+	r.Published("amq.direct", nil)
+	r.Published("amq.direct", nil)
+	r.Published("", errors.New("closed"))
+	r.Confirmed("amq.direct", true)
+	r.Confirmed("amq.direct", false)
+	r.Returned("amq.direct", "key")
+	r.Retried("amq.direct")
+	r.Reconnect(nil)
+	r.Consumed(`queue."q"`, 50*time.Millisecond)
+	r.Consumed(`queue."q"`, 500*time.Millisecond)
+	r.Consumed(`queue."q"`, 5*time.Second)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE ezmq_published_total counter\n",
+		`ezmq_published_total{exchange="",result="error"} 1` + "\n",
+		`ezmq_published_total{exchange="amq.direct",result="ok"} 2` + "\n",
+		`ezmq_confirms_total{exchange="amq.direct",result="ack"} 1` + "\n",
+		`ezmq_confirms_total{exchange="amq.direct",result="nack"} 1` + "\n",
+		`ezmq_returns_total{exchange="amq.direct"} 1` + "\n",
+		`ezmq_retries_total{exchange="amq.direct"} 1` + "\n",
+		`ezmq_reconnects_total{result="ok"} 1` + "\n",
+		"# TYPE ezmq_consume_duration_seconds histogram\n",
+		`ezmq_consume_duration_seconds_bucket{queue="queue.\"q\"",le="0.1"} 1` + "\n",
+		`ezmq_consume_duration_seconds_bucket{queue="queue.\"q\"",le="1"} 2` + "\n",
+		`ezmq_consume_duration_seconds_bucket{queue="queue.\"q\"",le="+Inf"} 3` + "\n",
+		`ezmq_consume_duration_seconds_sum{queue="queue.\"q\""} 5.55` + "\n",
+		`ezmq_consume_duration_seconds_count{queue="queue.\"q\""} 3` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q\n%s", want, body)
+		}
+	}
+}
+
+func TestConnection_SetMetricsRecorder(t *testing.T) {
+	r := NewPrometheusRecorder()
+	conn := NewConnection(defaultURL, nil).SetMetricsRecorder(r)
+	if conn.metrics() != r {
+		t.Error("connection should use its own recorder")
+	}
+	if _, ok := NewConnection(defaultURL, nil).metrics().(noopMetrics); !ok {
+		t.Error("connection should use the global recorder by default")
+	}
+}
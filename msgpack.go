@@ -0,0 +1,766 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+// 本文件实现了一个精简的 MessagePack 编解码器，以保证 ezmq 不引入额外依赖。
+//
+// 支持 nil、bool、整数、浮点数、字符串、[]byte、数组/切片、map 以及结构体（编码为 map）。
+// 结构体字段名可通过 `msgpack:"name,omitempty"` 标签指定，"-" 表示忽略该字段。
+// 实现了 encoding.BinaryMarshaler 的值会被编码为 bin 类型。不支持 ext 类型。
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+var (
+	errMsgpackShort = errors.New("msgpack: unexpected end of data")
+	errMsgpackDepth = fmt.Errorf("msgpack: nesting exceeds %d levels", msgpackMaxDepth)
+)
+
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func msgpackUnmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("msgpack: Unmarshal(non-pointer %T)", v)
+	}
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("msgpack: trailing data")
+	}
+	return nil
+}
+
+// ---- encoder ----
+
+type msgpackEncoder struct {
+	buf   []byte
+	depth int // 当前数组和映射的嵌套层数，防止自引用的值无限递归
+}
+
+func (e *msgpackEncoder) enter() error {
+	if e.depth >= msgpackMaxDepth {
+		return errMsgpackDepth
+	}
+	e.depth++
+	return nil
+}
+
+func (e *msgpackEncoder) leave() { e.depth-- }
+
+func (e *msgpackEncoder) write(b ...byte) { e.buf = append(e.buf, b...) }
+
+func (e *msgpackEncoder) writeUint16(code byte, n uint16) {
+	e.buf = append(e.buf, code)
+	e.buf = append(e.buf, byte(n>>8), byte(n))
+}
+
+func (e *msgpackEncoder) writeUint32(code byte, n uint32) {
+	e.buf = append(e.buf, code)
+	e.buf = append(e.buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func (e *msgpackEncoder) writeUint64(code byte, n uint64) {
+	e.writeUint32(code, uint32(n>>32))
+	e.buf = append(e.buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.write(0xc0)
+		return nil
+	}
+	if v.Type().Implements(binaryMarshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			e.write(0xc0)
+			return nil
+		}
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		e.encodeBin(data)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.write(0xc0)
+			return nil
+		}
+		if k := v.Elem().Kind(); v.Kind() == reflect.Ptr && (k == reflect.Ptr || k == reflect.Interface) {
+			// 只由指针组成的环（如指向自身的 *interface{}）不经过数组和映射，同样计入嵌套层数
+			if err := e.enter(); err != nil {
+				return err
+			}
+			defer e.leave()
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.write(0xc3)
+		} else {
+			e.write(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.writeUint32(0xca, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.writeUint64(0xcb, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.write(0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBin(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.write(0xc0)
+			return nil
+		}
+		if err := e.enter(); err != nil {
+			return err
+		}
+		defer e.leave()
+		e.encodeMapLen(v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		if err := e.enter(); err != nil {
+			return err
+		}
+		defer e.leave()
+		fields := msgpackFields(v.Type())
+		var values []reflect.Value
+		var names []string
+		for _, f := range fields {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || (f.omitEmpty && fv.IsZero()) {
+				continue
+			}
+			names = append(names, f.name)
+			values = append(values, fv)
+		}
+		e.encodeMapLen(len(values))
+		for i := range values {
+			e.encodeString(names[i])
+			if err := e.encode(values[i]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.write(byte(n))
+	case n >= math.MinInt8:
+		e.write(0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.writeUint16(0xd1, uint16(n))
+	case n >= math.MinInt32:
+		e.writeUint32(0xd2, uint32(n))
+	default:
+		e.writeUint64(0xd3, uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.write(byte(n))
+	case n <= math.MaxUint8:
+		e.write(0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint16(0xcd, uint16(n))
+	case n <= math.MaxUint32:
+		e.writeUint32(0xce, uint32(n))
+	default:
+		e.writeUint64(0xcf, n)
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		e.write(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		e.write(0xd9, byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint16(0xda, uint16(n))
+	default:
+		e.writeUint32(0xdb, uint32(n))
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBin(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		e.write(0xc4, byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint16(0xc5, uint16(n))
+	default:
+		e.writeUint32(0xc6, uint32(n))
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	if err := e.enter(); err != nil {
+		return err
+	}
+	defer e.leave()
+	n := v.Len()
+	switch {
+	case n < 16:
+		e.write(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint16(0xdc, uint16(n))
+	default:
+		e.writeUint32(0xdd, uint32(n))
+	}
+	for i := 0; i < n; i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeMapLen(n int) {
+	switch {
+	case n < 16:
+		e.write(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		e.writeUint16(0xde, uint16(n))
+	default:
+		e.writeUint32(0xdf, uint32(n))
+	}
+}
+
+// ---- struct fields ----
+
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+func msgpackFields(t reflect.Type) []msgpackField {
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("msgpack")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		// 匿名结构体字段在没有指定名称时会被展开
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range msgpackFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, msgpackField{name: name, index: []int{i}, omitEmpty: opts == "omitempty"})
+	}
+	return fields
+}
+
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// ---- decoder ----
+
+// msgpackMaxDepth 数组和映射的最大嵌套层数，防止恶意的深层嵌套数据或自引用的值耗尽栈空间
+const msgpackMaxDepth = 100
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int // 当前数组和映射的嵌套层数
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if d.pos+n > len(d.data) || n < 0 {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// readAny 读取一个值，并返回其通用表示：nil、bool、int64（超出范围的无符号整数为 uint64）、float64、string、[]byte、
+// []interface{} 或 map[string]interface{}（非字符串键时为 map[interface{}]interface{}）。
+func (d *msgpackDecoder) readAny() (interface{}, error) {
+	code, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xe0 == 0xa0:
+		return d.readString(int(code & 0x1f))
+	case code&0xf0 == 0x90:
+		return d.readArray(int(code & 0x0f))
+	case code&0xf0 == 0x80:
+		return d.readMap(int(code & 0x0f))
+	}
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.readUint(1 << (code - 0xcc))
+		if err != nil || n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		n, err := d.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		switch size {
+		case 1:
+			return int64(int8(n)), nil
+		case 2:
+			return int64(int16(n)), nil
+		case 4:
+			return int64(int32(n)), nil
+		default:
+			return int64(n), nil
+		}
+	case 0xca:
+		n, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.readUint(8)
+		return math.Float64frombits(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return append(make([]byte, 0, len(b)), b...), nil
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.readArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.readMap(int(n))
+	}
+	return nil, fmt.Errorf("msgpack: unsupported code 0x%x", code)
+}
+
+func (d *msgpackDecoder) readString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) enter() error {
+	if d.depth >= msgpackMaxDepth {
+		return errMsgpackDepth
+	}
+	d.depth++
+	return nil
+}
+
+func (d *msgpackDecoder) leave() { d.depth-- }
+
+func (d *msgpackDecoder) readArray(n int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	arr := make([]interface{}, n)
+	for i := range arr {
+		v, err := d.readAny()
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) readMap(n int) (interface{}, error) {
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	keys := make([]interface{}, n)
+	values := make([]interface{}, n)
+	allString := true
+	for i := 0; i < n; i++ {
+		k, err := d.readAny()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.readAny()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := k.(string); !ok {
+			allString = false
+		}
+		keys[i], values[i] = k, v
+	}
+	if allString {
+		m := make(map[string]interface{}, n)
+		for i := range keys {
+			m[keys[i].(string)] = values[i]
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, n)
+	for i := range keys {
+		k := keys[i]
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, fmt.Errorf("msgpack: unhashable map key %T", k)
+		}
+		m[k] = values[i]
+	}
+	return m, nil
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	raw, err := d.readAny()
+	if err != nil {
+		return err
+	}
+	return assignMsgpack(v, raw)
+}
+
+// assignMsgpack 将 readAny 返回的通用值赋给 v
+func assignMsgpack(v reflect.Value, raw interface{}) error {
+	if raw == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(binaryUnmarshalerType) {
+		var data []byte
+		switch t := raw.(type) {
+		case []byte:
+			data = t
+		case string:
+			data = []byte(t)
+		}
+		if data != nil {
+			return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return assignMsgpack(v.Elem(), raw)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			break
+		}
+		v.Set(reflect.ValueOf(raw))
+		return nil
+	case reflect.Bool:
+		if b, ok := raw.(bool); ok {
+			v.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch t := raw.(type) {
+		case int64:
+			n = t
+		case uint64:
+			if t > math.MaxInt64 {
+				return fmt.Errorf("msgpack: %d overflows %s", t, v.Type())
+			}
+			n = int64(t)
+		default:
+			return msgpackTypeErr(raw, v)
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		switch t := raw.(type) {
+		case uint64:
+			n = t
+		case int64:
+			if t < 0 {
+				return fmt.Errorf("msgpack: %d overflows %s", t, v.Type())
+			}
+			n = uint64(t)
+		default:
+			return msgpackTypeErr(raw, v)
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("msgpack: %d overflows %s", n, v.Type())
+		}
+		v.SetUint(n)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		switch t := raw.(type) {
+		case float64:
+			v.SetFloat(t)
+		case int64:
+			v.SetFloat(float64(t))
+		case uint64:
+			v.SetFloat(float64(t))
+		default:
+			return msgpackTypeErr(raw, v)
+		}
+		return nil
+	case reflect.String:
+		switch t := raw.(type) {
+		case string:
+			v.SetString(t)
+			return nil
+		case []byte:
+			v.SetString(string(t))
+			return nil
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			switch t := raw.(type) {
+			case []byte:
+				v.SetBytes(t)
+				return nil
+			case string:
+				v.SetBytes([]byte(t))
+				return nil
+			}
+		}
+		arr, ok := raw.([]interface{})
+		if !ok {
+			break
+		}
+		s := reflect.MakeSlice(v.Type(), len(arr), len(arr))
+		for i := range arr {
+			if err := assignMsgpack(s.Index(i), arr[i]); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	case reflect.Array:
+		if b, ok := raw.([]byte); ok && v.Type().Elem().Kind() == reflect.Uint8 {
+			reflect.Copy(v, reflect.ValueOf(b))
+			return nil
+		}
+		arr, ok := raw.([]interface{})
+		if !ok {
+			break
+		}
+		if len(arr) > v.Len() {
+			return fmt.Errorf("msgpack: array of length %d overflows %s", len(arr), v.Type())
+		}
+		for i := range arr {
+			if err := assignMsgpack(v.Index(i), arr[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		set := func(k, e interface{}) error {
+			kv := reflect.New(v.Type().Key()).Elem()
+			if err := assignMsgpack(kv, k); err != nil {
+				return err
+			}
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := assignMsgpack(ev, e); err != nil {
+				return err
+			}
+			m.SetMapIndex(kv, ev)
+			return nil
+		}
+		switch t := raw.(type) {
+		case map[string]interface{}:
+			for k, e := range t {
+				if err := set(k, e); err != nil {
+					return err
+				}
+			}
+		case map[interface{}]interface{}:
+			for k, e := range t {
+				if err := set(k, e); err != nil {
+					return err
+				}
+			}
+		default:
+			return msgpackTypeErr(raw, v)
+		}
+		v.Set(m)
+		return nil
+	case reflect.Struct:
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, f := range msgpackFields(v.Type()) {
+			e, ok := m[f.name]
+			if !ok {
+				continue
+			}
+			fv := v
+			for i, x := range f.index {
+				if i > 0 && fv.Kind() == reflect.Ptr {
+					if fv.IsNil() {
+						fv.Set(reflect.New(fv.Type().Elem()))
+					}
+					fv = fv.Elem()
+				}
+				fv = fv.Field(x)
+			}
+			if err := assignMsgpack(fv, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return msgpackTypeErr(raw, v)
+}
+
+func msgpackTypeErr(raw interface{}, v reflect.Value) error {
+	return fmt.Errorf("msgpack: cannot unmarshal %T into %s", raw, v.Type())
+}
@@ -0,0 +1,356 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	defaultOutboxInterval       = time.Second
+	defaultOutboxBatchSize      = 100
+	defaultOutboxConfirmTimeout = 30 * time.Second
+)
+
+var ErrOutboxClosed = errors.New("outbox closed")
+
+func init() {
+	// 消息头中可能出现的非基础类型
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(amqp.Decimal{})
+	gob.Register(time.Time{})
+}
+
+// OutboxEntry 发件箱中待发送的消息。Publishing 是经过消息工厂方法、压缩、加密等处理后最终发送的消息。
+type OutboxEntry struct {
+	ID         int64
+	Exchange   string
+	RoutingKey string
+	Mandatory  bool
+	Publishing amqp.Publishing
+}
+
+// OutboxStore 发件箱的持久化存储。实现必须是并发安全的。
+type OutboxStore interface {
+	// Append 持久化一条消息，并为其分配 ID。返回 nil 表示消息已被持久化。
+	Append(entry *OutboxEntry) error
+	// Pending 按照写入顺序返回最多 limit 条尚未完成的消息
+	Pending(limit int) ([]*OutboxEntry, error)
+	// MarkDone 将消息标记为已完成（已被服务器确认），已完成的消息不会再被 Pending 返回
+	MarkDone(ids ...int64) error
+	Close() error
+}
+
+// TxOutboxStore 支持在调用者的数据库事务中写入消息的 OutboxStore
+type TxOutboxStore interface {
+	OutboxStore
+	AppendTx(tx *sql.Tx, entry *OutboxEntry) error
+}
+
+// outboxRecord 消息的序列化格式
+type outboxRecord struct {
+	Exchange   string
+	RoutingKey string
+	Mandatory  bool
+	Publishing amqp.Publishing
+}
+
+func encodeOutboxEntry(e *OutboxEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&outboxRecord{
+		Exchange:   e.Exchange,
+		RoutingKey: e.RoutingKey,
+		Mandatory:  e.Mandatory,
+		Publishing: e.Publishing,
+	})
+	return buf.Bytes(), err
+}
+
+func decodeOutboxEntry(id int64, data []byte) (*OutboxEntry, error) {
+	var r outboxRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &OutboxEntry{
+		ID:         id,
+		Exchange:   r.Exchange,
+		RoutingKey: r.RoutingKey,
+		Mandatory:  r.Mandatory,
+		Publishing: r.Publishing,
+	}, nil
+}
+
+// OutboxOpts 发件箱选项。
+//
+// interval 表示中继协程轮询存储的间隔。通过 Outbox.Send 写入消息会立即唤醒中继协程，
+// 而通过 Outbox.SendTx 写入的消息要等到事务提交后的下一次轮询才会被发送。
+//
+// batchSize 表示每次从存储中取出并发送的最大消息数。
+//
+// confirmTimeout 表示等待服务器确认的超时时间。超时后，未确认的消息会在下一次轮询时重发。
+type OutboxOpts struct {
+	interval       time.Duration
+	batchSize      int
+	confirmTimeout time.Duration
+}
+
+func DefaultOutboxOpts() *OutboxOpts {
+	return &OutboxOpts{
+		interval:       defaultOutboxInterval,
+		batchSize:      defaultOutboxBatchSize,
+		confirmTimeout: defaultOutboxConfirmTimeout,
+	}
+}
+
+type OutboxOptsBuilder struct {
+	opts *OutboxOpts
+}
+
+func NewOutboxOptsBuilder() *OutboxOptsBuilder {
+	return &OutboxOptsBuilder{DefaultOutboxOpts()}
+}
+
+func (bld *OutboxOptsBuilder) SetInterval(interval time.Duration) *OutboxOptsBuilder {
+	bld.opts.interval = interval
+	return bld
+}
+
+func (bld *OutboxOptsBuilder) SetBatchSize(size int) *OutboxOptsBuilder {
+	bld.opts.batchSize = size
+	return bld
+}
+
+func (bld *OutboxOptsBuilder) SetConfirmTimeout(timeout time.Duration) *OutboxOptsBuilder {
+	bld.opts.confirmTimeout = timeout
+	return bld
+}
+
+func (bld *OutboxOptsBuilder) Build() *OutboxOpts {
+	return bld.opts
+}
+
+// Outbox 事务性发件箱。
+//
+// 消息先被写入持久化的 OutboxStore，再由中继协程使用 Confirm Mode 发送，服务器确认后才会被标记为已完成。
+// 因此即便进程在服务器断线期间崩溃，重启后重新创建的 Outbox 也会继续发送未完成的消息。
+// 断线期间中继协程会暂停发送，重连成功后自动恢复。
+//
+// 注意：消息至少会被发送一次，在进程崩溃或确认超时的情况下可能会重复发送，消费者应当做好幂等处理。
+type Outbox struct {
+	c        *Connection
+	store    OutboxStore
+	opts     *OutboxOpts
+	ch       *Channel               // 中继协程使用的 Channel，仅在中继协程中访问
+	confirms chan amqp.Confirmation // ch 的确认消息
+	wake     chan struct{}
+	closing  chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewOutbox 创建发件箱并启动中继协程。opts 如果为 nil，将使用 DefaultOutboxOpts() 作为默认配置。
+func NewOutbox(c *Connection, store OutboxStore, opts *OutboxOpts) *Outbox {
+	if store == nil {
+		panic("OutboxStore must not be nil")
+	}
+	if opts == nil {
+		opts = DefaultOutboxOpts()
+	}
+	if s, ok := store.(interface{ setConnection(c *Connection) }); ok {
+		s.setConnection(c)
+	}
+	o := &Outbox{
+		c:       c,
+		store:   store,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go o.relay()
+	return o
+}
+
+// Send 将消息写入发件箱。返回 nil 表示消息已被持久化，而不是已被发送。
+//
+// 参数 opts 中的消息工厂方法、压缩和加密配置会在写入前生效；retryable 会被忽略，发件箱总是会重试直到成功。
+func (o *Outbox) Send(exchange string, routingKey string, body []byte, opts *SendOpts) error {
+	entry, err := o.newEntry(exchange, routingKey, body, opts)
+	if err != nil {
+		return err
+	}
+	if err = o.store.Append(entry); err != nil {
+		return err
+	}
+	o.notify()
+	return nil
+}
+
+// SendTx 在调用者的数据库事务中将消息写入发件箱，消息会在事务提交后被发送。要求 OutboxStore 实现 TxOutboxStore。
+func (o *Outbox) SendTx(tx *sql.Tx, exchange string, routingKey string, body []byte, opts *SendOpts) error {
+	store, ok := o.store.(TxOutboxStore)
+	if !ok {
+		return errors.New("OutboxStore does not support transactions")
+	}
+	entry, err := o.newEntry(exchange, routingKey, body, opts)
+	if err != nil {
+		return err
+	}
+	return store.AppendTx(tx, entry)
+}
+
+func (o *Outbox) newEntry(exchange string, routingKey string, body []byte, opts *SendOpts) (*OutboxEntry, error) {
+	select {
+	case <-o.closing:
+		return nil, ErrOutboxClosed
+	default:
+	}
+	if opts == nil {
+		opts = DefaultSendOpts()
+	}
+	o2 := *opts
+	msg, err := o2.publishing(body)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxEntry{Exchange: exchange, RoutingKey: routingKey, Mandatory: opts.mandatory, Publishing: msg}, nil
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close 停止中继协程并关闭 OutboxStore。未发送的消息仍保留在存储中。
+func (o *Outbox) Close() error {
+	o.once.Do(func() { close(o.closing) })
+	<-o.done
+	return o.store.Close()
+}
+
+// relay 中继协程。不断从存储中取出未完成的消息发送，直到 Outbox 关闭。
+func (o *Outbox) relay() {
+	defer close(o.done)
+	defer o.closeChannel()
+	ticker := time.NewTicker(o.opts.interval)
+	defer ticker.Stop()
+	for {
+		for o.flush() {
+			// 存储中可能还有更多消息，继续发送
+		}
+		select {
+		case <-o.closing:
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// flush 发送一批消息。返回值表示是否完整地发送了一整批消息（即可能还有更多的消息等待发送）。
+func (o *Outbox) flush() bool {
+	if !o.c.IsOpen() {
+		return false
+	}
+	entries, err := o.store.Pending(o.opts.batchSize)
+	if err != nil {
+		o.c.warn("load outbox entries failed:", err)
+		return false
+	}
+	if len(entries) == 0 {
+		return false
+	}
+	acked, err := o.publish(entries)
+	if len(acked) > 0 {
+		if e := o.store.MarkDone(acked...); e != nil {
+			o.c.warn("mark outbox entries done failed:", e)
+			return false
+		}
+	}
+	if err != nil {
+		o.c.debug("relay outbox entries failed:", err, urlField(o.c.url))
+		o.closeChannel()
+		return false
+	}
+	return len(acked) == len(entries) && len(entries) == o.opts.batchSize
+}
+
+// publish 使用 Confirm Mode 发送消息，返回已被服务器确认的消息 ID
+func (o *Outbox) publish(entries []*OutboxEntry) (acked []int64, err error) {
+	if o.ch == nil {
+		ch, err := o.c.Channel()
+		if err != nil {
+			return nil, err
+		}
+		o.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, o.opts.batchSize))
+		if err = ch.Confirm(false); err != nil {
+			_ = ch.Close()
+			return nil, err
+		}
+		o.ch = ch
+	}
+	ch, confirms := o.ch, o.confirms
+	// 同一 Channel 上的确认消息按照发送顺序返回，因此可以根据发送的顺序逐个对应。
+	// 一旦出错，Channel 就会被关闭并重建，不会出现错位。
+	sent := 0
+	for _, e := range entries {
+		err = ch.Publish(e.Exchange, e.RoutingKey, e.Mandatory, false, e.Publishing)
+		o.c.metrics().Published(e.Exchange, err)
+		if err != nil {
+			break
+		}
+		sent++
+	}
+
+	timeout := time.NewTimer(o.opts.confirmTimeout)
+	defer timeout.Stop()
+	for i := 0; i < sent; i++ {
+		select {
+		case confirm, ok := <-confirms:
+			if !ok {
+				return acked, amqp.ErrClosed
+			}
+			o.c.metrics().Confirmed(entries[i].Exchange, confirm.Ack)
+			if confirm.Ack {
+				acked = append(acked, entries[i].ID)
+			}
+		case <-timeout.C:
+			return acked, errors.New("wait for confirmation timeout")
+		case <-o.closing:
+			return acked, ErrOutboxClosed
+		}
+	}
+	return acked, err
+}
+
+func (o *Outbox) closeChannel() {
+	if o.ch != nil {
+		_ = o.ch.Close()
+		o.ch = nil
+		o.confirms = nil
+	}
+}
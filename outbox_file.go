@@ -0,0 +1,347 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+const (
+	walOpAppend byte = 1
+	walOpDone   byte = 2
+
+	walHeaderSize     = 1 + 8 + 4 // op + id + payload length
+	walCRCSize        = 4
+	walMaxPayloadSize = 512 << 20 // RabbitMQ 允许的最大消息体为 512MB
+
+	defaultCompactThreshold = 1024
+)
+
+// FileOutboxStore 基于预写日志（WAL）文件的 OutboxStore 实现。
+//
+// 每条记录的格式为：op(1) + id(8) + payload 长度(4) + payload + crc32(4)。
+// 写入消息和标记完成都只会追加记录，并在返回前调用 fsync。打开文件时会重放日志以恢复未完成的消息，
+// 进程崩溃导致的不完整的尾部记录会被截断。已完成的记录累积到一定数量后，日志文件会被压缩。
+//
+// 写入或 fsync 失败时，文件会被截断回写入前的位置，防止不完整的记录留在文件中间；
+// 如果无法截断，之后的写入都会返回错误，需要重新打开日志文件。
+type FileOutboxStore struct {
+	path             string
+	f                *os.File
+	pending          map[int64][]byte // 未完成消息的 payload
+	lastID           int64
+	doneCount        int // 自上次压缩以来标记完成的记录数
+	compactThreshold int
+	corrupted        error       // 恢复时截断的损坏记录，由 NewOutbox 设置 c 后记录日志
+	broken           error       // 写入失败后无法截断日志文件的原因，不为 nil 时拒绝之后的写入
+	c                *Connection // 使用该存储的 Outbox 的 Connection，用于记录日志
+	mut              sync.Mutex
+}
+
+// NewFileOutboxStore 打开（不存在时创建）path 指定的日志文件，并恢复其中未完成的消息
+func NewFileOutboxStore(path string) (*FileOutboxStore, error) {
+	s := &FileOutboxStore{
+		path:             path,
+		pending:          make(map[int64][]byte),
+		compactThreshold: defaultCompactThreshold,
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.replay(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+// replay 重放日志，并将文件截断到最后一条完整的记录
+func (s *FileOutboxStore) replay(f *os.File) error {
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		op, id, payload, n, err := readWALRecord(r)
+		if err != nil {
+			if err != io.EOF {
+				s.corrupted = fmt.Errorf("offset %d: %w", offset, err)
+			}
+			break
+		}
+		offset += n
+		switch op {
+		case walOpAppend:
+			s.pending[id] = payload
+		case walOpDone:
+			delete(s.pending, id)
+			s.doneCount++
+		}
+		if id > s.lastID {
+			s.lastID = id
+		}
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func readWALRecord(r io.Reader) (op byte, id int64, payload []byte, n int64, err error) {
+	var header [walHeaderSize]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("incomplete record header")
+		}
+		return
+	}
+	op = header[0]
+	id = int64(binary.BigEndian.Uint64(header[1:9]))
+	size := binary.BigEndian.Uint32(header[9:13])
+	if size > walMaxPayloadSize {
+		err = errors.New("record too large")
+		return
+	}
+	rest := make([]byte, int(size)+walCRCSize)
+	if _, err = io.ReadFull(r, rest); err != nil {
+		err = errors.New("incomplete record")
+		return
+	}
+	payload = rest[:size]
+	crc := crc32.NewIEEE()
+	crc.Write(header[:])
+	crc.Write(payload)
+	if crc.Sum32() != binary.BigEndian.Uint32(rest[size:]) {
+		err = errors.New("record checksum mismatch")
+		return
+	}
+	if op != walOpAppend && op != walOpDone {
+		err = errors.New("unknown record op")
+		return
+	}
+	n = int64(walHeaderSize + len(rest))
+	return
+}
+
+func appendWALRecord(buf []byte, op byte, id int64, payload []byte) []byte {
+	var header [walHeaderSize]byte
+	header[0] = op
+	binary.BigEndian.PutUint64(header[1:9], uint64(id))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(payload)))
+	crc := crc32.NewIEEE()
+	crc.Write(header[:])
+	crc.Write(payload)
+	buf = append(buf, header[:]...)
+	buf = append(buf, payload...)
+	var sum [walCRCSize]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	return append(buf, sum[:]...)
+}
+
+// write 追加记录并同步到磁盘。失败时将文件截断回写入前的位置，否则重启时会从不完整的记录处截断，
+// 丢失其后已经写入的记录。
+func (s *FileOutboxStore) write(records []byte) error {
+	if s.f == nil {
+		return ErrOutboxClosed
+	}
+	if s.broken != nil {
+		return s.broken
+	}
+	offset, err := s.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = s.f.Write(records); err == nil {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		if e := s.rollback(offset); e != nil {
+			s.broken = fmt.Errorf("outbox log %s is broken: %w", s.path, e)
+		}
+		return err
+	}
+	return nil
+}
+
+// rollback 将日志文件截断到 offset，并同步到磁盘
+func (s *FileOutboxStore) rollback(offset int64) error {
+	if err := s.f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *FileOutboxStore) Append(entry *OutboxEntry) error {
+	payload, err := encodeOutboxEntry(entry)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	id := s.lastID + 1
+	if err = s.write(appendWALRecord(nil, walOpAppend, id, payload)); err != nil {
+		return err
+	}
+	s.lastID = id
+	s.pending[id] = payload
+	entry.ID = id
+	return nil
+}
+
+func (s *FileOutboxStore) Pending(limit int) ([]*OutboxEntry, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	ids := make([]int64, 0, len(s.pending))
+	for id := range s.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	entries := make([]*OutboxEntry, 0, len(ids))
+	for _, id := range ids {
+		entry, err := decodeOutboxEntry(id, s.pending[id])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *FileOutboxStore) MarkDone(ids ...int64) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	var records []byte
+	for _, id := range ids {
+		if _, ok := s.pending[id]; ok {
+			records = appendWALRecord(records, walOpDone, id, nil)
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if err := s.write(records); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, ok := s.pending[id]; ok {
+			delete(s.pending, id)
+			s.doneCount++
+		}
+	}
+	if s.doneCount >= s.compactThreshold {
+		if err := s.compact(); err != nil {
+			s.c.warn("compact outbox log failed:", err, Field{Key: "path", Value: s.path})
+		}
+	}
+	return nil
+}
+
+// setConnection 由 NewOutbox 调用，之后的日志通过 c 记录
+func (s *FileOutboxStore) setConnection(c *Connection) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.c = c
+	if s.corrupted != nil {
+		c.warn("truncated corrupted outbox log:", s.corrupted, Field{Key: "path", Value: s.path})
+		s.corrupted = nil
+	}
+}
+
+// compact 将未完成的消息写入新的日志文件，并替换旧的日志文件
+func (s *FileOutboxStore) compact() error {
+	ids := make([]int64, 0, len(s.pending))
+	for id := range s.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	var records []byte
+	for _, id := range ids {
+		records = appendWALRecord(records, walOpAppend, id, s.pending[id])
+	}
+	// 保留最大的 ID，防止重启后 ID 被重复使用
+	if len(ids) == 0 || ids[len(ids)-1] != s.lastID {
+		records = appendWALRecord(records, walOpDone, s.lastID, nil)
+	}
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(records); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = s.f.Close()
+	s.f = f
+	s.doneCount = 0
+	// 同步目录，确保重命名已经写入磁盘，否则崩溃后可能恢复出旧的日志文件
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir 将目录的变更（如重命名）同步到磁盘。Windows 不支持对目录调用 fsync，重命名由系统保证持久化。
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (s *FileOutboxStore) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
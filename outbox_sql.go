@@ -0,0 +1,130 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// QuestionPlaceholder MySQL、SQLite 等数据库使用的占位符
+func QuestionPlaceholder(int) string { return "?" }
+
+// DollarPlaceholder PostgreSQL 使用的占位符
+func DollarPlaceholder(n int) string { return "$" + strconv.Itoa(n) }
+
+// SQLOutboxStore 基于 database/sql 的 OutboxStore 实现，可以通过 AppendTx 在调用者的事务中写入消息，
+// 从而保证业务数据与消息同时提交或回滚。
+//
+// 表需要由调用者预先创建，已完成的消息会被直接删除。以 MySQL 为例：
+//
+//	CREATE TABLE ezmq_outbox (
+//		id          BIGINT AUTO_INCREMENT PRIMARY KEY,
+//		exchange    VARCHAR(255) NOT NULL,
+//		routing_key VARCHAR(255) NOT NULL,
+//		message     BLOB NOT NULL
+//	);
+//
+// 注意：自增 ID 按照插入顺序分配，但事务可能以不同的顺序提交，因此 SQLOutboxStore 不保证严格的发送顺序。
+type SQLOutboxStore struct {
+	db          *sql.DB
+	table       string
+	placeholder func(n int) string
+}
+
+// NewSQLOutboxStore 创建 SQLOutboxStore，默认使用 QuestionPlaceholder 作为占位符
+func NewSQLOutboxStore(db *sql.DB, table string) *SQLOutboxStore {
+	return &SQLOutboxStore{db: db, table: table, placeholder: QuestionPlaceholder}
+}
+
+// SetPlaceholder 设置 SQL 占位符，参数 n 从 1 开始。如 PostgreSQL 应使用 DollarPlaceholder。
+func (s *SQLOutboxStore) SetPlaceholder(placeholder func(n int) string) *SQLOutboxStore {
+	s.placeholder = placeholder
+	return s
+}
+
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLOutboxStore) Append(entry *OutboxEntry) error {
+	return s.append(s.db, entry)
+}
+
+func (s *SQLOutboxStore) AppendTx(tx *sql.Tx, entry *OutboxEntry) error {
+	return s.append(tx, entry)
+}
+
+func (s *SQLOutboxStore) append(db sqlExecer, entry *OutboxEntry) error {
+	message, err := encodeOutboxEntry(entry)
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO " + s.table + " (exchange, routing_key, message) VALUES (" +
+		s.placeholder(1) + ", " + s.placeholder(2) + ", " + s.placeholder(3) + ")"
+	_, err = db.Exec(query, entry.Exchange, entry.RoutingKey, message)
+	return err
+}
+
+func (s *SQLOutboxStore) Pending(limit int) ([]*OutboxEntry, error) {
+	query := "SELECT id, message FROM " + s.table + " ORDER BY id"
+	var args []interface{}
+	if limit > 0 {
+		query += " LIMIT " + s.placeholder(1)
+		args = append(args, limit)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*OutboxEntry
+	for rows.Next() {
+		var id int64
+		var message []byte
+		if err = rows.Scan(&id, &message); err != nil {
+			return nil, err
+		}
+		entry, err := decodeOutboxEntry(id, message)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLOutboxStore) MarkDone(ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = s.placeholder(i + 1)
+		args[i] = id
+	}
+	query := "DELETE FROM " + s.table + " WHERE id IN (" + strings.Join(placeholders, ", ") + ")"
+	_, err := s.db.Exec(query, args...)
+	return err
+}
+
+// Close 不会关闭 sql.DB，sql.DB 由调用者管理
+func (s *SQLOutboxStore) Close() error {
+	return nil
+}
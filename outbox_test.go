@@ -0,0 +1,213 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func appendOutboxEntries(t *testing.T, store OutboxStore, n int) []int64 {
+	var ids []int64
+	for i := 0; i < n; i++ {
+		entry := &OutboxEntry{
+			Exchange:   "amq.direct",
+			RoutingKey: "key.direct",
+			Publishing: amqp.Publishing{
+				Headers: amqp.Table{"n": int32(i), "nested": amqp.Table{"s": "v"}},
+				Body:    []byte("msg" + strconv.Itoa(i)),
+			},
+		}
+		if err := store.Append(entry); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func pendingIDs(t *testing.T, store OutboxStore) []int64 {
+	entries, err := store.Pending(0)
+	if err != nil {
+		t.Fatalf("Pending() error = %v", err)
+	}
+	var ids []int64
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestFileOutboxStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.wal")
+	store, err := NewFileOutboxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := appendOutboxEntries(t, store, 5)
+	if err = store.MarkDone(ids[0], ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := store.Pending(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != ids[1] || string(entries[0].Publishing.Body) != "msg1" {
+		t.Fatalf("Pending() got = %+v", entries)
+	}
+	if !reflect.DeepEqual(entries[0].Publishing.Headers, amqp.Table{"n": int32(1), "nested": amqp.Table{"s": "v"}}) {
+		t.Errorf("Pending() headers = %#v", entries[0].Publishing.Headers)
+	}
+	_ = store.Close()
+
+	// 重启后恢复未完成的消息
+	store, err = NewFileOutboxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{ids[1], ids[3], ids[4]}
+	if got := pendingIDs(t, store); !reflect.DeepEqual(got, want) {
+		t.Errorf("Pending() after reopen = %v, want %v", got, want)
+	}
+	if next := appendOutboxEntries(t, store, 1); next[0] != ids[4]+1 {
+		t.Errorf("Append() after reopen id = %v, want %v", next[0], ids[4]+1)
+	}
+	_ = store.Close()
+}
+
+func TestFileOutboxStore_truncateTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.wal")
+	store, err := NewFileOutboxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := appendOutboxEntries(t, store, 2)
+	_ = store.Close()
+
+	// 模拟写入过程中进程崩溃
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(appendWALRecord(nil, walOpAppend, 3, []byte("torn"))[:10])
+	_ = f.Close()
+
+	store, err = NewFileOutboxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := pendingIDs(t, store); !reflect.DeepEqual(got, ids) {
+		t.Errorf("Pending() = %v, want %v", got, ids)
+	}
+	// 截断的记录在 NewOutbox 设置 Connection 后通过该 Connection 记录日志
+	conn, buf := newLogConnection(t)
+	store.setConnection(conn)
+	if want := "truncated corrupted outbox log: offset "; !strings.Contains(buf.String(), want) {
+		t.Errorf("connection log %q does not contain %q", buf.String(), want)
+	}
+	if next := appendOutboxEntries(t, store, 1); next[0] != 3 {
+		t.Errorf("Append() id = %v, want 3", next[0])
+	}
+}
+
+func TestFileOutboxStore_writeFailed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.wal")
+	store, err := NewFileOutboxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := appendOutboxEntries(t, store, 1)
+
+	// 写入一半失败后截断，之后追加的记录在重启后仍然可以恢复
+	offset, _ := store.f.Seek(0, io.SeekCurrent)
+	_, _ = store.f.Write(appendWALRecord(nil, walOpAppend, 2, []byte("torn"))[:10])
+	if err = store.rollback(offset); err != nil {
+		t.Fatalf("rollback() error = %v", err)
+	}
+	ids = append(ids, appendOutboxEntries(t, store, 1)...)
+
+	// 无法截断时，拒绝之后的写入
+	f := store.f
+	if store.f, err = os.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Append(&OutboxEntry{}); err == nil {
+		t.Fatal("Append() on a read-only log error = nil")
+	}
+	_ = store.f.Close()
+	store.f = f
+	if err = store.Append(&OutboxEntry{}); err == nil || !strings.Contains(err.Error(), "is broken") {
+		t.Errorf("Append() after a failed rollback error = %v, want broken", err)
+	}
+	_ = store.Close()
+
+	store, err = NewFileOutboxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.corrupted != nil {
+		t.Errorf("replay truncated the log: %v", store.corrupted)
+	}
+	if got := pendingIDs(t, store); !reflect.DeepEqual(got, ids) {
+		t.Errorf("Pending() = %v, want %v", got, ids)
+	}
+}
+
+func TestFileOutboxStore_compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.wal")
+	store, err := NewFileOutboxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.compactThreshold = 2
+	ids := appendOutboxEntries(t, store, 6)
+	if err = store.MarkDone(ids[:4]...); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.MarkDone(ids[4:]...); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != walHeaderSize+walCRCSize {
+		t.Errorf("compacted log size = %d, want %d", info.Size(), walHeaderSize+walCRCSize)
+	}
+	store, err = NewFileOutboxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got := pendingIDs(t, store); len(got) != 0 {
+		t.Errorf("Pending() = %v, want none", got)
+	}
+	if next := appendOutboxEntries(t, store, 1); next[0] != 7 {
+		t.Errorf("Append() id = %v, want 7", next[0])
+	}
+}
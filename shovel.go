@@ -0,0 +1,342 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const defaultShovelPrefetch = 10
+
+// ShovelMessage Shovel 将要发送到目标交换器的消息，可以在 ShovelOpts.transform 中修改。
+// Delivery 是从源队列接收到的消息，不应修改。
+type ShovelMessage struct {
+	Exchange   string
+	RoutingKey string
+	Publishing amqp.Publishing
+	Delivery   *amqp.Delivery
+}
+
+// ShovelFilter 判断消息是否需要被转移
+type ShovelFilter func(delivery *amqp.Delivery) bool
+
+// MatchRoutingKey 返回匹配路由键的 ShovelFilter。pattern 的格式与 topic 交换器的绑定键相同：
+// * 匹配一个单词，# 匹配零个或多个单词，单词之间以 . 分隔。
+func MatchRoutingKey(pattern string) ShovelFilter {
+	words := strings.Split(pattern, ".")
+	return func(delivery *amqp.Delivery) bool {
+		return matchWords(words, strings.Split(delivery.RoutingKey, "."))
+	}
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+// MatchHeader 返回匹配消息头的 ShovelFilter。消息头的值按照 fmt.Sprint 的结果比较，因此 int32(1) 与 int64(1) 相等。
+func MatchHeader(key string, value interface{}) ShovelFilter {
+	want := fmt.Sprint(value)
+	return func(delivery *amqp.Delivery) bool {
+		v, ok := delivery.Headers[key]
+		return ok && fmt.Sprint(v) == want
+	}
+}
+
+// ShovelOpts Shovel 的选项。
+//
+// routingKey 如果设置了，会替换消息原来的路由键。
+//
+// filter 表示需要转移的消息，默认为 nil，表示转移所有消息。不需要转移的消息按照 skipDisposition 处置，默认为 DispositionStop，
+// 即放回源队列并停止 Shovel。注意：使用 DispositionRequeue 时，放回源队列的消息会被立即重新投递，Shovel 不会自行停止。
+//
+// transform 用于在发送前修改消息。返回 error 的消息按照 errDisposition 处置，默认为 DispositionStop。
+//
+// maxCount 表示最多转移的消息数，达到后 Shovel 会停止，默认为 0，表示不限制。
+//
+// rate 表示每秒最多转移的消息数，默认为 0，表示不限制。
+//
+// prefetch 表示源队列的预取数量，默认为 10。
+//
+// retryable 表示发送到目标交换器未收到确认（nack 或连接断开）时的重发配置，默认为 DefaultTimesRetry()，即一直重试直到目标服务器确认。
+// 每条消息都使用 retryable 的独立副本，互不影响。
+type ShovelOpts struct {
+	routingKey      string
+	setRoutingKey   bool
+	filter          ShovelFilter
+	skipDisposition Disposition
+	transform       func(msg *ShovelMessage) error
+	errDisposition  Disposition
+	maxCount        int64
+	rate            float64
+	prefetch        int
+	retryable       Retryable
+}
+
+func DefaultShovelOpts() *ShovelOpts {
+	return &ShovelOpts{
+		skipDisposition: DispositionStop,
+		errDisposition:  DispositionStop,
+		prefetch:        defaultShovelPrefetch,
+		retryable:       DefaultTimesRetry(),
+	}
+}
+
+type ShovelOptsBuilder struct {
+	opts *ShovelOpts
+}
+
+func NewShovelOptsBuilder() *ShovelOptsBuilder {
+	return &ShovelOptsBuilder{DefaultShovelOpts()}
+}
+
+func (bld *ShovelOptsBuilder) SetRoutingKey(routingKey string) *ShovelOptsBuilder {
+	bld.opts.routingKey, bld.opts.setRoutingKey = routingKey, true
+	return bld
+}
+
+// 设置需要转移的消息，以及不需要转移的消息的处置方式。多个 ShovelFilter 需要同时满足。
+func (bld *ShovelOptsBuilder) SetFilter(skip Disposition, filters ...ShovelFilter) *ShovelOptsBuilder {
+	bld.opts.skipDisposition = skip
+	bld.opts.filter = func(delivery *amqp.Delivery) bool {
+		for _, f := range filters {
+			if !f(delivery) {
+				return false
+			}
+		}
+		return true
+	}
+	return bld
+}
+
+func (bld *ShovelOptsBuilder) SetTransform(transform func(msg *ShovelMessage) error) *ShovelOptsBuilder {
+	bld.opts.transform = transform
+	return bld
+}
+
+func (bld *ShovelOptsBuilder) SetErrDisposition(d Disposition) *ShovelOptsBuilder {
+	bld.opts.errDisposition = d
+	return bld
+}
+
+func (bld *ShovelOptsBuilder) SetMaxCount(n int64) *ShovelOptsBuilder {
+	bld.opts.maxCount = n
+	return bld
+}
+
+func (bld *ShovelOptsBuilder) SetRate(perSecond float64) *ShovelOptsBuilder {
+	bld.opts.rate = perSecond
+	return bld
+}
+
+func (bld *ShovelOptsBuilder) SetPrefetch(prefetch int) *ShovelOptsBuilder {
+	bld.opts.prefetch = prefetch
+	return bld
+}
+
+func (bld *ShovelOptsBuilder) SetRetryable(retryable Retryable) *ShovelOptsBuilder {
+	bld.opts.retryable = retryable
+	return bld
+}
+
+func (bld *ShovelOptsBuilder) Build() *ShovelOpts {
+	return bld.opts
+}
+
+// Shovel 从源 Connection 的队列接收消息，并使用 Confirm Mode 发送到目标 Connection 的交换器。
+// 源队列的消息只会在目标服务器确认后才被确认，因此消息至少会被转移一次，但在连接断开时可能会被重复转移。
+//
+// 源和目标可以是同一个 Connection。任意一端断线时，Shovel 都会在重连成功后继续转移：
+// 源断线时由 Consumer.Receive 重新订阅；目标断线时，正在转移的消息会按照 ShovelOpts.retryable 重发。
+//
+// 注意：如果目标交换器不存在，发送会因为 Channel 错误一直失败，请先确保目标交换器已经声明。
+type Shovel struct {
+	src, dst *Connection
+	queue    string
+	exchange string
+	opts     *ShovelOpts
+	sub      *Subscription
+	ch       *Channel  // 目标 Channel
+	next     time.Time // 限速时下一条消息的发送时间
+	hMut     sync.Mutex
+	aborted  context.Context // Stop 的 ctx 结束后被取消，用于结束卡住的转移
+	abort    context.CancelFunc
+	moved    int64
+	skipped  int64
+	err      error
+	mut      sync.Mutex
+}
+
+// NewShovel 创建 Shovel 并开始转移消息。exchange 为目标交换器，"" 表示默认交换器。
+// opts 如果为 nil，将使用 DefaultShovelOpts() 作为默认配置。
+func NewShovel(src *Connection, queue string, dst *Connection, exchange string, opts *ShovelOpts) *Shovel {
+	if opts == nil {
+		opts = DefaultShovelOpts()
+	}
+	s := &Shovel{src: src, dst: dst, queue: queue, exchange: exchange, opts: opts}
+	s.aborted, s.abort = context.WithCancel(context.Background())
+	receiveOpts := NewReceiveOptsBuilder().SetAutoAck(false).SetPrefetch(opts.prefetch).Build()
+	s.sub = src.Consumer().Receive(queue, receiveOpts, &AbsReceiveListener{ConsumerContextMethod: s.handle})
+	go func() {
+		<-s.sub.Done()
+		s.abort()
+		s.hMut.Lock()
+		defer s.hMut.Unlock()
+		if s.ch != nil {
+			_ = s.ch.Close()
+		}
+	}()
+	return s
+}
+
+// handle 转移一条消息，返回是否停止接收。
+// 源断线重连后，旧的消费协程可能仍在转移消息，因此需要加锁，保证同一时间只转移一条消息。
+func (s *Shovel) handle(ctx context.Context, delivery *amqp.Delivery) (brk bool) {
+	s.hMut.Lock()
+	defer s.hMut.Unlock()
+	ctx = abortCtx{Context: ctx, aborted: s.aborted}
+	if s.opts.filter != nil && !s.opts.filter(delivery) {
+		atomic.AddInt64(&s.skipped, 1)
+		return s.opts.skipDisposition.apply(s.src, delivery, false, queueField(s.queue))
+	}
+	msg := &ShovelMessage{
+		Exchange:   s.exchange,
+		RoutingKey: delivery.RoutingKey,
+		Publishing: publishingOf(delivery),
+		Delivery:   delivery,
+	}
+	if s.opts.setRoutingKey {
+		msg.RoutingKey = s.opts.routingKey
+	}
+	if s.opts.transform != nil {
+		if err := s.opts.transform(msg); err != nil {
+			s.src.warn("transform message failed:", err, queueField(s.queue), deliveryTagField(delivery.DeliveryTag))
+			return s.opts.errDisposition.apply(s.src, delivery, false, queueField(s.queue))
+		}
+	}
+	if s.opts.rate > 0 {
+		if err := sleepCtx(ctx, time.Until(s.next)); err != nil {
+			return s.fail(delivery, err)
+		}
+		s.next = time.Now().Add(time.Duration(float64(time.Second) / s.opts.rate))
+	}
+	if err := s.publish(ctx, msg); err != nil {
+		return s.fail(delivery, err)
+	}
+	if err := delivery.Ack(false); err != nil {
+		// 源连接断开，消息会被重新投递，之后会被重复转移
+		s.src.warn("ack shoveled message failed:", err, queueField(s.queue), deliveryTagField(delivery.DeliveryTag))
+		return false
+	}
+	moved := atomic.AddInt64(&s.moved, 1)
+	return s.opts.maxCount > 0 && moved >= s.opts.maxCount
+}
+
+func (s *Shovel) publish(ctx context.Context, msg *ShovelMessage) (err error) {
+	retryable := cloneRetryable(s.opts.retryable)
+	if s.ch == nil {
+		retryable.retry(func() (brk bool) {
+			s.ch, err = s.dst.Channel()
+			return err == nil || ctx.Err() != nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sendOpts := &SendOpts{
+		messageFactory: func([]byte) amqp.Publishing { return msg.Publishing },
+		retryable:      retryable,
+	}
+	return s.ch.SendCtx(ctx, msg.Exchange, msg.RoutingKey, msg.Publishing.Body, sendOpts)
+}
+
+// fail 将消息放回源队列，并停止 Shovel
+func (s *Shovel) fail(delivery *amqp.Delivery, err error) bool {
+	s.dst.warn("shovel message failed:", err, queueField(s.queue), deliveryTagField(delivery.DeliveryTag))
+	s.mut.Lock()
+	s.err = err
+	s.mut.Unlock()
+	return DispositionStop.apply(s.src, delivery, false, queueField(s.queue))
+}
+
+// Moved 返回已转移的消息数
+func (s *Shovel) Moved() int64 {
+	return atomic.LoadInt64(&s.moved)
+}
+
+// Skipped 返回被 filter 过滤掉的消息数
+func (s *Shovel) Skipped() int64 {
+	return atomic.LoadInt64(&s.skipped)
+}
+
+// Stop 停止转移，等待正在转移的消息处理完毕。详见 Subscription.Stop。
+// ctx 结束时会中止正在转移的消息（例如目标断线时的重发），该消息会被放回源队列。
+func (s *Shovel) Stop(ctx context.Context) error {
+	err := s.sub.Stop(ctx)
+	if err != nil {
+		s.abort()
+	}
+	return err
+}
+
+// Done 返回一个 channel，Shovel 停止后会被关闭。达到 maxCount、消息被 DispositionStop 处置或发送失败时 Shovel 会自行停止。
+func (s *Shovel) Done() <-chan struct{} {
+	return s.sub.Done()
+}
+
+// Err 返回 Shovel 停止（或源队列最近一次中断）的原因。正常停止时返回 nil。
+func (s *Shovel) Err() error {
+	s.mut.Lock()
+	err := s.err
+	s.mut.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.sub.Err()
+}
+
+// abortCtx 保留消息的链路上下文，但在 Shovel 被中止时结束。
+// 消费者的 ctx 不会被取消，因此可以直接使用 aborted 的 Done 和 Err。
+type abortCtx struct {
+	context.Context
+	aborted context.Context
+}
+
+func (c abortCtx) Deadline() (time.Time, bool) { return c.aborted.Deadline() }
+func (c abortCtx) Done() <-chan struct{}       { return c.aborted.Done() }
+func (c abortCtx) Err() error                  { return c.aborted.Err() }
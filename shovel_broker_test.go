@@ -0,0 +1,207 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+	"ezmq/ezmqtest"
+)
+
+func shovelFixture(t *testing.T, n int) (src, dst *ezmqtest.Broker, srcConn, dstConn *ezmq.Connection) {
+	t.Helper()
+	src, dst = ezmqtest.NewBroker(), ezmqtest.NewBroker()
+	srcConn = src.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	dstConn = dst.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	for _, conn := range []*ezmq.Connection{srcConn, dstConn} {
+		if err := conn.Dial(); err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		conn := conn
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+	dch, err := dstConn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dch.Close()
+	if _, err = dch.QueueDeclare("orders", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	sch, err := srcConn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sch.Close()
+	if _, err = sch.QueueDeclare("dlq", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		msg := amqp.Publishing{Body: []byte(fmt.Sprint(i)), Headers: amqp.Table{"even": i%2 == 0}}
+		if err = sch.Publish("", "dlq", false, false, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func waitDone(t *testing.T, s *ezmq.Shovel) {
+	t.Helper()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("shovel not done")
+	}
+}
+
+func bodies(t *testing.T, conn *ezmq.Connection, queue string) []string {
+	t.Helper()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	var got []string
+	for {
+		d, ok, err := ch.Get(queue, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return got
+		}
+		got = append(got, string(d.Body))
+	}
+}
+
+func TestShovel(t *testing.T) {
+	src, _, srcConn, dstConn := shovelFixture(t, 5)
+	opts := ezmq.NewShovelOptsBuilder().
+		SetRoutingKey("orders").
+		SetMaxCount(3).
+		SetTransform(func(msg *ezmq.ShovelMessage) error {
+			msg.Publishing.Headers = amqp.Table{"shoveled": true}
+			return nil
+		}).
+		Build()
+	s := ezmq.NewShovel(srcConn, "dlq", dstConn, "", opts)
+	waitDone(t, s)
+	if s.Moved() != 3 || s.Err() != nil {
+		t.Errorf("Moved() = %d, Err() = %v, want 3, nil", s.Moved(), s.Err())
+	}
+	if got := fmt.Sprint(bodies(t, dstConn, "orders")); got != "[0 1 2]" {
+		t.Errorf("moved = %s", got)
+	}
+	waitFor(t, time.Second, func() bool { return src.QueueDepth("dlq") == 2 && src.Unacked("dlq") == 0 })
+}
+
+func TestShovel_filter(t *testing.T) {
+	src, _, srcConn, dstConn := shovelFixture(t, 4)
+	opts := ezmq.NewShovelOptsBuilder().SetRoutingKey("orders").
+		SetFilter(ezmq.DispositionReject, ezmq.MatchHeader("even", true), ezmq.MatchRoutingKey("dlq")).Build()
+	s := ezmq.NewShovel(srcConn, "dlq", dstConn, "", opts)
+	waitFor(t, time.Second, func() bool { return src.QueueDepth("dlq") == 0 && src.Unacked("dlq") == 0 })
+	_ = s.Stop(context.Background())
+	if s.Moved() != 2 || s.Skipped() != 2 {
+		t.Errorf("Moved() = %d, Skipped() = %d, want 2, 2", s.Moved(), s.Skipped())
+	}
+	if got := fmt.Sprint(bodies(t, dstConn, "orders")); got != "[0 2]" {
+		t.Errorf("moved = %s", got)
+	}
+
+	// 默认遇到不需要转移的消息时停止，消息留在源队列中
+	src, _, srcConn, dstConn = shovelFixture(t, 4)
+	opts = ezmq.NewShovelOptsBuilder().SetRoutingKey("orders").SetFilter(ezmq.DispositionStop, ezmq.MatchHeader("even", true)).Build()
+	s = ezmq.NewShovel(srcConn, "dlq", dstConn, "", opts)
+	waitDone(t, s)
+	waitFor(t, time.Second, func() bool { return src.QueueDepth("dlq") == 3 })
+	if s.Moved() != 1 {
+		t.Errorf("Moved() = %d, want 1", s.Moved())
+	}
+}
+
+func TestShovel_transformError(t *testing.T) {
+	src, _, srcConn, dstConn := shovelFixture(t, 2)
+	opts := ezmq.NewShovelOptsBuilder().SetRoutingKey("orders").
+		SetTransform(func(msg *ezmq.ShovelMessage) error { return errors.New("bad message") }).Build()
+	s := ezmq.NewShovel(srcConn, "dlq", dstConn, "", opts)
+	waitDone(t, s)
+	waitFor(t, time.Second, func() bool { return src.QueueDepth("dlq") == 2 })
+	if s.Moved() != 0 {
+		t.Errorf("Moved() = %d, want 0", s.Moved())
+	}
+}
+
+func TestShovel_reconnect(t *testing.T) {
+	src, dst, srcConn, dstConn := shovelFixture(t, 20)
+	opts := ezmq.NewShovelOptsBuilder().
+		SetRoutingKey("orders").
+		SetRate(200).
+		SetRetryable(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0)).
+		Build()
+	s := ezmq.NewShovel(srcConn, "dlq", dstConn, "", opts)
+	defer s.Stop(context.Background())
+	waitFor(t, time.Second, func() bool { return s.Moved() >= 5 })
+	dst.CloseConnections()
+	waitFor(t, time.Second, func() bool { return s.Moved() >= 10 })
+	src.CloseConnections()
+	waitFor(t, 2*time.Second, func() bool { return src.QueueDepth("dlq") == 0 && src.Unacked("dlq") == 0 })
+
+	// 断线可能导致消息被重复转移，但不会丢失
+	seen := make(map[string]bool)
+	for _, b := range bodies(t, dstConn, "orders") {
+		seen[b] = true
+	}
+	for i := 0; i < 20; i++ {
+		if !seen[fmt.Sprint(i)] {
+			t.Errorf("message %d lost", i)
+		}
+	}
+}
+
+func TestShovel_stopDuringRetry(t *testing.T) {
+	src, dst, srcConn, dstConn := shovelFixture(t, 1)
+	// 目标一直不可用，消息会一直重发
+	dst.SetDialError(ezmqtest.ErrConnRefused())
+	dst.CloseConnections()
+	waitFor(t, time.Second, func() bool { return !dstConn.IsOpen() })
+	opts := ezmq.NewShovelOptsBuilder().
+		SetRoutingKey("orders").
+		SetRetryable(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0)).
+		Build()
+	s := ezmq.NewShovel(srcConn, "dlq", dstConn, "", opts)
+	waitFor(t, time.Second, func() bool { return src.Unacked("dlq") == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	waitDone(t, s)
+	if s.Moved() != 0 {
+		t.Errorf("Moved() = %d, want 0", s.Moved())
+	}
+	// 被中止的消息放回源队列
+	waitFor(t, time.Second, func() bool { return src.QueueDepth("dlq") == 1 && src.Unacked("dlq") == 0 })
+}
@@ -0,0 +1,62 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestMatchRoutingKey(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"order.created", "order.created", true},
+		{"order.*", "order.created", true},
+		{"order.*", "order.created.eu", false},
+		{"order.#", "order", true},
+		{"#.eu", "order.created.eu", true},
+		{"*", "", true},
+		{"*.created", "created", false},
+	}
+	for _, tt := range tests {
+		if got := MatchRoutingKey(tt.pattern)(&amqp.Delivery{RoutingKey: tt.key}); got != tt.want {
+			t.Errorf("MatchRoutingKey(%q)(%q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMatchHeader(t *testing.T) {
+	d := &amqp.Delivery{Headers: amqp.Table{"tenant": "a", "retries": int32(3)}}
+	tests := []struct {
+		key   string
+		value interface{}
+		want  bool
+	}{
+		{"tenant", "a", true},
+		{"tenant", "b", false},
+		{"retries", 3, true},
+		{"missing", "", false},
+	}
+	for _, tt := range tests {
+		if got := MatchHeader(tt.key, tt.value)(d); got != tt.want {
+			t.Errorf("MatchHeader(%q, %v) = %v, want %v", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+//go:build go1.21
+
+package ezmq
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// slogLogger 将日志交给 slog.Handler 处理的 Logger。Field 类型的参数会被转换为 slog.Attr。
+type slogLogger struct {
+	h slog.Handler
+}
+
+// NewSlogLogger 返回使用 l 输出日志的 Logger。日志级别、Field 以及调用者的位置都会被保留。
+//
+// 注意：低于 SetLogLevel 设置的级别的日志不会传给 slog，如需输出 Debug 日志，请同时调用 SetLogLevel(LevelDebug)。
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return &slogLogger{h: l.Handler()}
+}
+
+// NewSlogHandlerLogger 返回使用 h 输出日志的 Logger，详见 NewSlogLogger
+func NewSlogHandlerLogger(h slog.Handler) Logger {
+	return &slogLogger{h: h}
+}
+
+// SetSlogLogger 使用 l 输出全局日志，等同于 SetLogger(NewSlogLogger(l))
+func SetSlogLogger(l *slog.Logger) {
+	SetLogger(NewSlogLogger(l))
+}
+
+func (l *slogLogger) Debug(v ...interface{}) {
+	l.log(slog.LevelDebug, v)
+}
+
+func (l *slogLogger) Info(v ...interface{}) {
+	l.log(slog.LevelInfo, v)
+}
+
+func (l *slogLogger) Warn(v ...interface{}) {
+	l.log(slog.LevelWarn, v)
+}
+
+func (l *slogLogger) Error(v ...interface{}) {
+	l.log(slog.LevelError, v)
+}
+
+func (l *slogLogger) Debugf(f string, args ...interface{}) {
+	l.log(slog.LevelDebug, []interface{}{fmt.Sprintf(f, args...)})
+}
+
+func (l *slogLogger) Infof(f string, args ...interface{}) {
+	l.log(slog.LevelInfo, []interface{}{fmt.Sprintf(f, args...)})
+}
+
+func (l *slogLogger) Warnf(f string, args ...interface{}) {
+	l.log(slog.LevelWarn, []interface{}{fmt.Sprintf(f, args...)})
+}
+
+func (l *slogLogger) Errorf(f string, args ...interface{}) {
+	l.log(slog.LevelError, []interface{}{fmt.Sprintf(f, args...)})
+}
+
+func (l *slogLogger) log(level slog.Level, v []interface{}) {
+	ctx := context.Background()
+	if !l.h.Enabled(ctx, level) {
+		return
+	}
+	msg := make([]interface{}, 0, len(v))
+	var attrs []slog.Attr
+	for _, e := range v {
+		if f, ok := e.(Field); ok {
+			attrs = append(attrs, slog.Any(f.Key, f.Value))
+		} else {
+			msg = append(msg, e)
+		}
+	}
+	// 跳过 runtime.Callers、log、Debug 等方法以及内部日志函数，记录内部日志函数的调用者
+	var pcs [1]uintptr
+	runtime.Callers(4, pcs[:])
+	r := slog.NewRecord(time.Now(), level, strings.TrimRight(fmt.Sprintln(msg...), "\n"), pcs[0])
+	r.AddAttrs(attrs...)
+	_ = l.h.Handle(ctx, r)
+}
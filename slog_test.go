@@ -0,0 +1,75 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+//go:build go1.21
+
+package ezmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	old := _default
+	defer func() {
+		SetLogger(old)
+		SetLogLevel(LevelInfo)
+	}()
+	SetSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{AddSource: true, Level: slog.LevelInfo})))
+	SetLogLevel(LevelDebug)
+
+	debug("filtered by the handler")
+	warn("consume failed:", errors.New("boom"), queueField("queue.direct"), attemptField(2))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("output = %q, want exactly one JSON record: %v", buf.String(), err)
+	}
+	if record["level"] != "WARN" || record["msg"] != "consume failed: boom" {
+		t.Errorf("level = %v, msg = %v", record["level"], record["msg"])
+	}
+	if record["queue"] != "queue.direct" || record["attempt"] != float64(2) {
+		t.Errorf("attrs = %v", record)
+	}
+	source, _ := record["source"].(map[string]interface{})
+	if file, _ := source["file"].(string); !strings.HasSuffix(file, "slog_test.go") {
+		t.Errorf("source = %v, want the caller of warn", source)
+	}
+}
+
+func TestConnection_SetLogger(t *testing.T) {
+	var global, local bytes.Buffer
+	old := _default
+	defer SetLogger(old)
+	SetLogOutput(&global)
+
+	conn := NewConnection(defaultURL, nil).SetLogger(NewPrintLogger(&local))
+	conn.warn("connection log")
+	NewConnection(defaultURL, nil).warn("global log")
+
+	if !strings.Contains(local.String(), "connection log") || strings.Contains(local.String(), "global log") {
+		t.Errorf("connection logger output = %q", local.String())
+	}
+	if !strings.Contains(global.String(), "global log") || strings.Contains(global.String(), "connection log") {
+		t.Errorf("global logger output = %q", global.String())
+	}
+}
@@ -0,0 +1,219 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"context"
+	"sync"
+)
+
+// subscriptionTag 用于生成 Subscription 默认的 consumer tag
+var subscriptionTag = NewDefaultSAdder()
+
+// Subscription 由 Consumer.Receive 返回，用于控制订阅。
+//
+// 订阅对应的 Operation 会一直保留在 Connection 中（断线重连后会自动重新订阅），
+// 直到调用 Stop、ConsumerFunc 主动放弃接收、Channel 被正常关闭，或者发生了重连也无法恢复的错误
+// （如队列不存在、没有权限等 Channel 异常）。
+type Subscription struct {
+	c               *Connection
+	lis             ReceiveListener
+	key             string // Operation 的 key
+	tag             string // consumer tag
+	mut             sync.Mutex
+	cond            *sync.Cond
+	ch              *Channel // 正在消费的 Channel，未在消费时为 nil
+	gen             uint64   // Operation 的执行次数，用于让断线前暂停的旧协程退出
+	paused, stopped bool
+	done            chan struct{}
+	err             error
+	once            sync.Once
+}
+
+func newSubscription(c *Connection, lis ReceiveListener) *Subscription {
+	s := &Subscription{c: c, lis: lis, done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mut)
+	return s
+}
+
+// run 在 Operation 中执行订阅。receive 返回 ConsumerFunc 是否主动放弃接收，以及订阅结束的原因。
+func (s *Subscription) run(ch *Channel, receive func() (brk bool, err error)) {
+	s.mut.Lock()
+	s.gen++
+	gen := s.gen
+	s.cond.Broadcast()
+	s.mut.Unlock()
+	for {
+		active, stopped := s.waitResume(gen)
+		if stopped {
+			s.finish(nil, nil)
+		}
+		if !active {
+			return
+		}
+		brk, err := receive()
+
+		s.mut.Lock()
+		if s.ch == ch {
+			// 断线后新的 Operation 可能已经开始消费，不能覆盖它的 Channel
+			s.ch = nil
+		}
+		stopped, paused := s.stopped, s.paused
+		s.mut.Unlock()
+		switch {
+		case stopped || brk:
+			s.finish(ch, nil)
+			return
+		case err == nil && paused:
+			// 暂停时取消了订阅，等待恢复
+			continue
+		case err == nil:
+			// Channel 被正常关闭
+			s.finish(ch, nil)
+			return
+		case !isConnectedErr(err):
+			// 连接没有断开，不会有重连来重新执行 Operation，订阅无法恢复
+			s.finish(ch, err)
+			return
+		default:
+			// 保留 Operation，重连成功后会重新执行
+			s.mut.Lock()
+			s.err = err
+			s.mut.Unlock()
+			s.lis.Finish(err)
+			return
+		}
+	}
+}
+
+// waitResume 等待恢复订阅。返回值 active 为 false 表示订阅已停止，或者已经有新的 Operation 在执行。
+func (s *Subscription) waitResume(gen uint64) (active, stopped bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for s.paused && !s.stopped && s.gen == gen {
+		s.cond.Wait()
+	}
+	return !s.stopped && s.gen == gen, s.stopped
+}
+
+// consuming 在订阅成功后调用。如果在订阅期间调用了 Stop 或 Pause，立即取消订阅。
+func (s *Subscription) consuming(ch *Channel) {
+	s.mut.Lock()
+	s.ch = ch
+	s.err = nil // 订阅已经恢复
+	cancel := s.stopped || s.paused
+	s.mut.Unlock()
+	if cancel {
+		s.cancel(ch)
+	}
+}
+
+func (s *Subscription) cancel(ch *Channel) {
+	if err := ch.Cancel(s.tag, false); err != nil {
+		s.c.debug("cancel consumer failed:", err, ch.logField(), consumerField(s.tag))
+	}
+}
+
+// finish 移除 Operation 并结束订阅。如果已经记录了中断的原因（如断线期间调用了 Stop），则保留该原因。
+func (s *Subscription) finish(ch *Channel, err error) {
+	s.once.Do(func() {
+		if ch != nil {
+			s.lis.Remove(s.key, ch)
+		}
+		// 无论 ReceiveListener.Remove 如何实现，都要确保 Operation 被移除
+		s.c.RemoveOperation(s.key)
+		s.c.removeSubscription(s)
+		s.mut.Lock()
+		if s.err == nil {
+			s.err = err
+		}
+		s.mut.Unlock()
+		s.lis.Finish(err)
+		close(s.done)
+	})
+}
+
+// Stop 取消订阅（basic.cancel），等待正在处理的消息处理完毕，并移除对应的 Operation，
+// 之后断线重连也不会再重新订阅。ctx 结束时不再等待，返回 ctx.Err()，但订阅仍然会被停止。
+func (s *Subscription) Stop(ctx context.Context) error {
+	s.mut.Lock()
+	s.stopped = true
+	ch := s.ch
+	s.cond.Broadcast()
+	s.mut.Unlock()
+	if ch != nil {
+		s.cancel(ch)
+	} else {
+		// 断线或暂停期间没有正在消费的 Channel
+		s.finish(nil, nil)
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Pause 暂停消费。暂停期间会取消订阅，服务器不再投递消息，但 Operation 仍会保留。
+func (s *Subscription) Pause() {
+	s.mut.Lock()
+	if s.paused || s.stopped {
+		s.mut.Unlock()
+		return
+	}
+	s.paused = true
+	ch := s.ch
+	s.mut.Unlock()
+	if ch != nil {
+		s.cancel(ch)
+	}
+}
+
+// Resume 恢复被 Pause 暂停的消费
+func (s *Subscription) Resume() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.paused = false
+	s.cond.Broadcast()
+}
+
+// stopping 返回是否已经调用了 Stop
+func (s *Subscription) stopping() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.stopped
+}
+
+// state 返回订阅是否正在消费，以及是否被暂停
+func (s *Subscription) state() (running, paused bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.ch != nil, s.paused
+}
+
+// Done 返回一个 channel，订阅结束后会被关闭
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err 返回订阅结束（或最近一次中断）的原因。正常停止时返回 nil；如果在中断期间停止，返回中断的原因。
+func (s *Subscription) Err() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.err
+}
@@ -0,0 +1,109 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+	"ezmq/ezmqtest"
+)
+
+func TestSubscription_missingQueue(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	finished := make(chan error, 1)
+	sub := conn.Consumer().Receive("missing", nil, &ezmq.AbsReceiveListener{
+		ConsumerMethod: func(*amqp.Delivery) bool { return false },
+		FinishMethod:   func(err error) { finished <- err },
+	})
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscription to a missing queue is not done")
+	}
+	var amqpErr *amqp.Error
+	if err := sub.Err(); !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Fatalf("Err() = %v, want NOT_FOUND", err)
+	}
+	if err := <-finished; err == nil {
+		t.Error("Finish() error = nil, want NOT_FOUND")
+	}
+	// Stop 不能覆盖订阅结束的原因
+	if err := sub.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if err := sub.Err(); !errors.As(err, &amqpErr) {
+		t.Errorf("Err() after Stop = %v, want NOT_FOUND", err)
+	}
+}
+
+func TestSubscription_stopWhileResubscribing(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err = ch.QueueDeclare("orders", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled := make(chan struct{}, 1)
+	sub := conn.Consumer().Receive("orders", nil, &ezmq.AbsReceiveListener{
+		ConsumerMethod: func(*amqp.Delivery) bool { return false },
+		CancelMethod:   func(error) { canceled <- struct{}{} },
+	})
+	deadline := time.Now().Add(time.Second)
+	for b.Consumers("orders") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscription is not consuming")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// 删除队列后，订阅会一直等待队列重新可用
+	b.DeleteQueue("orders")
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("consumer is not canceled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sub.Stop(ctx); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if err := sub.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+}
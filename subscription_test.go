@@ -0,0 +1,105 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestListener(finished *int32) *AbsReceiveListener {
+	return &AbsReceiveListener{
+		ConsumerMethod: func(*amqp.Delivery) bool { return false },
+		FinishMethod:   func(error) { atomic.AddInt32(finished, 1) },
+	}
+}
+
+func TestSubscription_Stop_disconnected(t *testing.T) {
+	// 未连接的 Connection，Operation 会在重连成功后执行
+	conn := NewConnection(defaultURL, nil)
+	var finished int32
+	sub := conn.Consumer().Receive("queue.direct", nil, newTestListener(&finished))
+	if len(conn.operations) != 1 {
+		t.Fatalf("len(operations) = %d, want 1", len(conn.operations))
+	}
+	if err := sub.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	select {
+	case <-sub.Done():
+	default:
+		t.Error("Done() should be closed after Stop()")
+	}
+	if len(conn.operations) != 0 {
+		t.Errorf("len(operations) = %d, want 0", len(conn.operations))
+	}
+	if finished != 1 {
+		t.Errorf("Finish called %d times, want 1", finished)
+	}
+}
+
+func TestSubscription_PauseResume(t *testing.T) {
+	conn := NewConnection(defaultURL, nil)
+	var finished int32
+	sub := newSubscription(conn, newTestListener(&finished))
+	sub.key = conn.addOperation(func(string, *Channel) {})
+
+	sub.Pause()
+	var received int32
+	go sub.run(nil, func() (bool, error) {
+		atomic.AddInt32(&received, 1)
+		return true, nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&received); n != 0 {
+		t.Fatalf("received %d times while paused, want 0", n)
+	}
+	sub.Resume()
+	select {
+	case <-sub.Done():
+	case <-time.After(time.Second):
+		t.Fatal("subscription should finish after the consumer breaks")
+	}
+	if received != 1 || len(conn.operations) != 0 {
+		t.Errorf("received = %d, len(operations) = %d, want 1, 0", received, len(conn.operations))
+	}
+}
+
+func TestSubscription_run_err(t *testing.T) {
+	conn := NewConnection(defaultURL, nil)
+	var finished int32
+	sub := newSubscription(conn, newTestListener(&finished))
+	sub.key = conn.addOperation(func(string, *Channel) {})
+
+	sub.run(nil, func() (bool, error) { return false, amqp.ErrClosed })
+	if !errors.Is(sub.Err(), amqp.ErrClosed) {
+		t.Errorf("Err() = %v, want %v", sub.Err(), amqp.ErrClosed)
+	}
+	select {
+	case <-sub.Done():
+		t.Error("Done() should not be closed, the Operation is kept for reconnection")
+	default:
+	}
+	if len(conn.operations) != 1 || finished != 1 {
+		t.Errorf("len(operations) = %d, finished = %d, want 1, 1", len(conn.operations), finished)
+	}
+}
@@ -0,0 +1,537 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrTopologyConflict = errors.New("topology conflicts with existing declarations")
+
+// Topology 声明式的拓扑定义，包括交换器、队列、绑定和策略。可以通过 LoadTopology 从 YAML 或 JSON 文件加载，例如：
+//
+//	exchanges:
+//	  - name: events
+//	    type: topic
+//	queues:
+//	  - name: orders
+//	    arguments:
+//	      x-queue-type: quorum
+//	      x-message-ttl: 60000
+//	bindings:
+//	  - source: events
+//	    destination: orders
+//	    routing_key: order.*
+//
+// 交换器和队列默认是持久化的，交换器的类型默认为 direct，绑定的目标类型默认为 queue。
+//
+// 注意：策略（policy）无法通过 AMQP 协议设置，Plan 和 Apply 会跳过策略，需要通过管理插件的 HTTP API 设置。
+type Topology struct {
+	Exchanges []ExchangeDef `json:"exchanges,omitempty"`
+	Queues    []QueueDef    `json:"queues,omitempty"`
+	Bindings  []BindingDef  `json:"bindings,omitempty"`
+	Policies  []PolicyDef   `json:"policies,omitempty"`
+}
+
+type ExchangeDef struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Internal   bool       `json:"internal"`
+	Arguments  amqp.Table `json:"arguments,omitempty"`
+}
+
+func (d *ExchangeDef) UnmarshalJSON(data []byte) error {
+	type def ExchangeDef
+	v := def{Type: amqp.ExchangeDirect, Durable: true}
+	if err := decodeStrict(data, &v); err != nil {
+		return err
+	}
+	*d = ExchangeDef(v)
+	return nil
+}
+
+type QueueDef struct {
+	Name       string     `json:"name"`
+	Durable    bool       `json:"durable"`
+	AutoDelete bool       `json:"auto_delete"`
+	Exclusive  bool       `json:"exclusive"`
+	Arguments  amqp.Table `json:"arguments,omitempty"`
+}
+
+func (d *QueueDef) UnmarshalJSON(data []byte) error {
+	type def QueueDef
+	v := def{Durable: true}
+	if err := decodeStrict(data, &v); err != nil {
+		return err
+	}
+	*d = QueueDef(v)
+	return nil
+}
+
+// 绑定的目标类型
+const (
+	DestinationQueue    = "queue"
+	DestinationExchange = "exchange"
+)
+
+type BindingDef struct {
+	Source          string     `json:"source"`
+	Destination     string     `json:"destination"`
+	DestinationType string     `json:"destination_type"` // queue 或 exchange
+	RoutingKey      string     `json:"routing_key"`
+	Arguments       amqp.Table `json:"arguments,omitempty"`
+}
+
+func (d *BindingDef) UnmarshalJSON(data []byte) error {
+	type def BindingDef
+	v := def{DestinationType: DestinationQueue}
+	if err := decodeStrict(data, &v); err != nil {
+		return err
+	}
+	*d = BindingDef(v)
+	return nil
+}
+
+// PolicyDef 策略定义，格式与管理插件的 HTTP API 相同
+type PolicyDef struct {
+	Name       string     `json:"name"`
+	Pattern    string     `json:"pattern"`
+	ApplyTo    string     `json:"apply_to,omitempty"` // queues、exchanges 或 all
+	Priority   int        `json:"priority,omitempty"`
+	Definition amqp.Table `json:"definition"`
+}
+
+// LoadTopology 从 YAML 或 JSON 加载拓扑定义，并校验其中的内容。以 { 开头的内容会被视为 JSON，否则视为 YAML。
+// YAML 只支持拓扑文件所需的子集，不支持锚点、别名、标签和多行标量。
+func LoadTopology(r io.Reader) (*Topology, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		v, err := parseYAML(data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	t := &Topology{}
+	if err = decodeStrict(data, t); err != nil {
+		return nil, fmt.Errorf("invalid topology: %w", err)
+	}
+	if err = t.normalize(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// decodeStrict 解析 JSON，数字解析为 json.Number，且不允许未知的字段。
+// 实现了 json.Unmarshaler 的类型不会继承外层 Decoder 的设置，因此也需要使用该方法解析。
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// LoadTopologyFile 从文件加载拓扑定义，详见 LoadTopology
+func LoadTopologyFile(path string) (*Topology, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadTopology(f)
+}
+
+// normalize 将 JSON 解析出的数字转换为 int64 或 float64，并校验拓扑定义
+func (t *Topology) normalize() (err error) {
+	for i := range t.Exchanges {
+		if t.Exchanges[i].Arguments, err = normalizeTable(t.Exchanges[i].Arguments); err != nil {
+			return err
+		}
+	}
+	for i := range t.Queues {
+		if t.Queues[i].Arguments, err = normalizeTable(t.Queues[i].Arguments); err != nil {
+			return err
+		}
+	}
+	for i := range t.Bindings {
+		if t.Bindings[i].Arguments, err = normalizeTable(t.Bindings[i].Arguments); err != nil {
+			return err
+		}
+	}
+	for i := range t.Policies {
+		if t.Policies[i].Definition, err = normalizeTable(t.Policies[i].Definition); err != nil {
+			return err
+		}
+	}
+	return t.Validate()
+}
+
+func normalizeTable(table amqp.Table) (amqp.Table, error) {
+	if table == nil {
+		return nil, nil
+	}
+	v, err := normalizeValue(map[string]interface{}(table))
+	if err != nil {
+		return nil, err
+	}
+	return v.(amqp.Table), nil
+}
+
+func normalizeValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case map[string]interface{}:
+		table := make(amqp.Table, len(v))
+		for k, e := range v {
+			n, err := normalizeValue(e)
+			if err != nil {
+				return nil, err
+			}
+			table[k] = n
+		}
+		return table, nil
+	case amqp.Table:
+		return normalizeValue(map[string]interface{}(v))
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			n, err := normalizeValue(e)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = n
+		}
+		return s, nil
+	}
+	return v, nil
+}
+
+// 常用队列参数的类型
+var queueArgumentKinds = map[string]string{
+	"x-message-ttl":             "an integer",
+	"x-expires":                 "an integer",
+	"x-max-length":              "an integer",
+	"x-max-length-bytes":        "an integer",
+	"x-max-priority":            "an integer",
+	"x-delivery-limit":          "an integer",
+	"x-dead-letter-exchange":    "a string",
+	"x-dead-letter-routing-key": "a string",
+	"x-overflow":                "a string",
+	"x-queue-mode":              "a string",
+	"x-queue-type":              "a string",
+	"x-single-active-consumer":  "a boolean",
+}
+
+func checkArgumentKind(key string, v interface{}) error {
+	want, ok := queueArgumentKinds[key]
+	if !ok {
+		return nil
+	}
+	var kind string
+	switch v.(type) {
+	case int64:
+		kind = "an integer"
+	case string:
+		kind = "a string"
+	case bool:
+		kind = "a boolean"
+	}
+	if kind != want {
+		return fmt.Errorf("argument %s must be %s, got %v", key, want, v)
+	}
+	return nil
+}
+
+// Validate 校验拓扑定义：名称不能为空或重复，队列参数的类型正确，绑定引用的交换器和队列必须已定义或者是预定义的交换器。
+// 通过 LoadTopology 加载时会自动校验。
+func (t *Topology) Validate() error {
+	var errs []string
+	exchanges := map[string]bool{"": true}
+	for _, ex := range t.Exchanges {
+		switch {
+		case ex.Name == "":
+			errs = append(errs, "exchange name must not be empty")
+		case exchanges[ex.Name]:
+			errs = append(errs, fmt.Sprintf("exchange %s: declared more than once", ex.Name))
+		}
+		if ex.Type == "" {
+			errs = append(errs, fmt.Sprintf("exchange %s: type must not be empty", ex.Name))
+		}
+		exchanges[ex.Name] = true
+	}
+	queues := map[string]bool{}
+	for _, q := range t.Queues {
+		switch {
+		case q.Name == "":
+			errs = append(errs, "queue name must not be empty")
+		case queues[q.Name]:
+			errs = append(errs, fmt.Sprintf("queue %s: declared more than once", q.Name))
+		}
+		queues[q.Name] = true
+		for _, k := range sortedKeys(q.Arguments) {
+			if err := checkArgumentKind(k, q.Arguments[k]); err != nil {
+				errs = append(errs, fmt.Sprintf("queue %s: %v", q.Name, err))
+			}
+		}
+	}
+	for _, b := range t.Bindings {
+		name := b.String()
+		if b.Source == "" {
+			errs = append(errs, fmt.Sprintf("binding %s: cannot bind to the default exchange", name))
+		} else if !exchanges[b.Source] && !isPredefinedExchange(b.Source) {
+			errs = append(errs, fmt.Sprintf("binding %s: exchange %s is not declared", name, b.Source))
+		}
+		switch b.DestinationType {
+		case DestinationQueue:
+			if !queues[b.Destination] {
+				errs = append(errs, fmt.Sprintf("binding %s: queue %s is not declared", name, b.Destination))
+			}
+		case DestinationExchange:
+			if !exchanges[b.Destination] && !isPredefinedExchange(b.Destination) {
+				errs = append(errs, fmt.Sprintf("binding %s: exchange %s is not declared", name, b.Destination))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("binding %s: invalid destination type %q", name, b.DestinationType))
+		}
+	}
+	for _, p := range t.Policies {
+		if p.Name == "" || p.Pattern == "" {
+			errs = append(errs, "policy name and pattern must not be empty")
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid topology: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func isPredefinedExchange(name string) bool {
+	return strings.HasPrefix(name, "amq.")
+}
+
+func (b BindingDef) String() string {
+	s := fmt.Sprintf("%s -> %s %s", b.Source, b.DestinationType, b.Destination)
+	if b.RoutingKey != "" {
+		s += " (" + b.RoutingKey + ")"
+	}
+	return s
+}
+
+// TopologyAction 拓扑变更的类型
+type TopologyAction string
+
+const (
+	TopologyCreate    TopologyAction = "create"    // 不存在，将被创建
+	TopologyUnchanged TopologyAction = "unchanged" // 已存在且定义相同
+	TopologyConflict  TopologyAction = "conflict"  // 已存在但定义不同（PRECONDITION_FAILED），或者无权访问
+	TopologyBind      TopologyAction = "bind"      // 绑定，AMQP 协议无法查询绑定是否存在，绑定本身是幂等的
+	TopologySkip      TopologyAction = "skip"      // 无法通过 AMQP 协议应用，如策略
+)
+
+// TopologyChange 拓扑中的一项变更
+type TopologyChange struct {
+	Action TopologyAction `json:"action"`
+	Kind   string         `json:"kind"` // exchange、queue、binding 或 policy
+	Name   string         `json:"name"`
+	Reason string         `json:"reason,omitempty"`
+}
+
+func (c TopologyChange) String() string {
+	s := fmt.Sprintf("%-9s %s %s", c.Action, c.Kind, c.Name)
+	if c.Reason != "" {
+		s += ": " + c.Reason
+	}
+	return s
+}
+
+// TopologyPlan Plan 和 Apply 的结果，按照交换器、队列、绑定、策略的顺序列出所有变更
+type TopologyPlan struct {
+	Changes []TopologyChange `json:"changes"`
+}
+
+// Conflicts 返回所有冲突的变更
+func (p *TopologyPlan) Conflicts() []TopologyChange {
+	var conflicts []TopologyChange
+	for _, c := range p.Changes {
+		if c.Action == TopologyConflict {
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+func (p *TopologyPlan) String() string {
+	var sb strings.Builder
+	for _, c := range p.Changes {
+		sb.WriteString(c.String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func (p *TopologyPlan) add(action TopologyAction, kind, name, reason string) {
+	p.Changes = append(p.Changes, TopologyChange{Action: action, Kind: kind, Name: name, Reason: reason})
+}
+
+// Plan 对比拓扑定义与服务器上已有的声明，返回需要执行的变更，不会修改服务器上的任何内容。
+//
+// 对于已存在的交换器和队列，会使用相同的定义再次声明：定义相同时声明是幂等的，定义不同时服务器会返回 PRECONDITION_FAILED，
+// 并关闭用于检查的 Channel，不会修改已有的声明。
+func (t *Topology) Plan(c *Connection) (*TopologyPlan, error) {
+	plan := &TopologyPlan{}
+	for _, ex := range t.Exchanges {
+		ex := ex
+		action, reason, err := probeDeclare(c,
+			func(ch *Channel) error {
+				return ch.ExchangeDeclarePassive(ex.Name, ex.Type, ex.Durable, ex.AutoDelete, ex.Internal, false, nil)
+			},
+			func(ch *Channel) error {
+				return ch.ExchangeDeclare(ex.Name, ex.Type, ex.Durable, ex.AutoDelete, ex.Internal, false, ex.Arguments)
+			})
+		if err != nil {
+			return nil, fmt.Errorf("plan exchange %s: %w", ex.Name, err)
+		}
+		plan.add(action, "exchange", ex.Name, reason)
+	}
+	for _, q := range t.Queues {
+		q := q
+		action, reason, err := probeDeclare(c,
+			func(ch *Channel) error {
+				_, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, nil)
+				return err
+			},
+			func(ch *Channel) error {
+				_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Arguments)
+				return err
+			})
+		if err != nil {
+			return nil, fmt.Errorf("plan queue %s: %w", q.Name, err)
+		}
+		plan.add(action, "queue", q.Name, reason)
+	}
+	for _, b := range t.Bindings {
+		plan.add(TopologyBind, "binding", b.String(), "")
+	}
+	for _, p := range t.Policies {
+		plan.add(TopologySkip, "policy", p.Name, "policies can only be set through the management HTTP API")
+	}
+	return plan, nil
+}
+
+// probeDeclare 使用 passive 声明检查是否存在，如果存在，再使用相同的定义声明以检查是否冲突
+func probeDeclare(c *Connection, passive, declare func(ch *Channel) error) (TopologyAction, string, error) {
+	err := withProbeChannel(c, passive)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return TopologyCreate, "", nil
+	}
+	if err == nil {
+		err = withProbeChannel(c, declare)
+		if err == nil {
+			return TopologyUnchanged, "", nil
+		}
+	}
+	if errors.As(err, &amqpErr) && isDeclareConflict(amqpErr.Code) {
+		return TopologyConflict, amqpErr.Reason, nil
+	}
+	return "", "", err
+}
+
+func isDeclareConflict(code int) bool {
+	return code == amqp.PreconditionFailed || code == amqp.AccessRefused || code == amqp.ResourceLocked
+}
+
+// withProbeChannel 使用新的 Channel 执行 fn。声明失败时服务器会关闭 Channel，因此每次检查都需要新的 Channel。
+func withProbeChannel(c *Connection, fn func(ch *Channel) error) error {
+	ch, err := c.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+// Apply 按照交换器、队列、绑定的顺序应用拓扑定义，返回执行的变更。
+//
+// 应用前会先执行 Plan，如果存在冲突，返回包装了 ErrTopologyConflict 的 error，不会修改服务器上的任何内容。
+// 已存在且定义相同的交换器和队列不会被重新声明。重复应用相同的拓扑定义是幂等的。
+func (t *Topology) Apply(c *Connection) (*TopologyPlan, error) {
+	plan, err := t.Plan(c)
+	if err != nil {
+		return nil, err
+	}
+	if conflicts := plan.Conflicts(); len(conflicts) > 0 {
+		reasons := make([]string, len(conflicts))
+		for i, conflict := range conflicts {
+			reasons[i] = conflict.String()
+		}
+		return plan, fmt.Errorf("%w: %s", ErrTopologyConflict, strings.Join(reasons, "; "))
+	}
+
+	ch, err := c.Channel()
+	if err != nil {
+		return plan, err
+	}
+	defer ch.Close()
+	changes := plan.Changes
+	for _, ex := range t.Exchanges {
+		if changes[0].Action == TopologyCreate {
+			if err = ch.ExchangeDeclare(ex.Name, ex.Type, ex.Durable, ex.AutoDelete, ex.Internal, false, ex.Arguments); err != nil {
+				return plan, fmt.Errorf("declare exchange %s: %w", ex.Name, err)
+			}
+		}
+		changes = changes[1:]
+	}
+	for _, q := range t.Queues {
+		if changes[0].Action == TopologyCreate {
+			if _, err = ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.Arguments); err != nil {
+				return plan, fmt.Errorf("declare queue %s: %w", q.Name, err)
+			}
+		}
+		changes = changes[1:]
+	}
+	for _, b := range t.Bindings {
+		if b.DestinationType == DestinationExchange {
+			err = ch.ExchangeBind(b.Destination, b.RoutingKey, b.Source, false, b.Arguments)
+		} else {
+			err = ch.QueueBind(b.Destination, b.RoutingKey, b.Source, false, b.Arguments)
+		}
+		if err != nil {
+			return plan, fmt.Errorf("bind %s: %w", b, err)
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,140 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+	"ezmq/ezmqtest"
+)
+
+const topology = `
+exchanges:
+  - name: events
+    type: topic
+queues:
+  - name: orders
+    arguments:
+      x-max-length: 10
+bindings:
+  - source: events
+    destination: orders
+    routing_key: order.*
+policies:
+  - name: ttl
+    pattern: ".*"
+    definition: {message-ttl: 1000}
+`
+
+func loadTopology(t *testing.T, s string) *ezmq.Topology {
+	t.Helper()
+	top, err := ezmq.LoadTopology(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return top
+}
+
+func actions(plan *ezmq.TopologyPlan) string {
+	var s []string
+	for _, c := range plan.Changes {
+		s = append(s, string(c.Action)+" "+c.Kind+" "+c.Name)
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestTopology_apply(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	top := loadTopology(t, topology)
+
+	plan, err := top.Plan(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "create exchange events, create queue orders, bind binding events -> queue orders (order.*), skip policy ttl"
+	if got := actions(plan); got != want {
+		t.Errorf("Plan() = %s\nwant %s", got, want)
+	}
+	if b.HasExchange("events") || b.HasQueue("orders") {
+		t.Fatal("Plan() changed the broker")
+	}
+
+	if _, err = top.Apply(conn); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if err = ch.Publish("events", "order.created", false, false, amqp.Publishing{Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.QueueDepth("orders"); n != 1 {
+		t.Errorf("QueueDepth() = %d, want 1", n)
+	}
+
+	// 重复应用是幂等的
+	plan, err = top.Apply(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions(plan); !strings.HasPrefix(got, "unchanged exchange events, unchanged queue orders") {
+		t.Errorf("Apply() = %s", got)
+	}
+}
+
+func TestTopology_conflict(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	conn := b.NewConnection(ezmq.NewTimesRetry(true, 10*time.Millisecond, 0))
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err = ch.QueueDeclare("orders", false, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	top := loadTopology(t, topology)
+	plan, err := top.Apply(conn)
+	if !errors.Is(err, ezmq.ErrTopologyConflict) {
+		t.Fatalf("Apply() error = %v, want ErrTopologyConflict", err)
+	}
+	conflicts := plan.Conflicts()
+	if len(conflicts) != 1 || conflicts[0].Name != "orders" || !strings.Contains(conflicts[0].Reason, "PRECONDITION_FAILED") {
+		t.Errorf("Conflicts() = %+v", conflicts)
+	}
+	if b.HasExchange("events") {
+		t.Error("Apply() changed the broker despite conflicts")
+	}
+}
@@ -0,0 +1,117 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const topologyYAML = `
+exchanges:
+  - name: events
+    type: topic
+  - name: dlx
+    type: fanout
+    durable: false
+queues:
+  - name: orders
+    arguments:
+      x-queue-type: quorum
+      x-message-ttl: 60000
+      x-dead-letter-exchange: dlx
+  - name: orders.dlq
+bindings:
+  - source: events
+    destination: orders
+    routing_key: order.*
+  - source: dlx
+    destination: orders.dlq
+  - {source: amq.topic, destination: events, destination_type: exchange, routing_key: "#"}
+policies:
+  - name: max-length
+    pattern: ^orders$
+    apply_to: queues
+    definition: {max-length: 1000}
+`
+
+const topologyJSON = `{
+  "exchanges": [{"name": "events", "type": "topic"}, {"name": "dlx", "type": "fanout", "durable": false}],
+  "queues": [
+    {"name": "orders", "arguments": {"x-queue-type": "quorum", "x-message-ttl": 60000, "x-dead-letter-exchange": "dlx"}},
+    {"name": "orders.dlq"}
+  ],
+  "bindings": [
+    {"source": "events", "destination": "orders", "routing_key": "order.*"},
+    {"source": "dlx", "destination": "orders.dlq"},
+    {"source": "amq.topic", "destination": "events", "destination_type": "exchange", "routing_key": "#"}
+  ],
+  "policies": [{"name": "max-length", "pattern": "^orders$", "apply_to": "queues", "definition": {"max-length": 1000}}]
+}`
+
+func TestLoadTopology(t *testing.T) {
+	fromYAML, err := LoadTopology(strings.NewReader(topologyYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := LoadTopology(strings.NewReader(topologyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("YAML = %+v\nJSON = %+v", fromYAML, fromJSON)
+	}
+
+	want := ExchangeDef{Name: "events", Type: "topic", Durable: true}
+	if !reflect.DeepEqual(fromYAML.Exchanges[0], want) {
+		t.Errorf("Exchanges[0] = %+v, want %+v", fromYAML.Exchanges[0], want)
+	}
+	q := fromYAML.Queues[0]
+	if !q.Durable || q.Arguments["x-message-ttl"] != int64(60000) {
+		t.Errorf("Queues[0] = %+v", q)
+	}
+	if b := fromYAML.Bindings[1]; b.DestinationType != DestinationQueue || b.RoutingKey != "" {
+		t.Errorf("Bindings[1] = %+v", b)
+	}
+	if d := fromYAML.Policies[0].Definition; !reflect.DeepEqual(d, amqp.Table{"max-length": int64(1000)}) {
+		t.Errorf("Policies[0].Definition = %#v", d)
+	}
+}
+
+func TestLoadTopology_invalid(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"queues:\n  - name: q\n    arguments: {x-message-ttl: '60000'}", "queue q: argument x-message-ttl must be an integer"},
+		{"queues:\n  - name: q\n  - name: q", "queue q: declared more than once"},
+		{"exchanges:\n  - type: topic", "exchange name must not be empty"},
+		{"bindings:\n  - {source: missing, destination: q}", "exchange missing is not declared"},
+		{"bindings:\n  - {source: amq.direct, destination: q}", "queue q is not declared"},
+		{"bindings:\n  - {source: '', destination: q}", "cannot bind to the default exchange"},
+		{"queue:\n  - name: q", `unknown field "queue"`},
+		{`{"queues": [{"name": 1}]}`, "invalid topology"},
+	}
+	for _, tt := range tests {
+		_, err := LoadTopology(strings.NewReader(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("LoadTopology(%q) error = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
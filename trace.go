@@ -0,0 +1,285 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	HeaderTraceParent = "traceparent"
+	HeaderTraceState  = "tracestate"
+)
+
+// HeaderCarrier 以消息头作为链路上下文的载体。
+//
+// HeaderCarrier 的方法与 OpenTelemetry 的 propagation.TextMapCarrier 相同，
+// 因此可以直接将其传给 OpenTelemetry 的 TextMapPropagator。
+type HeaderCarrier amqp.Table
+
+func (c HeaderCarrier) Get(key string) string {
+	switch v := c[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func (c HeaderCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Propagator 在消息头中注入和提取链路上下文。
+//
+// 可以通过包装 OpenTelemetry 的 TextMapPropagator 接入 OpenTelemetry：
+//
+//	type otelPropagator struct{ p propagation.TextMapPropagator }
+//
+//	func (o otelPropagator) Inject(ctx context.Context, c ezmq.HeaderCarrier) { o.p.Inject(ctx, c) }
+//	func (o otelPropagator) Extract(ctx context.Context, c ezmq.HeaderCarrier) context.Context {
+//		return o.p.Extract(ctx, c)
+//	}
+type Propagator interface {
+	// Inject 将 ctx 中的链路上下文写入 carrier
+	Inject(ctx context.Context, carrier HeaderCarrier)
+	// Extract 从 carrier 中读取链路上下文，返回包含该上下文的 ctx
+	Extract(ctx context.Context, carrier HeaderCarrier) context.Context
+}
+
+// SpanKind Span 的类型
+type SpanKind int
+
+const (
+	SpanKindProducer SpanKind = iota + 1
+	SpanKindConsumer
+)
+
+// Tracer 创建 Span 的最小接口，用于接入 OpenTelemetry 等链路追踪系统
+type Tracer interface {
+	// Start 创建 Span，并返回包含该 Span 的 ctx。fields 为 Span 的属性，如 messaging.destination.name。
+	// 生产者 Span 返回的 ctx 会被注入到消息头中，消费者 Span 返回的 ctx 会被传给消费者。
+	Start(ctx context.Context, name string, kind SpanKind, fields ...Field) (context.Context, Span)
+}
+
+// Span 链路中的一个操作
+type Span interface {
+	// End 结束 Span。err 不为 nil 表示操作失败
+	End(err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _ string, _ SpanKind, _ ...Field) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(error) {}
+
+var (
+	_propagator Propagator = TraceContext{}
+	_tracer     Tracer     = noopTracer{}
+)
+
+// SetTracing 设置全局的 Propagator 和 Tracer。
+// propagator 为 nil 时使用 TraceContext；tracer 为 nil 时不创建 Span，仅透传链路上下文。
+func SetTracing(propagator Propagator, tracer Tracer) {
+	_propagator, _tracer = nonNilTracing(propagator, tracer)
+}
+
+// SetTracing 设置该 Connection 及其创建的 Channel 使用的 Propagator 和 Tracer，必须在 Dial 之前调用。
+// 两者均为 nil 时使用全局的配置（见 SetTracing）。
+func (c *Connection) SetTracing(propagator Propagator, tracer Tracer) *Connection {
+	if propagator == nil && tracer == nil {
+		c.propagator, c.tracer = nil, nil
+		return c
+	}
+	c.propagator, c.tracer = nonNilTracing(propagator, tracer)
+	return c
+}
+
+func nonNilTracing(propagator Propagator, tracer Tracer) (Propagator, Tracer) {
+	if propagator == nil {
+		propagator = TraceContext{}
+	}
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+	return propagator, tracer
+}
+
+// tracing 返回 Connection 使用的 Propagator 和 Tracer。c 为 nil 或者没有设置时，返回全局的配置。
+func (c *Connection) tracing() (Propagator, Tracer) {
+	if c != nil && c.propagator != nil {
+		return c.propagator, c.tracer
+	}
+	return _propagator, _tracer
+}
+
+// injectHeaders 返回注入了 ctx 中链路上下文的消息头。ctx 中没有链路上下文时返回 nil。
+func injectHeaders(ctx context.Context, propagator Propagator) amqp.Table {
+	carrier := HeaderCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return amqp.Table(carrier)
+}
+
+// traceOpts 返回 opts 的副本，并将 ctx 中的链路上下文记录在副本中，发送时写入消息头
+func (c *Connection) traceOpts(ctx context.Context, opts *SendOpts) *SendOpts {
+	if opts == nil {
+		opts = DefaultSendOpts()
+	}
+	o := *opts
+	propagator, _ := c.tracing()
+	if headers := injectHeaders(ctx, propagator); headers != nil {
+		o.traceHeaders = headers
+	}
+	return &o
+}
+
+// startProducerSpan 创建发送消息的 Span
+func (c *Connection) startProducerSpan(ctx context.Context, exchange string, routingKey string) (context.Context, Span) {
+	_, tracer := c.tracing()
+	destination := exchange
+	if destination == "" {
+		destination = "amq.default"
+	}
+	return tracer.Start(ctx, destination+" publish", SpanKindProducer,
+		Field{Key: "messaging.system", Value: "rabbitmq"},
+		Field{Key: "messaging.operation", Value: "publish"},
+		Field{Key: "messaging.destination.name", Value: exchange},
+		Field{Key: "messaging.rabbitmq.destination.routing_key", Value: routingKey})
+}
+
+// startConsumerSpan 从消息头中提取链路上下文，并创建处理消息的 Span
+func (c *Connection) startConsumerSpan(queue string, delivery *amqp.Delivery) (context.Context, Span) {
+	propagator, tracer := c.tracing()
+	ctx := propagator.Extract(context.Background(), HeaderCarrier(delivery.Headers))
+	return tracer.Start(ctx, queue+" process", SpanKindConsumer,
+		Field{Key: "messaging.system", Value: "rabbitmq"},
+		Field{Key: "messaging.operation", Value: "process"},
+		Field{Key: "messaging.source.name", Value: queue},
+		Field{Key: "messaging.rabbitmq.destination.routing_key", Value: delivery.RoutingKey},
+		Field{Key: "messaging.message.id", Value: delivery.MessageId})
+}
+
+// SpanContext W3C Trace Context 中的链路上下文
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string // tracestate 的原始内容
+}
+
+// IsValid TraceID 和 SpanID 均不为全 0 时有效
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Sampled 是否设置了 sampled 标志
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&0x01 != 0
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext 返回包含 sc 的 ctx
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext 返回 ctx 中的链路上下文
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// TraceContext W3C Trace Context（traceparent/tracestate）格式的 Propagator，链路上下文以 SpanContext 的形式保存在 ctx 中。
+// 接入 OpenTelemetry 时，请使用 OpenTelemetry 的 Propagator 替代。
+type TraceContext struct{}
+
+func (TraceContext) Inject(ctx context.Context, carrier HeaderCarrier) {
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok {
+		return
+	}
+	carrier.Set(HeaderTraceParent, fmt.Sprintf("00-%x-%x-%02x", sc.TraceID, sc.SpanID, sc.Flags))
+	if sc.State != "" {
+		carrier.Set(HeaderTraceState, sc.State)
+	}
+}
+
+func (TraceContext) Extract(ctx context.Context, carrier HeaderCarrier) context.Context {
+	sc, ok := parseTraceParent(carrier.Get(HeaderTraceParent))
+	if !ok {
+		return ctx
+	}
+	sc.State = carrier.Get(HeaderTraceState)
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// parseTraceParent 解析 traceparent：version-trace_id-parent_id-flags
+func parseTraceParent(s string) (sc SpanContext, ok bool) {
+	// 版本 00 的长度固定为 55，更高的版本可能在末尾追加字段
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || (len(s) > 55 && s[55] != '-') {
+		return sc, false
+	}
+	version, ok := decodeLowerHex(s[0:2], 1)
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(s) != 55) {
+		return sc, false
+	}
+	traceID, ok1 := decodeLowerHex(s[3:35], 16)
+	spanID, ok2 := decodeLowerHex(s[36:52], 8)
+	flags, ok3 := decodeLowerHex(s[53:55], 1)
+	if !ok1 || !ok2 || !ok3 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+	return sc, sc.IsValid()
+}
+
+// decodeLowerHex 解码小写的十六进制字符串
+func decodeLowerHex(s string, n int) ([]byte, bool) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return nil, false
+		}
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil && len(b) == n
+}
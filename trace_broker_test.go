@@ -0,0 +1,105 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq_test
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"ezmq"
+	"ezmq/ezmqtest"
+)
+
+// recordingTracer 为每个 Span 生成新的 SpanID，并记录结束的 Span
+type recordingTracer struct {
+	mut   sync.Mutex
+	next  byte
+	spans []string
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, kind ezmq.SpanKind, _ ...ezmq.Field) (context.Context, ezmq.Span) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	sc, _ := ezmq.SpanContextFromContext(ctx)
+	t.next++
+	sc.SpanID = [8]byte{7: t.next}
+	return ezmq.ContextWithSpanContext(ctx, sc), spanFunc(func(err error) {
+		t.mut.Lock()
+		defer t.mut.Unlock()
+		t.spans = append(t.spans, name)
+	})
+}
+
+type spanFunc func(err error)
+
+func (f spanFunc) End(err error) { f(err) }
+
+func TestTracing(t *testing.T) {
+	b := ezmqtest.NewBroker()
+	tracer := &recordingTracer{}
+	conn := b.NewConnection(nil).SetTracing(nil, tracer)
+	if err := conn.Dial(); err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ch.Close()
+	if _, err = ch.QueueDeclare("queue.direct", true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan context.Context, 1)
+	conn.Consumer().Receive("queue.direct", nil, &ezmq.AbsReceiveListener{
+		ConsumerContextMethod: func(ctx context.Context, d *amqp.Delivery) bool {
+			received <- ctx
+			return false
+		}})
+
+	parent := ezmq.SpanContext{TraceID: [16]byte{0: 1}, SpanID: [8]byte{0: 1}, Flags: 1}
+	ctx := ezmq.ContextWithSpanContext(context.Background(), parent)
+	if err := conn.Producer().SendCtx(ctx, "", "queue.direct", []byte("hello"), nil); err != nil {
+		t.Fatalf("SendCtx() error = %v", err)
+	}
+	var got ezmq.SpanContext
+	select {
+	case ctx := <-received:
+		got, _ = ezmq.SpanContextFromContext(ctx)
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+	// 消费者 Span 与生产者 Span 属于同一条链路
+	if got.TraceID != parent.TraceID || got.SpanID != [8]byte{7: 2} {
+		t.Errorf("consumer span context = %+v", got)
+	}
+	waitFor(t, time.Second, func() bool {
+		tracer.mut.Lock()
+		defer tracer.mut.Unlock()
+		return len(tracer.spans) == 2
+	})
+	// 消费者可能先于生产者结束 Span
+	sort.Strings(tracer.spans)
+	if tracer.spans[0] != "amq.default publish" || tracer.spans[1] != "queue.direct process" {
+		t.Errorf("spans = %v", tracer.spans)
+	}
+}
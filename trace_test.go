@@ -0,0 +1,113 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"context"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"version 00 with extra", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"short", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := parseTraceParent(tt.header); ok != tt.want {
+				t.Errorf("parseTraceParent(%q) = %v, want %v", tt.header, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	carrier := HeaderCarrier{HeaderTraceParent: []byte(traceparent), HeaderTraceState: "congo=t61rcWkgMzE"}
+	ctx := TraceContext{}.Extract(context.Background(), carrier)
+	sc, ok := SpanContextFromContext(ctx)
+	if !ok || !sc.Sampled() || sc.State != "congo=t61rcWkgMzE" {
+		t.Fatalf("SpanContextFromContext() = %+v, %v", sc, ok)
+	}
+
+	out := HeaderCarrier{}
+	TraceContext{}.Inject(ctx, out)
+	if out.Get(HeaderTraceParent) != traceparent || out.Get(HeaderTraceState) != "congo=t61rcWkgMzE" {
+		t.Errorf("Inject() = %v", out)
+	}
+
+	empty := HeaderCarrier{}
+	TraceContext{}.Inject(context.Background(), empty)
+	if len(empty) != 0 {
+		t.Errorf("Inject() without span context = %v, want no headers", empty)
+	}
+}
+
+func TestSendOpts_publishing_traceHeaders(t *testing.T) {
+	shared := amqp.Table{"app": "ezmq"}
+	opts := NewSendOptsBuilder().SetMessageFactory(func(body []byte) amqp.Publishing {
+		return amqp.Publishing{Headers: shared, Body: body}
+	}).Build()
+	opts.traceHeaders = amqp.Table{HeaderTraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	msg, err := opts.publishing([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Headers["app"] != "ezmq" || msg.Headers[HeaderTraceParent] == nil {
+		t.Errorf("Headers = %v", msg.Headers)
+	}
+	if _, ok := shared[HeaderTraceParent]; ok {
+		t.Error("the factory's headers should not be modified")
+	}
+}
+
+func TestAbsReceiveListener_ConsumerContext(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	var got interface{}
+	lis := &AbsReceiveListener{ConsumerContextMethod: func(ctx context.Context, _ *amqp.Delivery) bool {
+		got = ctx.Value(key{})
+		return false
+	}}
+	lis.ConsumerContext(ctx, &amqp.Delivery{})
+	if got != "value" {
+		t.Errorf("ConsumerContextMethod got %v", got)
+	}
+
+	called := false
+	lis = &AbsReceiveListener{ConsumerMethod: func(*amqp.Delivery) bool {
+		called = true
+		return false
+	}}
+	lis.ConsumerContext(ctx, &amqp.Delivery{})
+	if !called {
+		t.Error("ConsumerContext should fall back to ConsumerMethod")
+	}
+}
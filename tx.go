@@ -0,0 +1,91 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	ErrConfirmMode = errors.New("channel is in confirm mode, transactions are not allowed")
+	ErrTxMode      = errors.New("channel is in transaction mode, confirm mode is not allowed")
+)
+
+// TxChannel 事务中的 Channel，只提供事务中可以安全执行的操作。
+// 在 WithTx 返回之前，发送和确认的消息不会生效。
+type TxChannel struct {
+	c *Channel
+}
+
+// Send 在事务中发送消息。opts 中的 retryable 会被忽略，事务提交成功即表示消息已被服务器接收。
+//
+// 参数 opts 如果为 nil，则表示使用默认配置。
+func (tx *TxChannel) Send(exchange string, routingKey string, body []byte, opts *SendOpts) error {
+	if opts == nil {
+		opts = DefaultSendOpts()
+	}
+	o := *opts
+	return tx.c.sendOpts(exchange, routingKey, body, &o)
+}
+
+// Ack 在事务中确认消息。消息必须是由同一个 Channel 接收的。
+func (tx *TxChannel) Ack(delivery *amqp.Delivery, multiple bool) error {
+	return tx.c.Ack(delivery.DeliveryTag, multiple)
+}
+
+// Nack 在事务中拒绝消息。消息必须是由同一个 Channel 接收的。
+func (tx *TxChannel) Nack(delivery *amqp.Delivery, multiple bool, requeue bool) error {
+	return tx.c.Nack(delivery.DeliveryTag, multiple, requeue)
+}
+
+// WithTx 在 AMQP 事务中执行 fn。fn 返回 nil 时提交事务；返回错误或 panic 时回滚事务（panic 会在回滚后继续抛出）。
+// 可以用于实现“消费-转换-发送”的原子操作：在 fn 中发送转换后的消息并确认原消息，两者要么同时生效，要么都不生效。
+//
+// 第一次调用 WithTx 后 Channel 会进入事务模式，之后不能再启用 Confirm Mode（即不能再使用带 retryable 的 SendOpts 发送消息）；
+// 同样，已经启用 Confirm Mode 的 Channel 不能使用 WithTx，此时返回 ErrConfirmMode。
+//
+// 注意：事务会极大地降低吞吐量，并且 fn 不能并发使用同一个 Channel。
+func (c *Channel) WithTx(fn func(tx *TxChannel) error) (err error) {
+	if c.confirming {
+		return ErrConfirmMode
+	}
+	if !c.transacting {
+		if err = c.Tx(); err != nil {
+			return err
+		}
+		c.transacting = true
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			if e := c.TxRollback(); e != nil {
+				c.conn.warn("rollback transaction failed:", e, c.logField())
+			}
+			panic(p)
+		}
+	}()
+	if err = fn(&TxChannel{c: c}); err != nil {
+		if e := c.TxRollback(); e != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, e)
+		}
+		return err
+	}
+	return c.TxCommit()
+}
@@ -0,0 +1,41 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChannel_WithTx_confirmExclusive(t *testing.T) {
+	confirming := &Channel{confirming: true}
+	err := confirming.WithTx(func(tx *TxChannel) error {
+		t.Error("fn should not be called in confirm mode")
+		return nil
+	})
+	if !errors.Is(err, ErrConfirmMode) {
+		t.Errorf("WithTx() error = %v, want %v", err, ErrConfirmMode)
+	}
+
+	transacting := &Channel{transacting: true}
+	if err = transacting.enableConfirm(); !errors.Is(err, ErrTxMode) {
+		t.Errorf("enableConfirm() error = %v, want %v", err, ErrTxMode)
+	}
+	if transacting.confirming {
+		t.Error("channel in transaction mode should not be confirming")
+	}
+}
@@ -0,0 +1,180 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"fmt"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Disposition 表示无法处理的消息（如解码失败）应当如何处置。
+//
+// 如果接收选项的 autoAck 为 true，消息在投递时已被服务器视为已确认，此时只有 DispositionStop 会生效。
+type Disposition int
+
+const (
+	// DispositionReject 拒绝消息且不重新入队。如果队列配置了死信交换器，消息会进入死信队列。
+	DispositionReject Disposition = iota
+	// DispositionRequeue 拒绝消息并重新入队。
+	DispositionRequeue
+	// DispositionAck 确认并丢弃消息。
+	DispositionAck
+	// DispositionStop 拒绝消息并重新入队，然后停止消费。
+	DispositionStop
+)
+
+// apply 按照 Disposition 处置消息，处置失败时通过 c 记录日志，fields 为额外的日志字段（如 Channel 和队列）。
+// 返回值 brk 表示是否需要终止消费。
+func (d Disposition) apply(c *Connection, delivery *amqp.Delivery, autoAck bool, fields ...interface{}) (brk bool) {
+	if autoAck {
+		return d == DispositionStop
+	}
+	var err error
+	switch d {
+	case DispositionRequeue:
+		err = delivery.Nack(false, true)
+	case DispositionAck:
+		err = delivery.Ack(false)
+	case DispositionStop:
+		err = delivery.Nack(false, true)
+		brk = true
+	default:
+		err = delivery.Nack(false, false)
+	}
+	if err != nil {
+		c.warn(append([]interface{}{"settle message failed:", err, consumerField(delivery.ConsumerTag), deliveryTagField(delivery.DeliveryTag)}, fields...)...)
+	}
+	return brk
+}
+
+// TypedProducer 使用 Codec 将 T 编码后发送。
+type TypedProducer[T any] struct {
+	p     *Producer
+	codec Codec
+}
+
+// NewTypedProducer 创建 TypedProducer。codec 如果为 nil，则使用 JSONCodec。
+func NewTypedProducer[T any](p *Producer, codec Codec) *TypedProducer[T] {
+	if codec == nil {
+		codec = JSONCodec
+	}
+	return &TypedProducer[T]{p: p, codec: codec}
+}
+
+// Send 编码并发送消息。消息的内容类型会被设置为 Codec 的内容类型，其他属性由 SendOpts 的消息工厂方法决定。
+//
+// 参数 opts 详见 Producer.Send。
+func (tp *TypedProducer[T]) Send(exchange string, routingKey string, msg T, opts *SendOpts) error {
+	body, err := tp.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = DefaultSendOpts()
+	}
+	o := *opts
+	o.messageFactory = CodecMessageFactory(tp.codec, o.messageFactory)
+	return tp.p.Send(exchange, routingKey, body, &o)
+}
+
+// TypedHandler 处理解码后的消息。返回值 brk 详见 ConsumerFunc。
+type TypedHandler[T any] func(msg T, delivery *amqp.Delivery) (brk bool)
+
+// TypedConsumer 根据消息的内容类型选择已注册的 Codec（见 RegisterCodec），将消息体解码为 T 后再交给 TypedHandler 处理。
+//
+// 如果消息没有内容类型，或内容类型未注册，则使用创建时指定的默认 Codec。
+// 解码失败的消息会按照 Disposition 处置（默认为 DispositionReject），不会交给 TypedHandler。
+type TypedConsumer[T any] struct {
+	c            *Consumer
+	codec        Codec
+	disposition  Disposition
+	onDecodeErr  func(delivery *amqp.Delivery, err error)
+	strictCodecs bool
+}
+
+// NewTypedConsumer 创建 TypedConsumer。codec 为默认 Codec，如果为 nil，则使用 JSONCodec。
+func NewTypedConsumer[T any](c *Consumer, codec Codec) *TypedConsumer[T] {
+	if codec == nil {
+		codec = JSONCodec
+	}
+	return &TypedConsumer[T]{c: c, codec: codec, disposition: DispositionReject}
+}
+
+// SetDecodeErrDisposition 设置解码失败的消息的处置方式
+func (tc *TypedConsumer[T]) SetDecodeErrDisposition(d Disposition) *TypedConsumer[T] {
+	tc.disposition = d
+	return tc
+}
+
+// SetDecodeErrHandler 设置解码失败时的回调，一般用于记录日志。回调在消息被处置之前调用。
+func (tc *TypedConsumer[T]) SetDecodeErrHandler(fn func(delivery *amqp.Delivery, err error)) *TypedConsumer[T] {
+	tc.onDecodeErr = fn
+	return tc
+}
+
+// SetStrictContentType 设为 true 时，内容类型未注册的消息被视为解码失败，而不是使用默认 Codec 解码。
+func (tc *TypedConsumer[T]) SetStrictContentType(b bool) *TypedConsumer[T] {
+	tc.strictCodecs = b
+	return tc
+}
+
+// Decode 根据消息的内容类型将消息体解码为 T
+func (tc *TypedConsumer[T]) Decode(delivery *amqp.Delivery) (T, error) {
+	var msg T
+	codec := tc.codec
+	if delivery.ContentType != "" {
+		if c, ok := CodecFor(delivery.ContentType); ok {
+			codec = c
+		} else if tc.strictCodecs {
+			return msg, fmt.Errorf("%w: %s", ErrUnknownContentType, delivery.ContentType)
+		}
+	}
+	err := codec.Unmarshal(delivery.Body, &msg)
+	return msg, err
+}
+
+// ConsumerFunc 将 TypedHandler 包装为 ConsumerFunc。autoAck 应与接收选项的 autoAck 一致。
+func (tc *TypedConsumer[T]) ConsumerFunc(handler TypedHandler[T], autoAck bool) ConsumerFunc {
+	if handler == nil {
+		panic("TypedHandler can't be nil")
+	}
+	return func(delivery *amqp.Delivery) (brk bool) {
+		msg, err := tc.Decode(delivery)
+		if err != nil {
+			if tc.onDecodeErr != nil {
+				tc.onDecodeErr(delivery, err)
+			} else {
+				tc.c.conn().warn("decode message failed:", err, consumerField(delivery.ConsumerTag), deliveryTagField(delivery.DeliveryTag))
+			}
+			return tc.disposition.apply(tc.c.conn(), delivery, autoAck)
+		}
+		return handler(msg, delivery)
+	}
+}
+
+// Receive 持续接收消息，解码后交给 handler 处理。参数 finish 可以为 nil。
+//
+// 详见 Consumer.Receive
+func (tc *TypedConsumer[T]) Receive(queue string, opts *ReceiveOpts, handler TypedHandler[T], finish func(err error)) *Subscription {
+	if opts == nil {
+		opts = DefaultReceiveOpts()
+	}
+	return tc.c.Receive(queue, opts, &AbsReceiveListener{
+		ConsumerMethod: tc.ConsumerFunc(handler, opts.autoAck),
+		FinishMethod:   finish,
+	})
+}
@@ -43,6 +43,16 @@ func Dial(url string, retryable Retryable) (*Connection, error) {
 	return conn, nil
 }
 
+// DialWithDialer 与 Dial 相同，但使用 dialer 连接服务器，详见 Dialer
+func DialWithDialer(url string, retryable Retryable, dialer Dialer) (*Connection, error) {
+	conn := NewConnection(url, retryable).SetDialer(dialer)
+	err := conn.Dial()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
 // 累加器。每次执行累加一定数额，返回一个 uint64。
 type Adder func() uint64
 
@@ -82,6 +92,21 @@ func getNonNilRetryable(retryable Retryable) Retryable {
 	return emptyRetryable
 }
 
+// cloneRetryable 返回与 retryable 配置相同、但尚未开始重试的 Retryable。
+// TimesRetry 会记录是否已放弃重试，多条消息共用同一个 Retryable 时，前一条消息放弃重试后，
+// 之后的消息也不会再重试，因此每条消息都需要使用独立的副本。CtxRetry 只会被主动放弃，因此保留该状态。
+func cloneRetryable(retryable Retryable) Retryable {
+	switch r := retryable.(type) {
+	case *TimesRetry:
+		return &TimesRetry{RetryTimes: r.RetryTimes, Interval: r.Interval, Always: r.Always}
+	case *CtxRetry:
+		r.RLock()
+		defer r.RUnlock()
+		return &CtxRetry{Ctx: r.Ctx, Interval: r.Interval, gaveUp: r.gaveUp}
+	}
+	return getNonNilRetryable(retryable)
+}
+
 func getNonNilMessageFactory(factory MessageFactory) MessageFactory {
 	if factory != nil {
 		return factory
@@ -250,7 +275,7 @@ var (
 	// JSON、非持久化消息工厂方法
 	MessageJsonTransient MessageFactory = func(body []byte) amqp.Publishing {
 		return amqp.Publishing{
-			ContentType:  "text/json",
+			ContentType:  ContentTypeJSON,
 			DeliveryMode: amqp.Transient,
 			Body:         body,
 		}
@@ -258,7 +283,7 @@ var (
 	// JSON、持久化消息工厂方法
 	MessageJsonPersistent MessageFactory = func(body []byte) amqp.Publishing {
 		return amqp.Publishing{
-			ContentType:  "text/json",
+			ContentType:  ContentTypeJSON,
 			DeliveryMode: amqp.Persistent,
 			Body:         body,
 		}
@@ -287,16 +312,37 @@ type ReceiveListener interface {
 	Remove(key string, ch *Channel)
 }
 
+// CancelListener 是 ReceiveListener 的可选接口。消费者被服务器取消时（如队列被删除、仲裁队列的 leader 发生迁移），
+// 会在重新订阅之前调用 Canceled，参数 err 包装了 ErrConsumerCanceled。
+type CancelListener interface {
+	Canceled(err error)
+}
+
+// ContextListener 是 ReceiveListener 的可选接口。实现了该接口的 ReceiveListener 会使用 ConsumerContext
+// 替代 Consumer 消费消息，详见 ContextConsumerFunc。
+type ContextListener interface {
+	ConsumerContext(ctx context.Context, delivery *amqp.Delivery) (brk bool)
+}
+
 // ReceiveListener 的抽象实现。
 //
-// 如果 ConsumerMethod 为 nil 或不赋值，将 panic;
-// 如果 FinishMethod 为 nil 或不赋值，则默认不做任何操作。
+// 如果 ConsumerMethod 和 ConsumerContextMethod 均为 nil 或不赋值，将 panic，两者都赋值时使用 ConsumerContextMethod;
+// 如果 FinishMethod 或 CancelMethod 为 nil 或不赋值，则默认不做任何操作。
 type AbsReceiveListener struct {
-	ConsumerMethod ConsumerFunc
-	FinishMethod   func(err error)
+	ConsumerMethod        ConsumerFunc
+	ConsumerContextMethod ContextConsumerFunc
+	FinishMethod          func(err error)
+	CancelMethod          func(err error)
 }
 
 func (lis *AbsReceiveListener) Consumer(delivery *amqp.Delivery) (brk bool) {
+	return lis.ConsumerContext(context.Background(), delivery)
+}
+
+func (lis *AbsReceiveListener) ConsumerContext(ctx context.Context, delivery *amqp.Delivery) (brk bool) {
+	if lis.ConsumerContextMethod != nil {
+		return lis.ConsumerContextMethod(ctx, delivery)
+	}
 	if lis.ConsumerMethod == nil {
 		panic("AbsReceiveListener.ConsumerMethod must not be nil")
 	}
@@ -310,6 +356,13 @@ func (lis *AbsReceiveListener) Finish(err error) {
 	lis.FinishMethod(err)
 }
 
+func (lis *AbsReceiveListener) Canceled(err error) {
+	if lis.CancelMethod == nil {
+		return
+	}
+	lis.CancelMethod(err)
+}
+
 func (lis *AbsReceiveListener) Remove(key string, ch *Channel) {
 	ch.RemoveOperation(key)
 }
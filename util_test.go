@@ -17,6 +17,7 @@
 package ezmq
 
 import (
+	"context"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"log"
@@ -114,3 +115,24 @@ func TestAbsReceiveListener_Remove(t *testing.T) {
 		log.Fatalf("Fail to remove! Expect: %v, actual: %v", expectLen, actualLen)
 	}
 }
+
+func TestCloneRetryable(t *testing.T) {
+	times := NewTimesRetry(false, time.Millisecond, 3)
+	times.GiveUp()
+	clone := cloneRetryable(times).(*TimesRetry)
+	if clone == times || clone.hasGaveUp() {
+		t.Errorf("cloneRetryable(TimesRetry) shares the given-up state")
+	}
+	if clone.RetryTimes != 3 || clone.Interval != time.Millisecond || clone.Always {
+		t.Errorf("cloneRetryable(TimesRetry) = %+v, want the same options", clone)
+	}
+
+	ctxRetry := NewCtxRetry(context.Background(), time.Millisecond)
+	ctxRetry.GiveUp()
+	if !cloneRetryable(ctxRetry).hasGaveUp() {
+		t.Error("cloneRetryable(CtxRetry) should keep the given-up state")
+	}
+	if cloneRetryable(nil) != emptyRetryable {
+		t.Error("cloneRetryable(nil) should return emptyRetryable")
+	}
+}
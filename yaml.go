@@ -0,0 +1,427 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine 去除注释和缩进后的一行
+type yamlLine struct {
+	indent int
+	text   string
+	no     int // 行号，从 1 开始
+}
+
+// yamlParser 解析 YAML 的一个子集，足以表示拓扑文件：
+//   - 块格式的映射和序列（包括 "- key: value" 形式的序列元素）
+//   - 流格式的映射和序列，如 {a: 1} 和 [a, b]
+//   - 普通、单引号和双引号的标量，以及注释和文档起始标记 ---
+//
+// 不支持锚点、别名、标签、多行标量（| 和 >）以及多文档。
+// 标量会被解析为 nil、bool、int64、float64 或 string，映射为 map[string]interface{}，序列为 []interface{}。
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func parseYAML(data []byte) (interface{}, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		line := strings.TrimRight(stripYAMLComment(strings.TrimRight(raw, "\r")), " \t")
+		text := strings.TrimLeft(line, " ")
+		if text == "" || len(p.lines) == 0 && text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed for indentation", i+1)
+		}
+		if text == "---" || text == "..." {
+			return nil, fmt.Errorf("yaml: line %d: multiple documents are not supported", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{indent: len(line) - len(text), text: text, no: i + 1})
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.parseNode(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf(p.lines[p.pos], "unexpected indentation")
+	}
+	return v, nil
+}
+
+// stripYAMLComment 去除引号之外的注释。# 必须位于行首或空白字符之后。
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func (p *yamlParser) errorf(line yamlLine, format string, args ...interface{}) error {
+	return fmt.Errorf("yaml: line %d: %s", line.no, fmt.Sprintf(format, args...))
+}
+
+// parseNode 解析缩进为 indent 的块
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	line := p.lines[p.pos]
+	if isSeqItem(line.text) {
+		return p.parseSeq(indent)
+	}
+	if isMapEntry(line.text) {
+		return p.parseMap(indent)
+	}
+	p.pos++
+	return parseYAMLValue(line.text, line)
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func isMapEntry(text string) bool {
+	_, _, ok := splitMapEntry(text)
+	return ok
+}
+
+func (p *yamlParser) parseSeq(indent int) ([]interface{}, error) {
+	seq := []interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent || line.indent == indent && !isSeqItem(line.text) {
+			// 与所属的键缩进相同的序列，在下一个键处结束
+			break
+		}
+		if line.indent > indent {
+			return nil, p.errorf(line, "unexpected indentation")
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		var (
+			v   interface{}
+			err error
+		)
+		switch {
+		case rest == "":
+			p.pos++
+			v, err = p.parseChild(indent)
+		case isSeqItem(rest) || isMapEntry(rest):
+			// 元素与 "- " 在同一行开始，将其视为缩进更深的块
+			p.lines[p.pos] = yamlLine{indent: line.indent + len(line.text) - len(rest), text: rest, no: line.no}
+			v, err = p.parseNode(p.lines[p.pos].indent)
+		default:
+			p.pos++
+			v, err = parseYAMLValue(rest, line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) parseMap(indent int) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		key, rest, ok := splitMapEntry(line.text)
+		if line.indent > indent || !ok {
+			return nil, p.errorf(line, "unexpected indentation")
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf(line, "duplicate key %q", key)
+		}
+		p.pos++
+		var (
+			v   interface{}
+			err error
+		)
+		switch {
+		case rest != "":
+			v, err = parseYAMLValue(rest, line)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && isSeqItem(p.lines[p.pos].text):
+			// 序列可以与所属的键缩进相同
+			v, err = p.parseSeq(indent)
+		default:
+			v, err = p.parseChild(indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// parseChild 解析缩进比 indent 更深的子块。如果没有子块，返回 nil。
+func (p *yamlParser) parseChild(indent int) (interface{}, error) {
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+		return nil, nil
+	}
+	return p.parseNode(p.lines[p.pos].indent)
+}
+
+// splitMapEntry 将 "key: value" 拆分为键和值
+func splitMapEntry(text string) (key, rest string, ok bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	start := 0
+	if text[0] == '"' || text[0] == '\'' {
+		n, err := quotedLen(text)
+		if err != nil {
+			return "", "", false
+		}
+		start = n
+	}
+	for i := start; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			key, err := parseYAMLKey(strings.TrimSpace(text[:i]))
+			if err != nil {
+				return "", "", false
+			}
+			return key, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func parseYAMLKey(s string) (string, error) {
+	if s != "" && (s[0] == '"' || s[0] == '\'') {
+		return unquoteYAML(s)
+	}
+	return s, nil
+}
+
+// quotedLen 返回以引号开头的字符串中，引号部分的长度
+func quotedLen(s string) (int, error) {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case q == '\'' && s[i] == q && i+1 < len(s) && s[i+1] == q:
+			i++
+		case s[i] == q:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated quoted string %s", s)
+}
+
+func unquoteYAML(s string) (string, error) {
+	if s[0] == '"' {
+		return strconv.Unquote(s)
+	}
+	if len(s) < 2 || s[len(s)-1] != '\'' {
+		return "", fmt.Errorf("unterminated quoted string %s", s)
+	}
+	return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+}
+
+// parseYAMLValue 解析一行中的值，可以是标量或流格式的映射、序列
+func parseYAMLValue(s string, line yamlLine) (interface{}, error) {
+	switch s[0] {
+	case '|', '>':
+		return nil, fmt.Errorf("yaml: line %d: block scalars are not supported", line.no)
+	case '&', '*', '!':
+		return nil, fmt.Errorf("yaml: line %d: anchors, aliases and tags are not supported", line.no)
+	case '[', '{', '"', '\'':
+	default:
+		// 块格式中的普通标量直到行尾
+		return resolveYAMLScalar(s), nil
+	}
+	f := &yamlFlow{s: s}
+	v, err := f.value()
+	if err == nil {
+		f.skipSpace()
+		if f.i < len(f.s) {
+			err = fmt.Errorf("unexpected %q", f.s[f.i:])
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("yaml: line %d: %v", line.no, err)
+	}
+	return v, nil
+}
+
+// yamlFlow 解析流格式的值
+type yamlFlow struct {
+	s string
+	i int
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.i < len(f.s) && f.s[f.i] == ' ' {
+		f.i++
+	}
+}
+
+func (f *yamlFlow) quoted() (string, error) {
+	n, err := quotedLen(f.s[f.i:])
+	if err != nil {
+		return "", err
+	}
+	s, err := unquoteYAML(f.s[f.i : f.i+n])
+	f.i += n
+	return s, err
+}
+
+func (f *yamlFlow) value() (interface{}, error) {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return nil, nil
+	}
+	switch f.s[f.i] {
+	case '[':
+		return f.seq()
+	case '{':
+		return f.mapping()
+	case '"', '\'':
+		return f.quoted()
+	}
+	// 流格式中的普通标量以 , ] } 结束
+	start := f.i
+	for f.i < len(f.s) && !strings.ContainsRune(",]}", rune(f.s[f.i])) {
+		f.i++
+	}
+	return resolveYAMLScalar(strings.TrimSpace(f.s[start:f.i])), nil
+}
+
+// key 解析流格式映射的键，普通的键以 ": " 或 , } 结束
+func (f *yamlFlow) key() (string, error) {
+	f.skipSpace()
+	if f.i < len(f.s) && (f.s[f.i] == '"' || f.s[f.i] == '\'') {
+		return f.quoted()
+	}
+	start := f.i
+	for f.i < len(f.s) && !strings.ContainsRune(",}", rune(f.s[f.i])) {
+		if f.s[f.i] == ':' && (f.i+1 == len(f.s) || f.s[f.i+1] == ' ') {
+			break
+		}
+		f.i++
+	}
+	return strings.TrimSpace(f.s[start:f.i]), nil
+}
+
+func (f *yamlFlow) seq() ([]interface{}, error) {
+	f.i++ // [
+	seq := []interface{}{}
+	for {
+		f.skipSpace()
+		if f.i < len(f.s) && f.s[f.i] == ']' {
+			f.i++
+			return seq, nil
+		}
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+		if err = f.separator(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *yamlFlow) mapping() (map[string]interface{}, error) {
+	f.i++ // {
+	m := map[string]interface{}{}
+	for {
+		f.skipSpace()
+		if f.i < len(f.s) && f.s[f.i] == '}' {
+			f.i++
+			return m, nil
+		}
+		key, err := f.key()
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpace()
+		if f.i >= len(f.s) || f.s[f.i] != ':' {
+			return nil, fmt.Errorf("missing ':' after key %q", key)
+		}
+		f.i++
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+		if err = f.separator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// separator 跳过 , 或者停在结束符 end 之前
+func (f *yamlFlow) separator(end byte) error {
+	f.skipSpace()
+	if f.i >= len(f.s) {
+		return fmt.Errorf("missing '%c'", end)
+	}
+	switch f.s[f.i] {
+	case ',':
+		f.i++
+		return nil
+	case end:
+		return nil
+	}
+	return fmt.Errorf("unexpected %q", f.s[f.i:])
+}
+
+// resolveYAMLScalar 将普通标量解析为 nil、bool、int64、float64 或 string
+func resolveYAMLScalar(s string) interface{} {
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if strings.ContainsAny(s, ".eE") && !strings.ContainsAny(s, " _") {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
@@ -0,0 +1,103 @@
+// ezmq: An easy golang amqp client.
+// Copyright (C) 2022  super9du
+//
+// This library is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// This library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with this library; If not, see <https://www.gnu.org/licenses/>.
+
+package ezmq
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	input := `
+--- # document start
+name: orders   # comment
+count: 3
+ratio: 0.5
+enabled: true
+empty:
+nothing: ~
+quoted: "a: b # not a comment"
+single: 'it''s'
+"quoted key": x
+list:
+  - a
+  - 'b'
+inline: [1, two, {k: v}]
+flow: {a: 1, b: [x, y], "c d": "e"}
+same_indent:
+- x
+- y
+nested:
+  - name: q1
+    args:
+      x-max-length: 10
+  - name: q2
+  -
+    - deep
+url: amqp://host:5672/vhost
+`
+	got, err := parseYAML([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"name":        "orders",
+		"count":       int64(3),
+		"ratio":       0.5,
+		"enabled":     true,
+		"empty":       nil,
+		"nothing":     nil,
+		"quoted":      "a: b # not a comment",
+		"single":      "it's",
+		"quoted key":  "x",
+		"list":        []interface{}{"a", "b"},
+		"inline":      []interface{}{int64(1), "two", map[string]interface{}{"k": "v"}},
+		"flow":        map[string]interface{}{"a": int64(1), "b": []interface{}{"x", "y"}, "c d": "e"},
+		"same_indent": []interface{}{"x", "y"},
+		"nested": []interface{}{
+			map[string]interface{}{"name": "q1", "args": map[string]interface{}{"x-max-length": int64(10)}},
+			map[string]interface{}{"name": "q2"},
+			[]interface{}{"deep"},
+		},
+		"url": "amqp://host:5672/vhost",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseYAML() = %#v\nwant %#v", got, want)
+	}
+}
+
+func TestParseYAML_errors(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"a: 1\n  b: 2", "line 2: unexpected indentation"},
+		{"a: 1\na: 2", `line 2: duplicate key "a"`},
+		{"a: |\n  text", "line 1: block scalars are not supported"},
+		{"a: &x 1", "line 1: anchors"},
+		{"a: [1, 2", "line 1: missing ']'"},
+		{"a: \"open", "line 1: unterminated"},
+		{"a: 1\n---\nb: 2", "line 2: multiple documents"},
+		{"- a\nb: 1", "line 2: unexpected indentation"},
+	}
+	for _, tt := range tests {
+		_, err := parseYAML([]byte(tt.input))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseYAML(%q) error = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}